@@ -0,0 +1,713 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: analytics.proto
+
+package analyticspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Batch struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Tenant is either the bundle scope uuid or organization and environment
+	BundleScopeUuid string             `protobuf:"bytes,1,opt,name=bundle_scope_uuid,json=bundleScopeUuid,proto3" json:"bundle_scope_uuid,omitempty"`
+	Organization    string             `protobuf:"bytes,2,opt,name=organization,proto3" json:"organization,omitempty"`
+	Environment     string             `protobuf:"bytes,3,opt,name=environment,proto3" json:"environment,omitempty"`
+	Records         []*AnalyticsRecord `protobuf:"bytes,4,rep,name=records,proto3" json:"records,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Batch) Reset() {
+	*x = Batch{}
+	mi := &file_analytics_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Batch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Batch) ProtoMessage() {}
+
+func (x *Batch) ProtoReflect() protoreflect.Message {
+	mi := &file_analytics_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Batch.ProtoReflect.Descriptor instead.
+func (*Batch) Descriptor() ([]byte, []int) {
+	return file_analytics_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Batch) GetBundleScopeUuid() string {
+	if x != nil {
+		return x.BundleScopeUuid
+	}
+	return ""
+}
+
+func (x *Batch) GetOrganization() string {
+	if x != nil {
+		return x.Organization
+	}
+	return ""
+}
+
+func (x *Batch) GetEnvironment() string {
+	if x != nil {
+		return x.Environment
+	}
+	return ""
+}
+
+func (x *Batch) GetRecords() []*AnalyticsRecord {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+// Fields which are not set are not added to the record
+type AnalyticsRecord struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// epoch milliseconds
+	ClientReceivedStartTimestamp int64  `protobuf:"varint,1,opt,name=client_received_start_timestamp,json=clientReceivedStartTimestamp,proto3" json:"client_received_start_timestamp,omitempty"`
+	ClientReceivedEndTimestamp   int64  `protobuf:"varint,2,opt,name=client_received_end_timestamp,json=clientReceivedEndTimestamp,proto3" json:"client_received_end_timestamp,omitempty"`
+	TargetSentStartTimestamp     int64  `protobuf:"varint,3,opt,name=target_sent_start_timestamp,json=targetSentStartTimestamp,proto3" json:"target_sent_start_timestamp,omitempty"`
+	TargetSentEndTimestamp       int64  `protobuf:"varint,4,opt,name=target_sent_end_timestamp,json=targetSentEndTimestamp,proto3" json:"target_sent_end_timestamp,omitempty"`
+	TargetReceivedStartTimestamp int64  `protobuf:"varint,5,opt,name=target_received_start_timestamp,json=targetReceivedStartTimestamp,proto3" json:"target_received_start_timestamp,omitempty"`
+	TargetReceivedEndTimestamp   int64  `protobuf:"varint,6,opt,name=target_received_end_timestamp,json=targetReceivedEndTimestamp,proto3" json:"target_received_end_timestamp,omitempty"`
+	ClientSentStartTimestamp     int64  `protobuf:"varint,7,opt,name=client_sent_start_timestamp,json=clientSentStartTimestamp,proto3" json:"client_sent_start_timestamp,omitempty"`
+	ClientSentEndTimestamp       int64  `protobuf:"varint,8,opt,name=client_sent_end_timestamp,json=clientSentEndTimestamp,proto3" json:"client_sent_end_timestamp,omitempty"`
+	ResponseStatusCode           int32  `protobuf:"varint,9,opt,name=response_status_code,json=responseStatusCode,proto3" json:"response_status_code,omitempty"`
+	TargetResponseCode           int32  `protobuf:"varint,10,opt,name=target_response_code,json=targetResponseCode,proto3" json:"target_response_code,omitempty"`
+	Apiproxy                     string `protobuf:"bytes,11,opt,name=apiproxy,proto3" json:"apiproxy,omitempty"`
+	ApiproxyRevision             string `protobuf:"bytes,12,opt,name=apiproxy_revision,json=apiproxyRevision,proto3" json:"apiproxy_revision,omitempty"`
+	Target                       string `protobuf:"bytes,13,opt,name=target,proto3" json:"target,omitempty"`
+	RequestVerb                  string `protobuf:"bytes,14,opt,name=request_verb,json=requestVerb,proto3" json:"request_verb,omitempty"`
+	RequestUri                   string `protobuf:"bytes,15,opt,name=request_uri,json=requestUri,proto3" json:"request_uri,omitempty"`
+	RequestPath                  string `protobuf:"bytes,16,opt,name=request_path,json=requestPath,proto3" json:"request_path,omitempty"`
+	Useragent                    string `protobuf:"bytes,17,opt,name=useragent,proto3" json:"useragent,omitempty"`
+	ClientIp                     string `protobuf:"bytes,18,opt,name=client_ip,json=clientIp,proto3" json:"client_ip,omitempty"`
+	XForwardedForIp              string `protobuf:"bytes,19,opt,name=x_forwarded_for_ip,json=xForwardedForIp,proto3" json:"x_forwarded_for_ip,omitempty"`
+	ClientId                     string `protobuf:"bytes,20,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	ApiProduct                   string `protobuf:"bytes,21,opt,name=api_product,json=apiProduct,proto3" json:"api_product,omitempty"`
+	AccessToken                  string `protobuf:"bytes,22,opt,name=access_token,json=accessToken,proto3" json:"access_token,omitempty"`
+	DeveloperApp                 string `protobuf:"bytes,23,opt,name=developer_app,json=developerApp,proto3" json:"developer_app,omitempty"`
+	DeveloperEmail               string `protobuf:"bytes,24,opt,name=developer_email,json=developerEmail,proto3" json:"developer_email,omitempty"`
+	// Custom dimensions added to the record as is.
+	// Well known fields above are not overwritten.
+	Dimensions    map[string]*DimensionValue `protobuf:"bytes,100,rep,name=dimensions,proto3" json:"dimensions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AnalyticsRecord) Reset() {
+	*x = AnalyticsRecord{}
+	mi := &file_analytics_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AnalyticsRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalyticsRecord) ProtoMessage() {}
+
+func (x *AnalyticsRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_analytics_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalyticsRecord.ProtoReflect.Descriptor instead.
+func (*AnalyticsRecord) Descriptor() ([]byte, []int) {
+	return file_analytics_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AnalyticsRecord) GetClientReceivedStartTimestamp() int64 {
+	if x != nil {
+		return x.ClientReceivedStartTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetClientReceivedEndTimestamp() int64 {
+	if x != nil {
+		return x.ClientReceivedEndTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetTargetSentStartTimestamp() int64 {
+	if x != nil {
+		return x.TargetSentStartTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetTargetSentEndTimestamp() int64 {
+	if x != nil {
+		return x.TargetSentEndTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetTargetReceivedStartTimestamp() int64 {
+	if x != nil {
+		return x.TargetReceivedStartTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetTargetReceivedEndTimestamp() int64 {
+	if x != nil {
+		return x.TargetReceivedEndTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetClientSentStartTimestamp() int64 {
+	if x != nil {
+		return x.ClientSentStartTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetClientSentEndTimestamp() int64 {
+	if x != nil {
+		return x.ClientSentEndTimestamp
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetResponseStatusCode() int32 {
+	if x != nil {
+		return x.ResponseStatusCode
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetTargetResponseCode() int32 {
+	if x != nil {
+		return x.TargetResponseCode
+	}
+	return 0
+}
+
+func (x *AnalyticsRecord) GetApiproxy() string {
+	if x != nil {
+		return x.Apiproxy
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetApiproxyRevision() string {
+	if x != nil {
+		return x.ApiproxyRevision
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetRequestVerb() string {
+	if x != nil {
+		return x.RequestVerb
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetRequestUri() string {
+	if x != nil {
+		return x.RequestUri
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetRequestPath() string {
+	if x != nil {
+		return x.RequestPath
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetUseragent() string {
+	if x != nil {
+		return x.Useragent
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetClientIp() string {
+	if x != nil {
+		return x.ClientIp
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetXForwardedForIp() string {
+	if x != nil {
+		return x.XForwardedForIp
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetApiProduct() string {
+	if x != nil {
+		return x.ApiProduct
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetAccessToken() string {
+	if x != nil {
+		return x.AccessToken
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetDeveloperApp() string {
+	if x != nil {
+		return x.DeveloperApp
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetDeveloperEmail() string {
+	if x != nil {
+		return x.DeveloperEmail
+	}
+	return ""
+}
+
+func (x *AnalyticsRecord) GetDimensions() map[string]*DimensionValue {
+	if x != nil {
+		return x.Dimensions
+	}
+	return nil
+}
+
+type DimensionValue struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Kind:
+	//
+	//	*DimensionValue_StringValue
+	//	*DimensionValue_IntValue
+	//	*DimensionValue_DoubleValue
+	//	*DimensionValue_BoolValue
+	Kind          isDimensionValue_Kind `protobuf_oneof:"kind"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DimensionValue) Reset() {
+	*x = DimensionValue{}
+	mi := &file_analytics_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DimensionValue) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DimensionValue) ProtoMessage() {}
+
+func (x *DimensionValue) ProtoReflect() protoreflect.Message {
+	mi := &file_analytics_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DimensionValue.ProtoReflect.Descriptor instead.
+func (*DimensionValue) Descriptor() ([]byte, []int) {
+	return file_analytics_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DimensionValue) GetKind() isDimensionValue_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return nil
+}
+
+func (x *DimensionValue) GetStringValue() string {
+	if x != nil {
+		if x, ok := x.Kind.(*DimensionValue_StringValue); ok {
+			return x.StringValue
+		}
+	}
+	return ""
+}
+
+func (x *DimensionValue) GetIntValue() int64 {
+	if x != nil {
+		if x, ok := x.Kind.(*DimensionValue_IntValue); ok {
+			return x.IntValue
+		}
+	}
+	return 0
+}
+
+func (x *DimensionValue) GetDoubleValue() float64 {
+	if x != nil {
+		if x, ok := x.Kind.(*DimensionValue_DoubleValue); ok {
+			return x.DoubleValue
+		}
+	}
+	return 0
+}
+
+func (x *DimensionValue) GetBoolValue() bool {
+	if x != nil {
+		if x, ok := x.Kind.(*DimensionValue_BoolValue); ok {
+			return x.BoolValue
+		}
+	}
+	return false
+}
+
+type isDimensionValue_Kind interface {
+	isDimensionValue_Kind()
+}
+
+type DimensionValue_StringValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type DimensionValue_IntValue struct {
+	IntValue int64 `protobuf:"varint,2,opt,name=int_value,json=intValue,proto3,oneof"`
+}
+
+type DimensionValue_DoubleValue struct {
+	DoubleValue float64 `protobuf:"fixed64,3,opt,name=double_value,json=doubleValue,proto3,oneof"`
+}
+
+type DimensionValue_BoolValue struct {
+	BoolValue bool `protobuf:"varint,4,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+func (*DimensionValue_StringValue) isDimensionValue_Kind() {}
+
+func (*DimensionValue_IntValue) isDimensionValue_Kind() {}
+
+func (*DimensionValue_DoubleValue) isDimensionValue_Kind() {}
+
+func (*DimensionValue_BoolValue) isDimensionValue_Kind() {}
+
+type PublishSummary struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	AcceptedBatches int64                  `protobuf:"varint,1,opt,name=accepted_batches,json=acceptedBatches,proto3" json:"accepted_batches,omitempty"`
+	// records of accepted batches, including ones dropped by sampling
+	AcceptedRecords int64         `protobuf:"varint,2,opt,name=accepted_records,json=acceptedRecords,proto3" json:"accepted_records,omitempty"`
+	Errors          []*BatchError `protobuf:"bytes,3,rep,name=errors,proto3" json:"errors,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *PublishSummary) Reset() {
+	*x = PublishSummary{}
+	mi := &file_analytics_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PublishSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PublishSummary) ProtoMessage() {}
+
+func (x *PublishSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_analytics_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PublishSummary.ProtoReflect.Descriptor instead.
+func (*PublishSummary) Descriptor() ([]byte, []int) {
+	return file_analytics_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PublishSummary) GetAcceptedBatches() int64 {
+	if x != nil {
+		return x.AcceptedBatches
+	}
+	return 0
+}
+
+func (x *PublishSummary) GetAcceptedRecords() int64 {
+	if x != nil {
+		return x.AcceptedRecords
+	}
+	return 0
+}
+
+func (x *PublishSummary) GetErrors() []*BatchError {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+type BatchError struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// index of the batch in the stream starting from 0
+	BatchIndex int64 `protobuf:"varint,1,opt,name=batch_index,json=batchIndex,proto3" json:"batch_index,omitempty"`
+	// same error codes as the HTTP API eg. UNKNOWN_SCOPE, BAD_DATA
+	ErrorCode     string `protobuf:"bytes,2,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"`
+	Reason        string `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchError) Reset() {
+	*x = BatchError{}
+	mi := &file_analytics_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchError) ProtoMessage() {}
+
+func (x *BatchError) ProtoReflect() protoreflect.Message {
+	mi := &file_analytics_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchError.ProtoReflect.Descriptor instead.
+func (*BatchError) Descriptor() ([]byte, []int) {
+	return file_analytics_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *BatchError) GetBatchIndex() int64 {
+	if x != nil {
+		return x.BatchIndex
+	}
+	return 0
+}
+
+func (x *BatchError) GetErrorCode() string {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return ""
+}
+
+func (x *BatchError) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+var File_analytics_proto protoreflect.FileDescriptor
+
+const file_analytics_proto_rawDesc = "" +
+	"\n" +
+	"\x0fanalytics.proto\x12\rapidanalytics\"\xb3\x01\n" +
+	"\x05Batch\x12*\n" +
+	"\x11bundle_scope_uuid\x18\x01 \x01(\tR\x0fbundleScopeUuid\x12\"\n" +
+	"\forganization\x18\x02 \x01(\tR\forganization\x12 \n" +
+	"\venvironment\x18\x03 \x01(\tR\venvironment\x128\n" +
+	"\arecords\x18\x04 \x03(\v2\x1e.apidanalytics.AnalyticsRecordR\arecords\"\x8a\n" +
+	"\n" +
+	"\x0fAnalyticsRecord\x12E\n" +
+	"\x1fclient_received_start_timestamp\x18\x01 \x01(\x03R\x1cclientReceivedStartTimestamp\x12A\n" +
+	"\x1dclient_received_end_timestamp\x18\x02 \x01(\x03R\x1aclientReceivedEndTimestamp\x12=\n" +
+	"\x1btarget_sent_start_timestamp\x18\x03 \x01(\x03R\x18targetSentStartTimestamp\x129\n" +
+	"\x19target_sent_end_timestamp\x18\x04 \x01(\x03R\x16targetSentEndTimestamp\x12E\n" +
+	"\x1ftarget_received_start_timestamp\x18\x05 \x01(\x03R\x1ctargetReceivedStartTimestamp\x12A\n" +
+	"\x1dtarget_received_end_timestamp\x18\x06 \x01(\x03R\x1atargetReceivedEndTimestamp\x12=\n" +
+	"\x1bclient_sent_start_timestamp\x18\a \x01(\x03R\x18clientSentStartTimestamp\x129\n" +
+	"\x19client_sent_end_timestamp\x18\b \x01(\x03R\x16clientSentEndTimestamp\x120\n" +
+	"\x14response_status_code\x18\t \x01(\x05R\x12responseStatusCode\x120\n" +
+	"\x14target_response_code\x18\n" +
+	" \x01(\x05R\x12targetResponseCode\x12\x1a\n" +
+	"\bapiproxy\x18\v \x01(\tR\bapiproxy\x12+\n" +
+	"\x11apiproxy_revision\x18\f \x01(\tR\x10apiproxyRevision\x12\x16\n" +
+	"\x06target\x18\r \x01(\tR\x06target\x12!\n" +
+	"\frequest_verb\x18\x0e \x01(\tR\vrequestVerb\x12\x1f\n" +
+	"\vrequest_uri\x18\x0f \x01(\tR\n" +
+	"requestUri\x12!\n" +
+	"\frequest_path\x18\x10 \x01(\tR\vrequestPath\x12\x1c\n" +
+	"\tuseragent\x18\x11 \x01(\tR\tuseragent\x12\x1b\n" +
+	"\tclient_ip\x18\x12 \x01(\tR\bclientIp\x12+\n" +
+	"\x12x_forwarded_for_ip\x18\x13 \x01(\tR\x0fxForwardedForIp\x12\x1b\n" +
+	"\tclient_id\x18\x14 \x01(\tR\bclientId\x12\x1f\n" +
+	"\vapi_product\x18\x15 \x01(\tR\n" +
+	"apiProduct\x12!\n" +
+	"\faccess_token\x18\x16 \x01(\tR\vaccessToken\x12#\n" +
+	"\rdeveloper_app\x18\x17 \x01(\tR\fdeveloperApp\x12'\n" +
+	"\x0fdeveloper_email\x18\x18 \x01(\tR\x0edeveloperEmail\x12N\n" +
+	"\n" +
+	"dimensions\x18d \x03(\v2..apidanalytics.AnalyticsRecord.DimensionsEntryR\n" +
+	"dimensions\x1a\\\n" +
+	"\x0fDimensionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x123\n" +
+	"\x05value\x18\x02 \x01(\v2\x1d.apidanalytics.DimensionValueR\x05value:\x028\x01\"\xa2\x01\n" +
+	"\x0eDimensionValue\x12#\n" +
+	"\fstring_value\x18\x01 \x01(\tH\x00R\vstringValue\x12\x1d\n" +
+	"\tint_value\x18\x02 \x01(\x03H\x00R\bintValue\x12#\n" +
+	"\fdouble_value\x18\x03 \x01(\x01H\x00R\vdoubleValue\x12\x1f\n" +
+	"\n" +
+	"bool_value\x18\x04 \x01(\bH\x00R\tboolValueB\x06\n" +
+	"\x04kind\"\x99\x01\n" +
+	"\x0ePublishSummary\x12)\n" +
+	"\x10accepted_batches\x18\x01 \x01(\x03R\x0facceptedBatches\x12)\n" +
+	"\x10accepted_records\x18\x02 \x01(\x03R\x0facceptedRecords\x121\n" +
+	"\x06errors\x18\x03 \x03(\v2\x19.apidanalytics.BatchErrorR\x06errors\"d\n" +
+	"\n" +
+	"BatchError\x12\x1f\n" +
+	"\vbatch_index\x18\x01 \x01(\x03R\n" +
+	"batchIndex\x12\x1d\n" +
+	"\n" +
+	"error_code\x18\x02 \x01(\tR\terrorCode\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason2V\n" +
+	"\x12AnalyticsIngestion\x12@\n" +
+	"\aPublish\x12\x14.apidanalytics.Batch\x1a\x1d.apidanalytics.PublishSummary(\x01B+Z)github.com/apid/apidAnalytics/analyticspbb\x06proto3"
+
+var (
+	file_analytics_proto_rawDescOnce sync.Once
+	file_analytics_proto_rawDescData []byte
+)
+
+func file_analytics_proto_rawDescGZIP() []byte {
+	file_analytics_proto_rawDescOnce.Do(func() {
+		file_analytics_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_analytics_proto_rawDesc), len(file_analytics_proto_rawDesc)))
+	})
+	return file_analytics_proto_rawDescData
+}
+
+var file_analytics_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_analytics_proto_goTypes = []any{
+	(*Batch)(nil),           // 0: apidanalytics.Batch
+	(*AnalyticsRecord)(nil), // 1: apidanalytics.AnalyticsRecord
+	(*DimensionValue)(nil),  // 2: apidanalytics.DimensionValue
+	(*PublishSummary)(nil),  // 3: apidanalytics.PublishSummary
+	(*BatchError)(nil),      // 4: apidanalytics.BatchError
+	nil,                     // 5: apidanalytics.AnalyticsRecord.DimensionsEntry
+}
+var file_analytics_proto_depIdxs = []int32{
+	1, // 0: apidanalytics.Batch.records:type_name -> apidanalytics.AnalyticsRecord
+	5, // 1: apidanalytics.AnalyticsRecord.dimensions:type_name -> apidanalytics.AnalyticsRecord.DimensionsEntry
+	4, // 2: apidanalytics.PublishSummary.errors:type_name -> apidanalytics.BatchError
+	2, // 3: apidanalytics.AnalyticsRecord.DimensionsEntry.value:type_name -> apidanalytics.DimensionValue
+	0, // 4: apidanalytics.AnalyticsIngestion.Publish:input_type -> apidanalytics.Batch
+	3, // 5: apidanalytics.AnalyticsIngestion.Publish:output_type -> apidanalytics.PublishSummary
+	5, // [5:6] is the sub-list for method output_type
+	4, // [4:5] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_analytics_proto_init() }
+func file_analytics_proto_init() {
+	if File_analytics_proto != nil {
+		return
+	}
+	file_analytics_proto_msgTypes[2].OneofWrappers = []any{
+		(*DimensionValue_StringValue)(nil),
+		(*DimensionValue_IntValue)(nil),
+		(*DimensionValue_DoubleValue)(nil),
+		(*DimensionValue_BoolValue)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_analytics_proto_rawDesc), len(file_analytics_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_analytics_proto_goTypes,
+		DependencyIndexes: file_analytics_proto_depIdxs,
+		MessageInfos:      file_analytics_proto_msgTypes,
+	}.Build()
+	File_analytics_proto = out.File
+	file_analytics_proto_goTypes = nil
+	file_analytics_proto_depIdxs = nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: analytics.proto
+
+package analyticspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AnalyticsIngestion_Publish_FullMethodName = "/apidanalytics.AnalyticsIngestion/Publish"
+)
+
+// AnalyticsIngestionClient is the client API for AnalyticsIngestion service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Ingestion of analytics records over gRPC as an alternative
+// to POST /analytics/{bundle_scope_uuid} and POST /analytics
+type AnalyticsIngestionClient interface {
+	// Each batch is validated, enriched and published like the body of a
+	// POST request. When the client closes the stream, the summary has
+	// the error of each batch which was rejected.
+	Publish(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Batch, PublishSummary], error)
+}
+
+type analyticsIngestionClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAnalyticsIngestionClient(cc grpc.ClientConnInterface) AnalyticsIngestionClient {
+	return &analyticsIngestionClient{cc}
+}
+
+func (c *analyticsIngestionClient) Publish(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Batch, PublishSummary], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AnalyticsIngestion_ServiceDesc.Streams[0], AnalyticsIngestion_Publish_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Batch, PublishSummary]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnalyticsIngestion_PublishClient = grpc.ClientStreamingClient[Batch, PublishSummary]
+
+// AnalyticsIngestionServer is the server API for AnalyticsIngestion service.
+// All implementations must embed UnimplementedAnalyticsIngestionServer
+// for forward compatibility.
+//
+// Ingestion of analytics records over gRPC as an alternative
+// to POST /analytics/{bundle_scope_uuid} and POST /analytics
+type AnalyticsIngestionServer interface {
+	// Each batch is validated, enriched and published like the body of a
+	// POST request. When the client closes the stream, the summary has
+	// the error of each batch which was rejected.
+	Publish(grpc.ClientStreamingServer[Batch, PublishSummary]) error
+	mustEmbedUnimplementedAnalyticsIngestionServer()
+}
+
+// UnimplementedAnalyticsIngestionServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAnalyticsIngestionServer struct{}
+
+func (UnimplementedAnalyticsIngestionServer) Publish(grpc.ClientStreamingServer[Batch, PublishSummary]) error {
+	return status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedAnalyticsIngestionServer) mustEmbedUnimplementedAnalyticsIngestionServer() {}
+func (UnimplementedAnalyticsIngestionServer) testEmbeddedByValue()                            {}
+
+// UnsafeAnalyticsIngestionServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AnalyticsIngestionServer will
+// result in compilation errors.
+type UnsafeAnalyticsIngestionServer interface {
+	mustEmbedUnimplementedAnalyticsIngestionServer()
+}
+
+func RegisterAnalyticsIngestionServer(s grpc.ServiceRegistrar, srv AnalyticsIngestionServer) {
+	// If the following call pancis, it indicates UnimplementedAnalyticsIngestionServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AnalyticsIngestion_ServiceDesc, srv)
+}
+
+func _AnalyticsIngestion_Publish_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AnalyticsIngestionServer).Publish(&grpc.GenericServerStream[Batch, PublishSummary]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnalyticsIngestion_PublishServer = grpc.ClientStreamingServer[Batch, PublishSummary]
+
+// AnalyticsIngestion_ServiceDesc is the grpc.ServiceDesc for AnalyticsIngestion service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AnalyticsIngestion_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "apidanalytics.AnalyticsIngestion",
+	HandlerType: (*AnalyticsIngestionServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Publish",
+			Handler:       _AnalyticsIngestion_Publish_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "analytics.proto",
+}
@@ -36,9 +36,33 @@ func initAPI(services apid.Services) {
 	log.Debug("initialized API's exposed by apidAnalytics plugin")
 	analyticsBasePath = config.GetString(configAnalyticsBasePath)
 	services.API().HandleFunc(analyticsBasePath+"/{bundle_scope_uuid}",
-		saveAnalyticsRecord).Methods("POST")
+		withAuth(saveAnalyticsRecord, false)).Methods("POST")
 	services.API().HandleFunc(analyticsBasePath,
-		processAnalyticsRecord).Methods("POST")
+		withAuth(processAnalyticsRecord, false)).Methods("POST")
+	services.API().HandleFunc(analyticsBasePath+"/query",
+		withAuth(queryAnalytics, false)).Methods("GET")
+	services.API().HandleFunc(analyticsBasePath+"/tail",
+		withAuth(tailAnalytics, false)).Methods("GET")
+	services.API().HandleFunc(analyticsBasePath+"/admin/config",
+		withAuth(getConfig, true)).Methods("GET")
+	services.API().HandleFunc(analyticsBasePath+"/admin/config",
+		withAuth(reloadConfig, true)).Methods("PUT")
+	services.API().HandleFunc(analyticsBasePath+"/admin/ratelimits",
+		withAuth(getRateLimitCounters, true)).Methods("GET")
+	services.API().HandleFunc(analyticsBasePath+"/admin/failed",
+		withAuth(getFailedUploads, true)).Methods("GET")
+	services.API().HandleFunc(analyticsBasePath+"/admin/failed",
+		withAuth(deleteFailedUploads, true)).Methods("DELETE")
+	services.API().HandleFunc(analyticsBasePath+"/admin/failed/retry",
+		withAuth(retryFailedUploadsHandler, true)).Methods("POST")
+	services.API().HandleFunc(analyticsBasePath+"/admin/failed/{failed_dir}",
+		withAuth(deleteFailedUploads, true)).Methods("DELETE")
+	services.API().HandleFunc(analyticsBasePath+"/admin/failed/{failed_dir}/retry",
+		withAuth(retryFailedUploadsHandler, true)).Methods("POST")
+	services.API().HandleFunc(analyticsBasePath+"/admin/failed/{failed_dir}/download",
+		withAuth(downloadFailedDir, true)).Methods("GET")
+	services.API().HandleFunc(analyticsBasePath+"/admin/uploads",
+		withAuth(getUploadLedger, true)).Methods("GET")
 }
 
 func saveAnalyticsRecord(w http.ResponseWriter, r *http.Request) {
@@ -72,9 +96,24 @@ func saveAnalyticsRecord(w http.ResponseWriter, r *http.Request) {
 				"UNKNOWN_SCOPE", dbErr.Reason)
 		}
 	} else {
+		orgEnv := getKeyForOrgEnvCache(tenant.Org, tenant.Env)
+		if !authorizedForScope(w, r, scopeuuid, orgEnv) {
+			return
+		}
+		reqBody := &countingReader{ReadCloser: r.Body}
+		r.Body = reqBody
 		body, err := getJsonBody(r)
 		if err.ErrorCode == "" {
+			idempotent, duplicate := beginIdempotentRequest(w, r, orgEnv)
+			if duplicate {
+				return
+			}
+			defer idempotent.abandon()
+			if !allowedByRateLimit(w, []string{scopeuuid, orgEnv}, body, reqBody) {
+				return
+			}
 			err = validateEnrichPublish(tenant, body)
+			idempotent.complete(err)
 			if err.ErrorCode == "" {
 				w.WriteHeader(http.StatusOK)
 				return
@@ -102,6 +141,8 @@ func processAnalyticsRecord(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reqBody := &countingReader{ReadCloser: r.Body}
+	r.Body = reqBody
 	body, err := getJsonBody(r)
 	if err.ErrorCode == "" {
 		tenant, e := getTenantFromPayload(body)
@@ -118,7 +159,20 @@ func processAnalyticsRecord(w http.ResponseWriter, r *http.Request) {
 				}
 				return
 			} else {
+				orgEnv := getKeyForOrgEnvCache(tenant.Org, tenant.Env)
+				if !authorizedForScope(w, r, orgEnv) {
+					return
+				}
+				idempotent, duplicate := beginIdempotentRequest(w, r, orgEnv)
+				if duplicate {
+					return
+				}
+				defer idempotent.abandon()
+				if !allowedByRateLimit(w, []string{orgEnv}, body, reqBody) {
+					return
+				}
 				err = validateEnrichPublish(tenant, body)
+				idempotent.complete(err)
 				if err.ErrorCode == "" {
 					w.WriteHeader(http.StatusOK)
 					return
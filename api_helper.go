@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -101,6 +102,32 @@ func getTenantFromPayload(raw map[string]interface{}) (tenant, errResponse) {
 	return tenant{Org: org, Env: env}, errResponse{}
 }
 
+/*
+Get tenant of a batch which is not sent over HTTP from the bundle scope uuid
+if given, else from organization and environment which are validated
+*/
+func getTenantForBatch(scopeuuid, org, env string) (tenant, errResponse) {
+	var t tenant
+	var dbErr dbError
+	if scopeuuid != "" {
+		t, dbErr = getTenantForScope(scopeuuid)
+	} else {
+		var e errResponse
+		t, e = getTenantFromPayload(map[string]interface{}{
+			"organization": org,
+			"environment":  env,
+		})
+		if e.ErrorCode != "" {
+			return t, e
+		}
+		_, dbErr = validateTenant(t)
+	}
+	if dbErr.ErrorCode != "" {
+		return t, errResponse{ErrorCode: dbErr.ErrorCode, Reason: dbErr.Reason}
+	}
+	return t, errResponse{}
+}
+
 func validateEnrichPublish(tenant tenant, raw map[string]interface{}) errResponse {
 	if records := raw["records"]; records != nil {
 		records, isArray := records.([]interface{})
@@ -115,6 +142,7 @@ func validateEnrichPublish(tenant tenant, raw map[string]interface{}) errRespons
 				Reason:    "No analytics records in the payload"}
 		}
 		// Iterate through each record to validate and enrich it
+		sampled := make([]interface{}, 0, len(records))
 		for _, eachRecord := range records {
 			recordMap, isMap := eachRecord.(map[string]interface{})
 			if !isMap {
@@ -124,17 +152,26 @@ func validateEnrichPublish(tenant tenant, raw map[string]interface{}) errRespons
 			}
 			valid, err := validate(recordMap)
 			if valid {
-				enrich(recordMap, tenant)
+				if sampleRecord(tenant, recordMap) {
+					enrich(recordMap, tenant)
+					enrichGeo(recordMap)
+					enrichUserAgent(recordMap)
+					sampled = append(sampled, recordMap)
+				}
 			} else {
 				// Even if there is one bad record, then reject entire batch
 				return err
 			}
 		}
+		if len(sampled) == 0 {
+			return errResponse{}
+		}
 		axRecords := axRecords{
 			Tenant:  tenant,
-			Records: records}
+			Records: sampled}
 		// publish batch of records to channel (blocking call)
-		internalBuffer <- axRecords
+		publishRecords(axRecords)
+		publishToTail(tenant, sampled)
 	} else {
 		return errResponse{
 			ErrorCode: "NO_RECORDS",
@@ -148,8 +185,14 @@ Does basic validation on each analytics message
 1. client_received_start_timestamp, client_received_end_timestamp should exist
 2. client_received_start_timestamp, client_received_end_timestamp should be a number
 3. client_received_end_timestamp should be > client_received_start_timestamp and not 0
+4. client_received_start_timestamp should not be after current time plus allowed
+clock skew or older than max record age
+5. client_* and target_* timestamps should be in order if it is enabled
 */
 func validate(recordMap map[string]interface{}) (bool, errResponse) {
+	if config.GetBool(analyticsNormalizeTimestamps) {
+		normalizeTimestamps(recordMap)
+	}
 	elems := []string{"client_received_start_timestamp", "client_received_end_timestamp"}
 	for _, elem := range elems {
 		if recordMap[elem] == nil {
@@ -174,40 +217,51 @@ func validate(recordMap map[string]interface{}) (bool, errResponse) {
 				ErrorCode: "BAD_DATA",
 				Reason: "client_received_start_timestamp or " +
 					"client_received_end_timestamp cannot be 0"}
-		} else if crst > cret {
+		} else if crstMs, cretMs := getTimestampMs(crst), getTimestampMs(cret); crstMs > cretMs {
 			return false, errResponse{
 				ErrorCode: "BAD_DATA",
 				Reason: "client_received_start_timestamp " +
 					"> client_received_end_timestamp"}
 		} else {
-			ts, _ := crst.Int64()
-			crstTime := time.Unix(ts/1000, 0) // Convert crst(ms) to seconds
+			crstTime := time.Unix(crstMs/1000, 0) // Convert crst(ms) to seconds
 			diff := time.Now().UTC().Sub(crstTime)
-			if diff <= 0 {
+			skew := time.Duration(config.GetInt(analyticsMaxClockSkew)) * time.Second
+			maxAgeDays := config.GetInt(analyticsMaxRecordAge)
+			if diff <= -skew {
 				return false, errResponse{
 					ErrorCode: "BAD_DATA",
 					Reason: "client_received_start_timestamp " +
 						"cannot be after current time"}
-			} else if diff.Hours() > 90*24 { // 90 Days
+			} else if diff.Hours() > float64(maxAgeDays*24) {
 				return false, errResponse{
 					ErrorCode: "BAD_DATA",
 					Reason: "client_received_start_timestamp " +
-						"cannot be older than 90 days"}
-			} else {
-				return true, errResponse{}
+						"cannot be older than " + strconv.Itoa(maxAgeDays) + " days"}
+			} else if config.GetBool(analyticsValidateTimestampOrder) {
+				return validateTimestampOrder(recordMap)
 			}
 		}
 	}
 	return true, errResponse{}
 }
 
+// Numbers with a fraction are truncated
+func getTimestampMs(n json.Number) int64 {
+	if ms, err := n.Int64(); err == nil {
+		return ms
+	}
+	f, _ := n.Float64()
+	return int64(f)
+}
+
 /*
-Enrich each record by adding org and env fields
+Enrich each record by adding org and env fields and derived latencies
 */
 func enrich(recordMap map[string]interface{}, tenant tenant) {
 	// Always overwrite organization/environment value with the tenant information provided in the payload
 	recordMap["organization"] = tenant.Org
 	recordMap["environment"] = tenant.Env
+	addDerivedFields(recordMap)
 }
 
 func writeError(w http.ResponseWriter, status int, code string, reason string) {
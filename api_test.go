@@ -331,6 +331,24 @@ func getRequestWithScope(scope string, payload []byte) *http.Request {
 	return req
 }
 
+// Admin API's are only available if authentication
+// is configured, so a bearer token is used for them
+func makeAdminRequest(req *http.Request) (*http.Response, []byte) {
+	config.Set(analyticsAuthMethods, authMethodBearer)
+	config.Set(analyticsAuthBearerToken, "admintoken")
+	defer func() {
+		config.Set(analyticsAuthMethods, "")
+		config.Set(analyticsAuthBearerToken, "")
+	}()
+
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res, err := client.Do(req)
+	Expect(err).ShouldNot(HaveOccurred())
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res, body
+}
+
 func makeRequest(req *http.Request) (*http.Response, errResponse) {
 	res, err := client.Do(req)
 	Expect(err).ShouldNot(HaveOccurred())
@@ -81,10 +81,24 @@ var _ = BeforeSuite(func() {
 })
 
 func mockUAPCollection(w http.ResponseWriter, req *http.Request) {
-	if req.Header.Get("Authorization") == "" {
+	if req.Header.Get("Authorization") == "" ||
+		req.Header.Get("Authorization") == "Bearer expiredtoken" {
 		w.WriteHeader(http.StatusUnauthorized)
 	} else {
-		if req.URL.Query().Get("tenant") == "testorg~testenv" {
+		paths := req.URL.Query()["relative_file_path"]
+		if req.URL.Query().Get("tenant") == "testorg~testenv" && len(paths) > 1 {
+			w.WriteHeader(http.StatusOK)
+
+			urls := make(map[string]interface{})
+			for _, path := range paths {
+				urls[path] = testServer.URL + "/upload?awskey=xxxx"
+			}
+			body := map[string]interface{}{"urls": urls, "expires_in": 60}
+			bytes, _ := json.Marshal(body)
+			w.Write(bytes)
+		} else if req.URL.Query().Get("tenant") == "forbiddenorg~testenv" {
+			w.WriteHeader(http.StatusForbidden)
+		} else if req.URL.Query().Get("tenant") == "testorg~testenv" {
 			w.WriteHeader(http.StatusOK)
 
 			body := make(map[string]interface{})
@@ -106,6 +120,9 @@ func mockFinalDatastore(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 	case "forbidden":
 		w.WriteHeader(http.StatusForbidden)
+	case "badChecksum":
+		w.Header().Set("ETag", `"00000000000000000000000000000000"`)
+		w.WriteHeader(http.StatusOK)
 	default:
 		w.WriteHeader(http.StatusOK)
 	}
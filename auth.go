@@ -0,0 +1,310 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Implements pluggable authentication for the API's exposed by this plugin.
+Each configured authenticator is tried in order and the request is
+accepted if any of them is able to identify the caller.
+*/
+
+const (
+	authMethodBearer     = "bearer"
+	authMethodHMAC       = "hmac"
+	authMethodClientCert = "clientcert"
+
+	// Headers used for HMAC request signature
+	hmacTimestampHeader = "X-Apid-Timestamp"
+	hmacSignatureHeader = "X-Apid-Signature"
+
+	// Scope that allows access to all tenants and admin API's
+	allScopes = "*"
+)
+
+type authContextKey struct{}
+
+// Identity of the caller and the scopes i.e. org~env
+// or bundle scope uuid it is allowed to post data for
+type authIdentity struct {
+	Name   string
+	Scopes map[string]bool
+}
+
+type authenticator interface {
+	// Returns identity of the caller if the request could be
+	// authenticated by this authenticator, nil otherwise
+	authenticate(r *http.Request, body []byte) *authIdentity
+}
+
+// Map from client certificate common name to allowed scopes
+var clientCertScopes map[string][]string
+
+// RW lock for clientCertScopes since the mapping
+// can be reloaded while requests are authenticated
+var clientCertScopesLock = sync.RWMutex{}
+
+// Load client certificate identity to scopes mapping if configured
+func initAuth() error {
+	path := config.GetString(analyticsAuthClientCertScopes)
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read client certificate "+
+			"scopes file '%s': %v", path, err)
+	}
+	var scopes map[string][]string
+	if err := json.Unmarshal(b, &scopes); err != nil {
+		return fmt.Errorf("Cannot parse client certificate "+
+			"scopes file '%s': %v", path, err)
+	}
+	clientCertScopesLock.Lock()
+	clientCertScopes = scopes
+	clientCertScopesLock.Unlock()
+	log.Infof("Loaded scopes for %d client certificate identities", len(scopes))
+	return nil
+}
+
+func getAuthenticators() []authenticator {
+	var authenticators []authenticator
+	methods := config.GetString(analyticsAuthMethods)
+	for _, method := range strings.Split(methods, ",") {
+		switch strings.TrimSpace(method) {
+		case authMethodBearer:
+			authenticators = append(authenticators, bearerAuthenticator{})
+		case authMethodHMAC:
+			authenticators = append(authenticators, hmacAuthenticator{})
+		case authMethodClientCert:
+			authenticators = append(authenticators, clientCertAuthenticator{})
+		}
+	}
+	return authenticators
+}
+
+/*
+Wraps a handler to authenticate each request before it is processed.
+Admin API's can only be accessed by identities that are allowed all scopes,
+so they are not available at all if authentication is not configured.
+*/
+func withAuth(handler http.HandlerFunc, admin bool) http.HandlerFunc {
+	return authenticateRequest(handler, admin, true)
+}
+
+// Streamed requests (i.e. gRPC calls) are not read before they are
+// handled, so HMAC signature is computed without the body for them
+func withStreamAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return authenticateRequest(handler, false, false)
+}
+
+func authenticateRequest(handler http.HandlerFunc, admin, signedBody bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxSize := int64(config.GetInt(analyticsMaxPayloadSize))
+		if signedBody && r.Body != nil && maxSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+
+		authenticators := getAuthenticators()
+		if len(authenticators) == 0 {
+			if admin {
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				writeError(w, http.StatusForbidden, "FORBIDDEN",
+					"Admin API is not available if authentication is not configured")
+				return
+			}
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+		var body []byte
+		if signedBody && config.GetString(analyticsAuthHMACSecret) != "" && r.Body != nil {
+			// Body is needed to verify signature so read it
+			// and replace it for the handler to read again
+			var err error
+			body, err = ioutil.ReadAll(r.Body)
+			if err != nil && maxSize > 0 && int64(len(body)) >= maxSize {
+				writeError(w, http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE",
+					fmt.Sprintf("Request body is larger than %d bytes", maxSize))
+				return
+			} else if err != nil {
+				writeError(w, http.StatusBadRequest, "BAD_DATA",
+					"Request body cannot be read")
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		var identity *authIdentity
+		for _, a := range authenticators {
+			if identity = a.authenticate(r, body); identity != nil {
+				break
+			}
+		}
+
+		if identity == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED",
+				"Request could not be authenticated")
+			return
+		}
+		if admin && !identity.Scopes[allScopes] {
+			writeError(w, http.StatusForbidden, "FORBIDDEN",
+				identity.Name+" is not allowed to access admin API")
+			return
+		}
+		ctx := context.WithValue(r.Context(), authContextKey{}, identity)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// Checks if the caller is allowed to post data for any of the given scopes
+// and writes error response if not. Returns true if request can be processed.
+func authorizedForScope(w http.ResponseWriter, r *http.Request, scopes ...string) bool {
+	if e := checkScope(r.Context(), scopes...); e.ErrorCode != "" {
+		writeError(w, http.StatusForbidden, e.ErrorCode, e.Reason)
+		return false
+	}
+	return true
+}
+
+// Returns FORBIDDEN error if the caller is not allowed
+// to post data for any of the given scopes
+func checkScope(ctx context.Context, scopes ...string) errResponse {
+	identity, ok := ctx.Value(authContextKey{}).(*authIdentity)
+	if !ok {
+		// authentication is not configured
+		return errResponse{}
+	}
+	if identity.Scopes[allScopes] {
+		return errResponse{}
+	}
+	for _, scope := range scopes {
+		if identity.Scopes[scope] {
+			return errResponse{}
+		}
+	}
+	return errResponse{
+		ErrorCode: "FORBIDDEN",
+		Reason: identity.Name + " is not allowed to post data for " +
+			strings.Join(scopes, ", ")}
+}
+
+// Shared bearer token configured on apid and the gateways
+type bearerAuthenticator struct{}
+
+func (bearerAuthenticator) authenticate(r *http.Request, body []byte) *authIdentity {
+	expected := config.GetString(analyticsAuthBearerToken)
+	auth := r.Header.Get("Authorization")
+	if expected == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return nil
+	}
+	return &authIdentity{
+		Name:   authMethodBearer,
+		Scopes: map[string]bool{allScopes: true}}
+}
+
+/*
+HMAC-SHA256 signature of the request using a shared secret.
+Signature is hex encoded and computed over
+<timestamp>\n<method>\n<request uri>\n<body>
+where timestamp is the epoch seconds sent in X-Apid-Timestamp header and
+request uri is the path with the query string eg. /analytics/query?org=x&env=y
+so that query parameters cannot be changed.
+Requests with timestamp outside the allowed skew are rejected to prevent replays.
+*/
+type hmacAuthenticator struct{}
+
+func (hmacAuthenticator) authenticate(r *http.Request, body []byte) *authIdentity {
+	secret := config.GetString(analyticsAuthHMACSecret)
+	timestamp := r.Header.Get(hmacTimestampHeader)
+	signature := r.Header.Get(hmacSignatureHeader)
+	if secret == "" || timestamp == "" || signature == "" {
+		return nil
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil
+	}
+	skew := time.Since(time.Unix(ts, 0)).Seconds()
+	if math.Abs(skew) > float64(config.GetInt(analyticsAuthHMACMaxSkew)) {
+		log.Debugf("Rejecting signed request with timestamp %s", timestamp)
+		return nil
+	}
+
+	expected := computeSignature(secret, timestamp, r.Method, r.URL.RequestURI(), body)
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(actual, expected) {
+		return nil
+	}
+	return &authIdentity{
+		Name:   authMethodHMAC,
+		Scopes: map[string]bool{allScopes: true}}
+}
+
+func computeSignature(secret, timestamp, method, requestURI string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + requestURI + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Client certificate verified by the TLS server where the
+// common name is mapped to allowed scopes in a configured file
+type clientCertAuthenticator struct{}
+
+func (clientCertAuthenticator) authenticate(r *http.Request, body []byte) *authIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+		len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+
+	clientCertScopesLock.RLock()
+	scopes := clientCertScopes[name]
+	clientCertScopesLock.RUnlock()
+
+	// Identity without any scopes is authenticated
+	// but not allowed to post data for any tenant
+	identity := &authIdentity{Name: name, Scopes: make(map[string]bool)}
+	for _, scope := range scopes {
+		identity.Scopes[scope] = true
+	}
+	return identity
+}
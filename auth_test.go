@@ -0,0 +1,221 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test withAuth()", func() {
+	var handlerBody []byte
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		handlerBody, _ = ioutil.ReadAll(r.Body)
+		if authorizedForScope(w, r, "testorg~testenv") {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	serve := func(req *http.Request, admin bool) int {
+		rec := httptest.NewRecorder()
+		withAuth(handler, admin)(rec, req)
+		return rec.Code
+	}
+
+	AfterEach(func() {
+		config.Set(analyticsAuthMethods, "")
+		config.Set(analyticsAuthBearerToken, "")
+		config.Set(analyticsAuthHMACSecret, "")
+		clientCertScopesLock.Lock()
+		clientCertScopes = nil
+		clientCertScopesLock.Unlock()
+	})
+
+	Context("authentication not configured", func() {
+		It("should allow all requests except admin API", func() {
+			req := httptest.NewRequest("POST", "/analytics", nil)
+			Expect(serve(req, false)).To(Equal(http.StatusOK))
+			Expect(serve(req, true)).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Context("bearer token", func() {
+		It("should allow only requests with configured token", func() {
+			config.Set(analyticsAuthMethods, "bearer")
+			config.Set(analyticsAuthBearerToken, "secrettoken")
+
+			req := httptest.NewRequest("POST", "/analytics", nil)
+			Expect(serve(req, false)).To(Equal(http.StatusUnauthorized))
+
+			req.Header.Set("Authorization", "Bearer wrongtoken")
+			Expect(serve(req, false)).To(Equal(http.StatusUnauthorized))
+
+			req.Header.Set("Authorization", "Bearer secrettoken")
+			Expect(serve(req, false)).To(Equal(http.StatusOK))
+			Expect(serve(req, true)).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("hmac signature", func() {
+		payload := []byte(`{"records":[]}`)
+		signedRequest := func(ts time.Time, secret string) *http.Request {
+			timestamp := strconv.FormatInt(ts.Unix(), 10)
+			req := httptest.NewRequest("POST", "/analytics",
+				bytes.NewReader(payload))
+			req.Header.Set(hmacTimestampHeader, timestamp)
+			sig := computeSignature(secret, timestamp, "POST",
+				"/analytics", payload)
+			req.Header.Set(hmacSignatureHeader, hex.EncodeToString(sig))
+			return req
+		}
+
+		BeforeEach(func() {
+			config.Set(analyticsAuthMethods, "bearer,hmac")
+			config.Set(analyticsAuthHMACSecret, "hmacsecret")
+		})
+
+		It("should allow correctly signed request and keep body", func() {
+			req := signedRequest(time.Now(), "hmacsecret")
+			Expect(serve(req, false)).To(Equal(http.StatusOK))
+			Expect(handlerBody).To(Equal(payload))
+		})
+
+		It("should reject request signed with wrong secret", func() {
+			req := signedRequest(time.Now(), "wrongsecret")
+			Expect(serve(req, false)).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject request with old timestamp", func() {
+			req := signedRequest(time.Now().Add(-time.Hour), "hmacsecret")
+			Expect(serve(req, false)).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should sign the query string", func() {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			sig := computeSignature("hmacsecret", timestamp, "GET",
+				"/analytics/query?org=testorg&env=testenv", nil)
+
+			req := httptest.NewRequest("GET", "/analytics/query?org=testorg&env=testenv", nil)
+			req.Header.Set(hmacTimestampHeader, timestamp)
+			req.Header.Set(hmacSignatureHeader, hex.EncodeToString(sig))
+			Expect(serve(req, false)).To(Equal(http.StatusOK))
+
+			req = httptest.NewRequest("GET", "/analytics/query?org=otherorg&env=testenv", nil)
+			req.Header.Set(hmacTimestampHeader, timestamp)
+			req.Header.Set(hmacSignatureHeader, hex.EncodeToString(sig))
+			Expect(serve(req, false)).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not read more than max payload size before authentication", func() {
+			config.Set(analyticsMaxPayloadSize, 10)
+			defer config.Set(analyticsMaxPayloadSize, analyticsMaxPayloadSizeDefault)
+			req := signedRequest(time.Now(), "hmacsecret")
+			Expect(serve(req, false)).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+		It("should sign streamed requests without the body", func() {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			sig := computeSignature("hmacsecret", timestamp, "POST", "/analytics", nil)
+			req := httptest.NewRequest("POST", "/analytics", bytes.NewReader(payload))
+			req.Header.Set(hmacTimestampHeader, timestamp)
+			req.Header.Set(hmacSignatureHeader, hex.EncodeToString(sig))
+
+			rec := httptest.NewRecorder()
+			withStreamAuth(handler)(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(handlerBody).To(Equal(payload))
+		})
+	})
+
+	Context("client certificate", func() {
+		requestWithCert := func(cn string) *http.Request {
+			req := httptest.NewRequest("POST", "/analytics", nil)
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			req.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}}}
+			return req
+		}
+
+		BeforeEach(func() {
+			config.Set(analyticsAuthMethods, "clientcert")
+			clientCertScopesLock.Lock()
+			clientCertScopes = map[string][]string{
+				"gateway1": {"testorg~testenv"},
+				"gateway2": {"otherorg~otherenv"},
+				"operator": {allScopes},
+			}
+			clientCertScopesLock.Unlock()
+		})
+
+		It("should allow only mapped scopes", func() {
+			Expect(serve(requestWithCert("gateway1"), false)).
+				To(Equal(http.StatusOK))
+			Expect(serve(requestWithCert("gateway2"), false)).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(requestWithCert("unknown"), false)).
+				To(Equal(http.StatusForbidden))
+		})
+
+		It("should allow admin API only for all scopes", func() {
+			Expect(serve(requestWithCert("gateway1"), true)).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(requestWithCert("operator"), true)).
+				To(Equal(http.StatusOK))
+		})
+
+		It("should reject request without certificate", func() {
+			req := httptest.NewRequest("POST", "/analytics", nil)
+			Expect(serve(req, false)).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
+
+var _ = Describe("test initAuth()", func() {
+	AfterEach(func() {
+		config.Set(analyticsAuthClientCertScopes, "")
+		clientCertScopesLock.Lock()
+		clientCertScopes = nil
+		clientCertScopesLock.Unlock()
+	})
+
+	It("should load client certificate scopes from file", func() {
+		path := filepath.Join(testTempDir, "cert_scopes.json")
+		err := ioutil.WriteFile(path,
+			[]byte(`{"gateway1": ["testorg~testenv"]}`), 0600)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		config.Set(analyticsAuthClientCertScopes, path)
+		Expect(initAuth()).To(Succeed())
+		Expect(clientCertScopes["gateway1"]).To(Equal([]string{"testorg~testenv"}))
+	})
+
+	It("should return error for invalid file", func() {
+		config.Set(analyticsAuthClientCertScopes,
+			filepath.Join(testTempDir, "missing.json"))
+		Expect(initAuth()).ToNot(Succeed())
+	})
+})
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -32,6 +33,10 @@ const fileExtension = ".txt.gz"
 // file as write to file should not performed in the Http Thread
 var internalBuffer chan axRecords
 
+// RW lock for internalBuffer since the channel can be
+// replaced by a resized one while records are being published
+var internalBufferLock = sync.RWMutex{}
+
 // channel to indicate that internalBuffer channel is closed
 var doneInternalBufferChan chan bool
 
@@ -49,11 +54,19 @@ var bucketMap map[int64]bucket
 // read while its being written to and vice versa
 var bucketMaplock = sync.RWMutex{}
 
+// Lock held while records are written to a bucket or a bucket is
+// being closed so that a file is never closed in the middle of a write
+var bucketWriteLock = sync.Mutex{}
+
 type bucket struct {
 	keyTS   int64
 	DirName string
 	// We need file handle and writer to close the file
 	FileWriter fileWriter
+	// Timer which publishes the close bucket event
+	closeTimer *time.Timer
+	// nil if rollups are disabled
+	rollup *rollup
 }
 
 // This struct will store open file handle and writer to close the file
@@ -61,6 +74,8 @@ type fileWriter struct {
 	file *os.File
 	gw   *gzip.Writer
 	bw   *bufio.Writer
+	// nil if encryption is disabled
+	ew *encryptingWriter
 }
 
 func initBufferingManager() {
@@ -76,12 +91,22 @@ func initBufferingManager() {
 
 	// Keep polling the internal buffer for new messages
 	go func() {
-		for records := range internalBuffer {
-			err := save(records)
-			if err != nil {
-				log.Errorf("Could not save %d messages to file"+
-					" due to: %v", len(records.Records), err)
+		buffer := getInternalBuffer()
+		for {
+			for records := range buffer {
+				err := save(records)
+				if err != nil {
+					log.Errorf("Could not save %d messages to file"+
+						" due to: %v", len(records.Records), err)
+				}
+			}
+			// channel is closed either on shutdown or when it has been
+			// replaced by a resized channel which needs to be polled next
+			next := getInternalBuffer()
+			if next == buffer {
+				break
 			}
+			buffer = next
 		}
 		// indicates a close signal was sent on the channel
 		log.Debugf("Closing channel internal buffer")
@@ -94,22 +119,25 @@ func initBufferingManager() {
 			log.Debugf("Close Event received for bucket: %s",
 				bucket.DirName)
 
-			// close open file
-			closeGzipFile(bucket.FileWriter)
+			bucketWriteLock.Lock()
+			closeBucketFile(bucket)
+			// Remove bucket from bucket map once its file is closed
+			// unless it was already replaced by a new bucket for
+			// the same timestamp
+			bucketMaplock.Lock()
+			if b, exists := bucketMap[bucket.keyTS]; exists &&
+				b.DirName == bucket.DirName {
+				delete(bucketMap, bucket.keyTS)
+			}
+			bucketMaplock.Unlock()
+			bucketWriteLock.Unlock()
 
-			dirToBeClosed := filepath.Join(localAnalyticsTempDir, bucket.DirName)
-			stagingPath := filepath.Join(localAnalyticsStagingDir, bucket.DirName)
-			// close files in tmp folder and move directory to
-			// staging to indicate its ready for upload
-			err := os.Rename(dirToBeClosed, stagingPath)
+			// records are saved to other buckets while
+			// the manifest is written
+			err := stageBucket(bucket)
 			if err != nil {
 				log.Errorf("Cannot move directory '%s' from"+
 					" tmp to staging folder due to '%s", bucket.DirName, err)
-			} else {
-				// Remove bucket from bucket map once its closed successfully
-				bucketMaplock.Lock()
-				delete(bucketMap, bucket.keyTS)
-				bucketMaplock.Unlock()
 			}
 		}
 		// indicates a close signal was sent on the channel
@@ -118,20 +146,126 @@ func initBufferingManager() {
 	}()
 }
 
+func getInternalBuffer() chan axRecords {
+	internalBufferLock.RLock()
+	buffer := internalBuffer
+	internalBufferLock.RUnlock()
+	return buffer
+}
+
+// Publish batch of records to the internal buffer channel (blocking call)
+func publishRecords(records axRecords) {
+	// Read lock is held while blocked on the channel so that
+	// the channel cannot be closed by a resize in the meantime
+	internalBufferLock.RLock()
+	defer internalBufferLock.RUnlock()
+	internalBuffer <- records
+}
+
+// Replace the internal buffer with a channel of a new size. Records still
+// in the old channel are drained by the buffering manager before it
+// starts polling the new channel.
+func resizeInternalBuffer(size int) {
+	internalBufferLock.Lock()
+	defer internalBufferLock.Unlock()
+	old := internalBuffer
+	internalBuffer = make(chan axRecords, size)
+	close(old)
+	log.Infof("Resized internal buffer channel from %d to %d slots",
+		cap(old), size)
+}
+
+// Change the collection interval and close all open buckets immediately
+// so that the next records are saved to buckets based on the new interval
+func setCollectionInterval(interval int) {
+	bucketWriteLock.Lock()
+	config.Set(analyticsCollectionInterval, interval)
+
+	var closed []bucket
+	bucketMaplock.Lock()
+	for ts, bucket := range bucketMap {
+		delete(bucketMap, ts)
+		// If the timer has already fired then the bucket
+		// will be closed by the close bucket event
+		if bucket.closeTimer != nil && !bucket.closeTimer.Stop() {
+			continue
+		}
+		log.Infof("closing bucket '%s' as collection "+
+			"interval changed", bucket.DirName)
+		closeBucketFile(bucket)
+		closed = append(closed, bucket)
+	}
+	bucketMaplock.Unlock()
+	bucketWriteLock.Unlock()
+
+	for _, bucket := range closed {
+		err := stageBucket(bucket)
+		if err != nil {
+			log.Errorf("Cannot move directory '%s' from"+
+				" tmp to staging folder due to '%s", bucket.DirName, err)
+		}
+	}
+}
+
+// Close open file for the bucket and move directory from tmp
+// to staging to indicate its ready for upload
+func closeBucket(bucket bucket) error {
+	closeBucketFile(bucket)
+	return stageBucket(bucket)
+}
+
+// Close open file and write rollup of the bucket. Called with
+// bucketWriteLock held so that no more records are written to it
+func closeBucketFile(bucket bucket) {
+	closeGzipFile(bucket.FileWriter)
+
+	dirToBeClosed := filepath.Join(localAnalyticsTempDir, bucket.DirName)
+	// rollup is written first so that it is listed in the manifest
+	if err := writeRollupFile(dirToBeClosed, bucket.rollup); err != nil {
+		log.Errorf("Cannot write rollup for '%s': %v", bucket.DirName, err)
+	}
+}
+
+// Write manifest and move directory of a closed bucket from tmp to
+// staging. Called without bucketWriteLock since the manifest reads
+// every file of the directory
+func stageBucket(bucket bucket) error {
+	dirToBeClosed := filepath.Join(localAnalyticsTempDir, bucket.DirName)
+	// directory is still uploaded without a manifest
+	if err := writeManifest(dirToBeClosed); err != nil {
+		log.Errorf("Cannot write manifest for '%s': %v", bucket.DirName, err)
+	}
+	stagingPath := filepath.Join(localAnalyticsStagingDir, bucket.DirName)
+	return os.Rename(dirToBeClosed, stagingPath)
+}
+
 // Save records to correct file based on what timestamp data is being collected for
 func save(records axRecords) error {
+	bucketWriteLock.Lock()
+	defer bucketWriteLock.Unlock()
+
 	bucket, err := getBucketForTimestamp(time.Now().UTC(), records.Tenant)
 	if err != nil {
 		return err
 	}
 	writeGzipFile(bucket.FileWriter, records.Records)
+	if bucket.rollup != nil {
+		for _, record := range records.Records {
+			if r, ok := record.(map[string]interface{}); ok {
+				bucket.rollup.add(r)
+			}
+		}
+	}
+	addToQueryStore(records.Tenant, records.Records)
+	publishToKafka(records.Tenant, records.Records)
 	return nil
 }
 
 func getBucketForTimestamp(now time.Time, tenant tenant) (bucket, error) {
 	// first based on current timestamp and collection interval,
 	// determine the timestamp of the bucket
-	ts := now.Unix() / int64(config.GetInt(analyticsCollectionInterval)) * int64(config.GetInt(analyticsCollectionInterval))
+	interval := int64(config.GetInt(analyticsCollectionInterval))
+	ts := now.Unix() / interval * interval
 
 	bucketMaplock.RLock()
 	b, exists := bucketMap[ts]
@@ -143,13 +277,13 @@ func getBucketForTimestamp(now time.Time, tenant tenant) (bucket, error) {
 		timestamp := time.Unix(ts, 0).UTC().Format(timestampLayout)
 
 		// endtimestamp of bucket = starttimestamp + collectionInterval
-		endTime := time.Unix(ts+int64(config.GetInt(analyticsCollectionInterval)), 0)
+		endTime := time.Unix(ts+interval, 0)
 		endtimestamp := endTime.UTC().Format(timestampLayout)
 
-		dirName := tenant.Org + "~" + tenant.Env + "~" + timestamp
+		dirName := getUniqueDirName(tenant.Org + "~" + tenant.Env + "~" + timestamp)
 		newPath := filepath.Join(localAnalyticsTempDir, dirName)
 		// create dir
-		err := os.Mkdir(newPath, os.ModePerm)
+		err := os.Mkdir(newPath, dirPermissions)
 		if err != nil {
 			return bucket{}, fmt.Errorf("Cannot create directory "+
 				"'%s' to buffer messages '%v'", dirName, err)
@@ -167,23 +301,44 @@ func getBucketForTimestamp(now time.Time, tenant tenant) (bucket, error) {
 			return bucket{}, err
 		}
 
-		newBucket := bucket{keyTS: ts, DirName: dirName, FileWriter: fw}
+		newBucket := bucket{keyTS: ts, DirName: dirName, FileWriter: fw,
+			rollup: newRollup()}
+
+		//Send event to close directory after endTime + 5
+		// seconds to make sure all buffers are flushed to file
+		newBucket.closeTimer = time.AfterFunc(
+			endTime.Sub(time.Now().UTC())+time.Second*5, func() {
+				closeBucketEvent <- newBucket
+			})
 
 		bucketMaplock.Lock()
 		bucketMap[ts] = newBucket
 		bucketMaplock.Unlock()
-
-		//Send event to close directory after endTime + 5
-		// seconds to make sure all buffers are flushed to file
-		timer := time.After(endTime.Sub(time.Now().UTC()) + time.Second*5)
-		go func() {
-			<-timer
-			closeBucketEvent <- newBucket
-		}()
 		return newBucket, nil
 	}
 }
 
+// A bucket for the same timestamp might have been closed already when the
+// collection interval changed, so a sequence is suffixed to the directory
+// name if it is still buffered, staged or failed eg. org~env~20160101222400~1
+func getUniqueDirName(dirName string) string {
+	name := dirName
+	for seq := 1; ; seq++ {
+		exists := false
+		for _, dir := range []string{localAnalyticsTempDir,
+			localAnalyticsStagingDir, localAnalyticsFailedDir} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			return name
+		}
+		name = dirName + "~" + strconv.Itoa(seq)
+	}
+}
+
 // 4 digit Hex is prefixed to each filename to improve
 // how s3 partitions the files being uploaded
 func getRandomHex() string {
@@ -193,15 +348,28 @@ func getRandomHex() string {
 }
 
 func createGzipFile(s string) (fileWriter, error) {
-	file, err := os.OpenFile(s, os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	file, err := os.OpenFile(s, os.O_WRONLY|os.O_CREATE, filePermissions)
 	if err != nil {
 		return fileWriter{},
 			fmt.Errorf("Cannot create file '%s' "+
 				"to buffer messages '%v'", s, err)
 	}
-	gw := gzip.NewWriter(file)
+	if encryptionKey == nil {
+		gw := gzip.NewWriter(file)
+		bw := bufio.NewWriter(gw)
+		return fileWriter{file, gw, bw, nil}, nil
+	}
+
+	ew, err := newEncryptingWriter(file, encryptionKey)
+	if err != nil {
+		file.Close()
+		return fileWriter{},
+			fmt.Errorf("Cannot encrypt file '%s' "+
+				"to buffer messages '%v'", s, err)
+	}
+	gw := gzip.NewWriter(ew)
 	bw := bufio.NewWriter(gw)
-	return fileWriter{file, gw, bw}, nil
+	return fileWriter{file, gw, bw, ew}, nil
 }
 
 func writeGzipFile(fw fileWriter, records []interface{}) {
@@ -217,10 +385,18 @@ func writeGzipFile(fw fileWriter, records []interface{}) {
 	// Flush entire batch of records to file vs each message
 	fw.bw.Flush()
 	fw.gw.Flush()
+	if fw.ew != nil {
+		if err := fw.ew.Flush(); err != nil {
+			log.Errorf("Write to file failed '%v'", err)
+		}
+	}
 }
 
 func closeGzipFile(fw fileWriter) {
 	fw.bw.Flush()
 	fw.gw.Close()
+	if fw.ew != nil {
+		fw.ew.Flush()
+	}
 	fw.file.Close()
 }
@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+Checksums of the data being uploaded are sent to S3/GCS and compared against
+the hash returned by the datastore to make sure that the bytes that reached
+the datastore are the same as the ones in the staged file.
+*/
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type checksum struct {
+	md5    []byte
+	crc32c uint32
+}
+
+// Error returned when hash returned by the datastore does not match
+type checksumMismatchError struct {
+	expected string
+	actual   string
+}
+
+func (e checksumMismatchError) Error() string {
+	return fmt.Sprintf("Checksum mismatch after upload, expected "+
+		"'%s' but datastore returned '%s'", e.expected, e.actual)
+}
+
+// Compute MD5 and CRC32C by streaming the data through both hashes
+func computeChecksum(r io.Reader) (checksum, error) {
+	md5Hash := md5.New()
+	crc32cHash := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(md5Hash, crc32cHash), r); err != nil {
+		return checksum{}, err
+	}
+	return checksum{md5: md5Hash.Sum(nil), crc32c: crc32cHash.Sum32()}, nil
+}
+
+func (c checksum) md5Base64() string {
+	return base64.StdEncoding.EncodeToString(c.md5)
+}
+
+func (c checksum) crc32cBase64() string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, c.crc32c)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (c checksum) String() string {
+	return "md5=" + hex.EncodeToString(c.md5) + ",crc32c=" + c.crc32cBase64()
+}
+
+// Add checksum headers understood by both S3 and GCS
+func addChecksumHeaders(req *http.Request, c checksum) {
+	req.Header.Set("Content-MD5", c.md5Base64())
+}
+
+/*
+Verify checksum against the hash returned by the datastore
+1. GCS returns x-goog-hash: crc32c=<base64>,md5=<base64>
+2. S3 returns ETag which is hex MD5 of the data for single part uploads
+and parts of a multipart upload. ETags of other forms are not verified.
+*/
+func verifyChecksum(header http.Header, c checksum) error {
+	if gcsHashes := header["X-Goog-Hash"]; len(gcsHashes) > 0 {
+		for _, gcsHash := range strings.Split(strings.Join(gcsHashes, ","), ",") {
+			kv := strings.SplitN(strings.TrimSpace(gcsHash), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "md5":
+				if kv[1] != c.md5Base64() {
+					return checksumMismatchError{
+						expected: "md5=" + c.md5Base64(),
+						actual:   gcsHash}
+				}
+			case "crc32c":
+				if kv[1] != c.crc32cBase64() {
+					return checksumMismatchError{
+						expected: "crc32c=" + c.crc32cBase64(),
+						actual:   gcsHash}
+				}
+			}
+		}
+		return nil
+	}
+
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	if etagMD5, err := hex.DecodeString(etag); err == nil && len(etagMD5) == md5.Size {
+		if !bytes.Equal(etagMD5, c.md5) {
+			return checksumMismatchError{
+				expected: hex.EncodeToString(c.md5),
+				actual:   etag}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test computeChecksum()", func() {
+	It("should compute md5 and crc32c", func() {
+		c, err := computeChecksum(strings.NewReader("hello"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(hex.EncodeToString(c.md5)).To(Equal("5d41402abc4b2a76b9719d911017c592"))
+		Expect(c.md5Base64()).To(Equal("XUFAKrxLKna5cZ2REBfFkg=="))
+		Expect(c.crc32c).To(Equal(uint32(0x9a71bb4c)))
+		Expect(c.crc32cBase64()).To(Equal("mnG7TA=="))
+	})
+})
+
+var _ = Describe("test verifyChecksum()", func() {
+	c, _ := computeChecksum(strings.NewReader("hello"))
+
+	Context("S3 ETag", func() {
+		It("should verify md5 etag", func() {
+			header := http.Header{}
+			header.Set("ETag", `"5d41402abc4b2a76b9719d911017c592"`)
+			Expect(verifyChecksum(header, c)).To(Succeed())
+
+			header.Set("ETag", `"00000000000000000000000000000000"`)
+			err := verifyChecksum(header, c)
+			_, ok := err.(checksumMismatchError)
+			Expect(ok).To(BeTrue())
+		})
+
+		It("should ignore etag which is not an md5", func() {
+			header := http.Header{}
+			header.Set("ETag", `"5d41402abc4b2a76b9719d911017c592-3"`)
+			Expect(verifyChecksum(header, c)).To(Succeed())
+		})
+	})
+
+	Context("GCS x-goog-hash", func() {
+		It("should verify md5 and crc32c", func() {
+			header := http.Header{}
+			header.Add("X-Goog-Hash", "crc32c=mnG7TA==")
+			header.Add("X-Goog-Hash", "md5=XUFAKrxLKna5cZ2REBfFkg==")
+			Expect(verifyChecksum(header, c)).To(Succeed())
+
+			header = http.Header{}
+			header.Set("X-Goog-Hash", "crc32c=AAAAAA==,md5=XUFAKrxLKna5cZ2REBfFkg==")
+			Expect(verifyChecksum(header, c)).ToNot(Succeed())
+		})
+	})
+})
+
+var _ = Describe("test uploadFileToDatastore() with checksum", func() {
+	It("should fail upload if datastore returns different checksum", func() {
+		fakeDir := filepath.Join(testTempDir, "checksum")
+		os.MkdirAll(fakeDir, os.ModePerm)
+		fp := filepath.Join(fakeDir, "fakefile.txt.gz")
+		f, _ := os.Create(fp)
+		f.WriteString("hello")
+		f.Close()
+
+		signedUrl := testServer.URL + "/upload?expected_status=badChecksum"
+		status, err := uploadFileToDatastore(fp, signedUrl)
+		Expect(status).To(BeFalse())
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("Checksum mismatch"))
+
+		signedUrl = testServer.URL + "/upload?expected_status=ok"
+		status, err = uploadFileToDatastore(fp, signedUrl)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(BeTrue())
+	})
+})
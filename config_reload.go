@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lock to make sure only one config reload is applied at a time
+var configReloadLock = sync.Mutex{}
+
+// Analytics configuration that can be changed without restarting apid
+type reloadableConfig struct {
+	CollectionInterval int  `json:"apidanalytics_collection_interval"`
+	UploadInterval     int  `json:"apidanalytics_upload_interval"`
+	BufferChannelSize  int  `json:"apidanalytics_buffer_channel_size"`
+	UseCaching         bool `json:"apidanalytics_use_caching"`
+}
+
+func getReloadableConfig() reloadableConfig {
+	return reloadableConfig{
+		CollectionInterval: config.GetInt(analyticsCollectionInterval),
+		UploadInterval:     config.GetInt(analyticsUploadInterval),
+		BufferChannelSize:  config.GetInt(analyticsBufferChannelSize),
+		UseCaching:         config.GetBool(useCaching),
+	}
+}
+
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writeConfig(w)
+}
+
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if !strings.EqualFold(r.Header.Get("Content-Type"), "application/json") {
+		writeError(w, http.StatusBadRequest, "UNSUPPORTED_CONTENT_TYPE",
+			"Only supported content type is application/json")
+		return
+	}
+
+	body, err := getJsonBody(r)
+	if err.ErrorCode != "" {
+		writeError(w, http.StatusBadRequest, err.ErrorCode, err.Reason)
+		return
+	}
+
+	configReloadLock.Lock()
+	defer configReloadLock.Unlock()
+
+	newConfig, err := mergeConfig(getReloadableConfig(), body)
+	if err.ErrorCode != "" {
+		writeError(w, http.StatusBadRequest, err.ErrorCode, err.Reason)
+		return
+	}
+	applyConfig(newConfig)
+	writeConfig(w)
+}
+
+func writeConfig(w http.ResponseWriter) {
+	bytes, err := json.Marshal(getReloadableConfig())
+	if err != nil {
+		log.Errorf("unable to marshal config: %v", err)
+		writeError(w, http.StatusInternalServerError,
+			"INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+/*
+Overrides current config with the values in the payload and validates them
+1. Only reloadable config keys are allowed
+2. Intervals and buffer channel size should be positive integers
+3. use caching should be a boolean
+*/
+func mergeConfig(current reloadableConfig,
+	raw map[string]interface{}) (reloadableConfig, errResponse) {
+	newConfig := current
+	for key, value := range raw {
+		switch key {
+		case analyticsCollectionInterval:
+			i, err := getPositiveInt(key, value)
+			if err.ErrorCode != "" {
+				return current, err
+			}
+			newConfig.CollectionInterval = i
+		case analyticsUploadInterval:
+			i, err := getPositiveInt(key, value)
+			if err.ErrorCode != "" {
+				return current, err
+			}
+			newConfig.UploadInterval = i
+		case analyticsBufferChannelSize:
+			i, err := getPositiveInt(key, value)
+			if err.ErrorCode != "" {
+				return current, err
+			}
+			newConfig.BufferChannelSize = i
+		case useCaching:
+			b, isBool := value.(bool)
+			if !isBool {
+				return current, errResponse{
+					ErrorCode: "BAD_DATA",
+					Reason:    key + " has to be a boolean"}
+			}
+			newConfig.UseCaching = b
+		default:
+			return current, errResponse{
+				ErrorCode: "BAD_DATA",
+				Reason:    key + " cannot be reloaded"}
+		}
+	}
+	return newConfig, errResponse{}
+}
+
+func getPositiveInt(key string, value interface{}) (int, errResponse) {
+	n, isNumber := value.(json.Number)
+	if isNumber {
+		i, err := n.Int64()
+		if err == nil && i > 0 {
+			return int(i), errResponse{}
+		}
+	}
+	return 0, errResponse{
+		ErrorCode: "BAD_DATA",
+		Reason:    key + " has to be a positive integer"}
+}
+
+// Apply each changed value so that components
+// using it pick up the new value safely
+func applyConfig(newConfig reloadableConfig) {
+	current := getReloadableConfig()
+
+	if newConfig.CollectionInterval != current.CollectionInterval {
+		// new buckets will be created based on the new interval
+		setCollectionInterval(newConfig.CollectionInterval)
+		log.Infof("Reloaded collection interval: %d seconds",
+			newConfig.CollectionInterval)
+	}
+
+	if newConfig.UploadInterval != current.UploadInterval {
+		config.Set(analyticsUploadInterval, newConfig.UploadInterval)
+		resetUploadInterval(time.Second *
+			config.GetDuration(analyticsUploadInterval))
+		log.Infof("Reloaded upload interval: %d seconds",
+			newConfig.UploadInterval)
+	}
+
+	if newConfig.BufferChannelSize != current.BufferChannelSize {
+		config.Set(analyticsBufferChannelSize, newConfig.BufferChannelSize)
+		resizeInternalBuffer(newConfig.BufferChannelSize)
+	}
+
+	if newConfig.UseCaching != current.UseCaching {
+		// Caches need to be created before caching is turned on.
+		// If DB is not initialized yet then caches will be
+		// created once the snapshot is received
+		if newConfig.UseCaching && getDB() != nil {
+			createTenantCache()
+			createOrgEnvCache()
+		}
+		config.Set(useCaching, newConfig.UseCaching)
+		log.Infof("Reloaded use caching: %t", newConfig.UseCaching)
+	}
+}
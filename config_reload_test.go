@@ -0,0 +1,187 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test mergeConfig()", func() {
+	current := reloadableConfig{
+		CollectionInterval: 120,
+		UploadInterval:     5,
+		BufferChannelSize:  1000,
+		UseCaching:         false,
+	}
+
+	Context("valid values", func() {
+		It("should override only the given values", func() {
+			var payload = []byte(`{
+					"apidanalytics_collection_interval": 60,
+					"apidanalytics_use_caching": true
+				}`)
+			newConfig, e := mergeConfig(current, getRaw(payload))
+			Expect(e.ErrorCode).To(Equal(""))
+			Expect(newConfig.CollectionInterval).To(Equal(60))
+			Expect(newConfig.UploadInterval).To(Equal(5))
+			Expect(newConfig.BufferChannelSize).To(Equal(1000))
+			Expect(newConfig.UseCaching).To(BeTrue())
+		})
+	})
+
+	Context("invalid values", func() {
+		It("should return bad data", func() {
+			By("unknown key")
+			payload := []byte(`{"apidanalytics_base_path": "/ax"}`)
+			_, e := mergeConfig(current, getRaw(payload))
+			Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+
+			By("negative interval")
+			payload = []byte(`{"apidanalytics_upload_interval": -5}`)
+			_, e = mergeConfig(current, getRaw(payload))
+			Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+
+			By("non integer buffer size")
+			payload = []byte(`{"apidanalytics_buffer_channel_size": "100"}`)
+			_, e = mergeConfig(current, getRaw(payload))
+			Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+
+			By("non boolean caching")
+			payload = []byte(`{"apidanalytics_use_caching": "yes"}`)
+			_, e = mergeConfig(current, getRaw(payload))
+			Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+		})
+	})
+})
+
+var _ = Describe("test setCollectionInterval()", func() {
+	It("should close open buckets and create new ones with new interval", func() {
+		original := config.GetInt(analyticsCollectionInterval)
+		defer setCollectionInterval(original)
+
+		tenant := tenant{Org: "testorg", Env: "testenv"}
+		t := time.Date(2017, 2, 20, 10, 24, 5, 0, time.UTC)
+
+		bucketWriteLock.Lock()
+		b, err := getBucketForTimestamp(t, tenant)
+		bucketWriteLock.Unlock()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(b.DirName).To(Equal("testorg~testenv~20170220102400"))
+
+		setCollectionInterval(60)
+
+		// bucket is in the past so it might be closed by its timer instead
+		Eventually(filepath.Join(localAnalyticsStagingDir, b.DirName)).
+			Should(BeADirectory())
+		bucketMaplock.RLock()
+		_, exists := bucketMap[b.keyTS]
+		bucketMaplock.RUnlock()
+		Expect(exists).To(BeFalse())
+
+		t2 := time.Date(2017, 2, 20, 10, 25, 5, 0, time.UTC)
+		bucketWriteLock.Lock()
+		b, err = getBucketForTimestamp(t2, tenant)
+		bucketWriteLock.Unlock()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(b.DirName).To(Equal("testorg~testenv~20170220102500"))
+		Expect(b.FileWriter.file.Name()).
+			To(ContainSubstring("20170220102500.20170220102600"))
+
+		By("bucket for a timestamp which was already closed")
+		bucketWriteLock.Lock()
+		b, err = getBucketForTimestamp(t, tenant)
+		bucketWriteLock.Unlock()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(b.DirName).To(Equal("testorg~testenv~20170220102400~1"))
+		dirTenant, timestamp := splitDirName(b.DirName)
+		Expect(dirTenant).To(Equal("testorg~testenv"))
+		Expect(timestamp).To(Equal("20170220102400"))
+	})
+})
+
+var _ = Describe("test resizeInternalBuffer()", func() {
+	It("should replace channel and keep accepting records", func() {
+		original := config.GetInt(analyticsBufferChannelSize)
+		defer resizeInternalBuffer(original)
+
+		resizeInternalBuffer(10)
+		Expect(cap(getInternalBuffer())).To(Equal(10))
+
+		now := time.Now().Unix() * 1000
+		records := axRecords{
+			Tenant: tenant{Org: "testorg", Env: "testenv"},
+			Records: []interface{}{map[string]interface{}{
+				"client_received_start_timestamp": now,
+				"client_received_end_timestamp":   now + 1000,
+			}},
+		}
+		done := make(chan bool)
+		go func() {
+			publishRecords(records)
+			done <- true
+		}()
+		Eventually(done).Should(Receive())
+		Eventually(func() int {
+			return len(getInternalBuffer())
+		}).Should(Equal(0))
+	})
+})
+
+var _ = Describe("PUT /analytics/admin/config", func() {
+	It("should apply valid config and reject invalid config", func() {
+		original := config.GetInt(analyticsUploadInterval)
+		defer func() {
+			config.Set(analyticsUploadInterval, original)
+			resetUploadInterval(time.Second *
+				config.GetDuration(analyticsUploadInterval))
+		}()
+
+		By("valid config")
+		payload := []byte(`{"apidanalytics_upload_interval": 10}`)
+		res, body := makeConfigRequest(payload)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		var c reloadableConfig
+		Expect(json.Unmarshal(body, &c)).To(Succeed())
+		Expect(c.UploadInterval).To(Equal(10))
+		Expect(config.GetInt(analyticsUploadInterval)).To(Equal(10))
+
+		By("invalid config")
+		payload = []byte(`{"apidanalytics_upload_interval": 0}`)
+		res, body = makeConfigRequest(payload)
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		var e errResponse
+		Expect(json.Unmarshal(body, &e)).To(Succeed())
+		Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+		Expect(config.GetInt(analyticsUploadInterval)).To(Equal(10))
+	})
+})
+
+func makeConfigRequest(payload []byte) (*http.Response, []byte) {
+	uri, err := url.Parse(testServer.URL)
+	Expect(err).ShouldNot(HaveOccurred())
+	uri.Path = analyticsBasePath + "/admin/config"
+
+	req, _ := http.NewRequest("PUT", uri.String(), bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	return makeAdminRequest(req)
+}
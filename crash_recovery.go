@@ -122,12 +122,30 @@ func recoverDirectory(dirName string) {
 	dirBeingRecovered := filepath.Join(localAnalyticsRecoveredDir, dirName)
 	files, _ := ioutil.ReadDir(dirBeingRecovered)
 	for _, file := range files {
+		// rollup and manifest may be incomplete or list files
+		// which are renamed on recovery so they are written again
+		if isRollupFile(file.Name()) || isManifestFile(file.Name()) {
+			deletePartialFile(filepath.Join(dirBeingRecovered, file.Name()))
+			continue
+		}
 		// recovering each file sequentially for now
 		recoverFile(bucketRecoveryTS, dirName, file.Name())
 	}
 
+	// rollup of an open bucket is lost so recompute it from recovered files
+	r, err := computeRollupFromFiles(dirBeingRecovered)
+	if err != nil {
+		log.Errorf("Cannot compute rollup for '%s': %v", dirName, err)
+	} else if err := writeRollupFile(dirBeingRecovered, r); err != nil {
+		log.Errorf("Cannot write rollup for '%s': %v", dirName, err)
+	}
+
+	if err := writeManifest(dirBeingRecovered); err != nil {
+		log.Errorf("Cannot write manifest for '%s': %v", dirName, err)
+	}
+
 	stagingPath := filepath.Join(localAnalyticsStagingDir, dirName)
-	err := os.Rename(dirBeingRecovered, stagingPath)
+	err = os.Rename(dirBeingRecovered, stagingPath)
 	if err != nil {
 		log.Errorf("Cannot move directory '%s' from"+
 			" recovered to staging folder", dirName)
@@ -159,7 +177,15 @@ func copyPartialFile(completeOrigFilePath, recoveredFilePath string) {
 	}
 	defer partialFile.Close()
 
-	bufReader := bufio.NewReader(partialFile)
+	// decrypts frames if file is encrypted
+	reader, err := newFileReader(partialFile)
+	if err != nil {
+		log.Errorf("Cannot read file: %s due to %v",
+			completeOrigFilePath, err)
+		return
+	}
+
+	bufReader := bufio.NewReader(reader)
 	gzReader, err := gzip.NewReader(bufReader)
 	if err != nil {
 		log.Errorf("Cannot create reader on gzip file: %s"+
@@ -171,19 +197,13 @@ func copyPartialFile(completeOrigFilePath, recoveredFilePath string) {
 	scanner := bufio.NewScanner(gzReader)
 
 	// Create new file to copy complete records from partial file and upload only a complete file
-	recoveredFile, err := os.OpenFile(recoveredFilePath,
-		os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	fw, err := createGzipFile(recoveredFilePath)
 	if err != nil {
 		log.Errorf("Cannot create recovered file: %s", recoveredFilePath)
 		return
 	}
-	defer recoveredFile.Close()
-
-	gzWriter := gzip.NewWriter(recoveredFile)
-	defer gzWriter.Close()
-
-	bufWriter := bufio.NewWriter(gzWriter)
-	defer bufWriter.Flush()
+	defer closeGzipFile(fw)
+	bufWriter := fw.bw
 
 	for scanner.Scan() {
 		bufWriter.Write(scanner.Bytes())
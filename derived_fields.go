@@ -0,0 +1,142 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/*
+Latencies are derived from the client_* and target_* timestamps of a
+record during enrichment so that consumers do not need to recompute them.
+A field is not added if its timestamps are missing, 0 (eg. target timestamps
+when the response was served from cache) or not in order. If enabled,
+validation rejects records whose timestamps are not in order instead.
+*/
+
+type derivedField struct {
+	name  string
+	start string
+	end   string
+}
+
+var allDerivedFields = []derivedField{
+	{"total_response_time",
+		"client_received_start_timestamp", "client_sent_end_timestamp"},
+	{"target_response_time",
+		"target_sent_start_timestamp", "target_received_end_timestamp"},
+	{"request_processing_latency",
+		"client_received_end_timestamp", "target_sent_start_timestamp"},
+	{"response_processing_latency",
+		"target_received_end_timestamp", "client_sent_start_timestamp"},
+}
+
+// Timestamps of a record in the order in which they should occur
+var orderedTimestamps = []string{
+	"client_received_start_timestamp",
+	"client_received_end_timestamp",
+	"target_sent_start_timestamp",
+	"target_sent_end_timestamp",
+	"target_received_start_timestamp",
+	"target_received_end_timestamp",
+	"client_sent_start_timestamp",
+	"client_sent_end_timestamp",
+}
+
+// Derived fields enabled by config
+var derivedFields []derivedField
+
+var derivedFieldsLock = sync.RWMutex{}
+
+func initDerivedFields() error {
+	var fields []derivedField
+	for _, name := range strings.Split(config.GetString(analyticsDerivedFields), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, f := range allDerivedFields {
+			if f.name == name {
+				fields = append(fields, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown derived field '%s'", name)
+		}
+	}
+
+	derivedFieldsLock.Lock()
+	derivedFields = fields
+	derivedFieldsLock.Unlock()
+	return nil
+}
+
+func getDerivedFields() []derivedField {
+	derivedFieldsLock.RLock()
+	defer derivedFieldsLock.RUnlock()
+	return derivedFields
+}
+
+// Returns start and end timestamps of the field if both are present
+func (f derivedField) getTimestamps(recordMap map[string]interface{}) (int64, int64, bool) {
+	start, ok1 := getInt64Field(recordMap, f.start)
+	end, ok2 := getInt64Field(recordMap, f.end)
+	if !ok1 || !ok2 || start == 0 || end == 0 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// Check that timestamps which are present and not 0 are monotonic
+func validateTimestampOrder(recordMap map[string]interface{}) (bool, errResponse) {
+	var previous string
+	var previousTs int64
+	for _, field := range orderedTimestamps {
+		ts, ok := getInt64Field(recordMap, field)
+		if !ok || ts == 0 {
+			continue
+		}
+		if previous != "" && previousTs > ts {
+			return false, errResponse{
+				ErrorCode: "BAD_DATA",
+				Reason:    previous + " > " + field}
+		}
+		previous, previousTs = field, ts
+	}
+	return true, errResponse{}
+}
+
+// Add derived fields unless they were already sent by the gateway
+func addDerivedFields(recordMap map[string]interface{}) {
+	for _, f := range getDerivedFields() {
+		if _, exists := recordMap[f.name]; exists {
+			continue
+		}
+		start, end, ok := f.getTimestamps(recordMap)
+		if !ok {
+			continue
+		}
+		if start > end {
+			log.Debugf("Not adding %s since %s > %s", f.name, f.start, f.end)
+			continue
+		}
+		recordMap[f.name] = end - start
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test derived fields", func() {
+	var start string
+
+	BeforeEach(func() {
+		start = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond)-1000, 10)
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsDerivedFields, analyticsDerivedFieldsDefault)
+		Expect(initDerivedFields()).To(Succeed())
+	})
+
+	It("should add derived latencies during enrichment", func() {
+		config.Set(analyticsDerivedFields, "total_response_time,target_response_time,"+
+			"request_processing_latency,response_processing_latency")
+		Expect(initDerivedFields()).To(Succeed())
+
+		raw := getRaw([]byte(`{
+			"client_received_start_timestamp": 1462850097576,
+			"client_received_end_timestamp": 1462850097580,
+			"target_sent_start_timestamp": 1462850097602,
+			"target_sent_end_timestamp": 1462850097602,
+			"target_received_start_timestamp": 1462850097800,
+			"target_received_end_timestamp": 1462850097810,
+			"client_sent_start_timestamp": 1462850097894,
+			"client_sent_end_timestamp": 1462850097900
+		}`))
+		enrich(raw, tenant{Org: "testorg", Env: "testenv"})
+
+		Expect(raw["total_response_time"]).To(Equal(int64(324)))
+		Expect(raw["target_response_time"]).To(Equal(int64(208)))
+		Expect(raw["request_processing_latency"]).To(Equal(int64(22)))
+		Expect(raw["response_processing_latency"]).To(Equal(int64(84)))
+	})
+
+	It("should only add configured fields which have timestamps", func() {
+		config.Set(analyticsDerivedFields, "total_response_time, target_response_time")
+		Expect(initDerivedFields()).To(Succeed())
+
+		raw := getRaw([]byte(`{
+			"total_response_time": 5,
+			"client_received_start_timestamp": 1462850097576,
+			"client_received_end_timestamp": 1462850097580,
+			"target_sent_start_timestamp": 0,
+			"target_received_end_timestamp": 1462850097810,
+			"client_sent_start_timestamp": 1462850097894,
+			"client_sent_end_timestamp": 1462850097900
+		}`))
+		enrich(raw, tenant{Org: "testorg", Env: "testenv"})
+
+		Expect(raw["total_response_time"]).To(BeEquivalentTo(5))
+		Expect(raw).ToNot(HaveKey("target_response_time"))
+		Expect(raw).ToNot(HaveKey("response_processing_latency"))
+
+		By("unknown field")
+		config.Set(analyticsDerivedFields, "latency")
+		Expect(initDerivedFields()).ToNot(Succeed())
+	})
+
+	It("should skip derived fields whose timestamps are not in order", func() {
+		config.Set(analyticsDerivedFields, "total_response_time,target_response_time")
+		Expect(initDerivedFields()).To(Succeed())
+
+		raw := getRaw([]byte(`{
+			"client_received_start_timestamp": ` + start + `,
+			"client_received_end_timestamp": ` + start + `,
+			"target_sent_start_timestamp": ` + start + `,
+			"target_received_end_timestamp": 1462850097810,
+			"client_sent_end_timestamp": ` + start + `
+		}`))
+		valid, _ := validate(raw)
+		Expect(valid).To(BeTrue())
+		enrich(raw, tenant{Org: "testorg", Env: "testenv"})
+
+		Expect(raw["total_response_time"]).To(Equal(int64(0)))
+		Expect(raw).ToNot(HaveKey("target_response_time"))
+	})
+
+	It("should reject timestamps which are not in order if enabled", func() {
+		config.Set(analyticsValidateTimestampOrder, true)
+		defer config.Set(analyticsValidateTimestampOrder, analyticsValidateTimestampOrderDefault)
+
+		raw := getRaw([]byte(`{
+			"client_received_start_timestamp": ` + start + `,
+			"client_received_end_timestamp": ` + start + `,
+			"target_sent_start_timestamp": 0,
+			"target_received_end_timestamp": 1462850097810
+		}`))
+		valid, e := validate(raw)
+		Expect(valid).To(BeFalse())
+		Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+		Expect(e.Reason).To(Equal("client_received_end_timestamp > target_received_end_timestamp"))
+
+		By("timestamps in order")
+		raw = getRaw([]byte(`{
+			"client_received_start_timestamp": ` + start + `,
+			"client_received_end_timestamp": ` + start + `,
+			"target_sent_start_timestamp": 0,
+			"client_sent_end_timestamp": ` + start + `
+		}`))
+		valid, _ = validate(raw)
+		Expect(valid).To(BeTrue())
+	})
+})
@@ -0,0 +1,343 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Staged files can be delivered to other destinations in addition to UAP.
+Delivery to each destination is tracked per file in a sidecar file of the
+directory so that a destination is not sent a file again when the
+directory is retried. A directory is deleted from staging once UAP and
+all required destinations have the files. Failures of optional destinations
+are only logged, so an optional destination is retried only while the
+directory stays staged for UAP or a required destination, and usually gets
+a single attempt.
+
+Deliveries of an upload pass share a deadline, and a destination which
+failed is not attempted again for other directories in the same pass, so
+that an unreachable destination does not hold up uploads to UAP.
+
+Eg. apidanalytics_destinations: backup
+    apidanalytics_destination_backup_type: http
+    apidanalytics_destination_backup_url: https://backup.example.com/analytics
+    apidanalytics_destination_backup_required: true
+*/
+
+const (
+	// Sidecar file in each directory with files delivered to each destination
+	deliveryStateFileName = ".delivery.json"
+
+	// Name under which delivery to UAP is tracked
+	uapDestinationName = "uap"
+)
+
+// Delivers a staged file to a destination
+type destination interface {
+	getName() string
+	// directory is not deleted till all required destinations succeed
+	isRequired() bool
+	// returns true if files of the tenant should be delivered
+	accepts(tenant string) bool
+	// returns once ctx is done if the file is not delivered by then
+	deliver(ctx context.Context, tenant, relativeFilePath, completeFilePath string) error
+}
+
+// Creates a destination of a type from its config
+type destinationFactory func(name string, config destinationConfig) (destination, error)
+
+type destinationConfig struct {
+	required bool
+	tenants  map[string]bool
+}
+
+var destinationFactories = map[string]destinationFactory{
+	"http": newHttpDestination,
+	"otlp": newOTLPDestination,
+}
+
+var destinations []destination
+
+var destinationsLock = sync.RWMutex{}
+
+// Lock for delivery state files since admin API can move directories
+var deliveryStateLock = sync.Mutex{}
+
+// Deadline of deliveries and destinations which failed in an upload pass
+type deliveryPass struct {
+	ctx    context.Context
+	failed map[string]error
+}
+
+// Only used by the upload manager, nil outside of an upload pass
+var currentDeliveryPass *deliveryPass
+
+type deliveryState struct {
+	path string
+	// destination to names of delivered files
+	Delivered map[string][]string `json:"delivered"`
+}
+
+func getDestinationConfigKey(name, key string) string {
+	return analyticsDestinationPrefix + name + "_" + key
+}
+
+func initDestinations() error {
+	var dests []destination
+	for _, name := range strings.Split(config.GetString(analyticsDestinations), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == uapDestinationName {
+			return fmt.Errorf("Destination name '%s' is reserved", name)
+		}
+		typ := config.GetString(getDestinationConfigKey(name, "type"))
+		if typ == "" {
+			typ = "http"
+		}
+		factory, ok := destinationFactories[typ]
+		if !ok {
+			return fmt.Errorf("Unknown type '%s' of destination '%s'", typ, name)
+		}
+
+		c := destinationConfig{
+			required: config.GetBool(getDestinationConfigKey(name, "required")),
+			tenants:  make(map[string]bool),
+		}
+		tenants := config.GetString(getDestinationConfigKey(name, "tenants"))
+		for _, t := range strings.Split(tenants, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				c.tenants[t] = true
+			}
+		}
+		d, err := factory(name, c)
+		if err != nil {
+			return err
+		}
+		dests = append(dests, d)
+		log.Infof("Delivering staged files to destination '%s' (%s)", name, typ)
+	}
+
+	destinationsLock.Lock()
+	destinations = dests
+	destinationsLock.Unlock()
+	return nil
+}
+
+// Destinations other than UAP for files of the tenant
+func getDestinations(tenant string) []destination {
+	destinationsLock.RLock()
+	defer destinationsLock.RUnlock()
+	var dests []destination
+	for _, d := range destinations {
+		if d.accepts(tenant) {
+			dests = append(dests, d)
+		}
+	}
+	return dests
+}
+
+func (c destinationConfig) accepts(tenant string) bool {
+	return len(c.tenants) == 0 || c.tenants[tenant]
+}
+
+func isDeliveryStateFile(fileName string) bool {
+	return fileName == deliveryStateFileName
+}
+
+// Returns nil if files are only delivered to UAP
+func loadDeliveryState(dirPath string, dests []destination) *deliveryState {
+	if len(dests) == 0 {
+		return nil
+	}
+	s := &deliveryState{
+		path:      filepath.Join(dirPath, deliveryStateFileName),
+		Delivered: make(map[string][]string),
+	}
+	deliveryStateLock.Lock()
+	defer deliveryStateLock.Unlock()
+	if b, err := ioutil.ReadFile(s.path); err == nil {
+		json.Unmarshal(b, s)
+		if s.Delivered == nil {
+			s.Delivered = make(map[string][]string)
+		}
+	}
+	return s
+}
+
+func (s *deliveryState) isDelivered(dest, fileName string) bool {
+	if s == nil {
+		return false
+	}
+	for _, name := range s.Delivered[dest] {
+		if name == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+// State is saved after each delivery so that it survives a restart
+func (s *deliveryState) markDelivered(dest, fileName string) error {
+	if s.isDelivered(dest, fileName) {
+		return nil
+	}
+	s.Delivered[dest] = append(s.Delivered[dest], fileName)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	deliveryStateLock.Lock()
+	defer deliveryStateLock.Unlock()
+	return ioutil.WriteFile(s.path, b, filePermissions)
+}
+
+// Start an upload pass whose deliveries to other destinations
+// take at most the configured timeout in total
+func startDeliveryPass() context.CancelFunc {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*
+		time.Duration(config.GetInt(analyticsDestinationTimeout)))
+	currentDeliveryPass = &deliveryPass{ctx: ctx, failed: make(map[string]error)}
+	return func() {
+		cancel()
+		currentDeliveryPass = nil
+	}
+}
+
+// Deliver files to destinations other than UAP. Returns false
+// if any required destination did not get all files.
+func deliverToDestinations(dirName, tenant string, dests []destination,
+	state *deliveryState, files []os.FileInfo, relativeFilePaths []string) bool {
+	pass := currentDeliveryPass
+	if pass == nil {
+		// upload outside of a pass, eg. tests
+		cancel := startDeliveryPass()
+		defer cancel()
+		pass = currentDeliveryPass
+	}
+
+	completePath := filepath.Join(localAnalyticsStagingDir, dirName)
+	status := true
+	for _, d := range dests {
+		for i, file := range files {
+			if state.isDelivered(d.getName(), file.Name()) {
+				continue
+			}
+			err := pass.failed[d.getName()]
+			if err == nil {
+				err = pass.ctx.Err()
+			}
+			if err != nil {
+				err = fmt.Errorf("skipped for this upload pass: %v", err)
+			} else {
+				completeFilePath := filepath.Join(completePath, file.Name())
+				err = d.deliver(pass.ctx, tenant, relativeFilePaths[i], completeFilePath)
+				if err == nil {
+					err = state.markDelivered(d.getName(), file.Name())
+				} else {
+					pass.failed[d.getName()] = err
+				}
+			}
+			if err != nil {
+				log.Errorf("Delivery of '%s' to destination '%s' failed "+
+					"due to: %v", file.Name(), d.getName(), err)
+				if d.isRequired() {
+					status = false
+					setLastUploadError(dirName, fmt.Sprintf(
+						"destination %s: %v", d.getName(), err))
+				}
+				// remaining files are attempted if the directory is retried
+				break
+			}
+		}
+	}
+	return status
+}
+
+// PUT each file to <url>/<tenant>/<relative file path>
+type httpDestination struct {
+	destinationConfig
+	name  string
+	url   string
+	token string
+}
+
+func newHttpDestination(name string, c destinationConfig) (destination, error) {
+	url := config.GetString(getDestinationConfigKey(name, "url"))
+	if url == "" {
+		return nil, fmt.Errorf("URL of destination '%s' is not configured", name)
+	}
+	return &httpDestination{
+		destinationConfig: c,
+		name:              name,
+		url:               strings.TrimSuffix(url, "/"),
+		token:             config.GetString(getDestinationConfigKey(name, "token")),
+	}, nil
+}
+
+func (d *httpDestination) getName() string {
+	return d.name
+}
+
+func (d *httpDestination) isRequired() bool {
+	return d.required
+}
+
+func (d *httpDestination) deliver(ctx context.Context, tenant, relativeFilePath, completeFilePath string) error {
+	file, err := openStagedFile(completeFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	req, err := http.NewRequest("PUT", d.url+"/"+tenant+"/"+relativeFilePath,
+		io.NewSectionReader(file, 0, file.Size()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = file.Size()
+	if isManifestFile(completeFilePath) {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-gzip")
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Destination returned error '%v'", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var _ = Describe("test delivery to destinations", func() {
+	var server *httptest.Server
+	var lock sync.Mutex
+	var received map[string]string
+	var responseStatus int
+
+	getReceived := func() map[string]string {
+		lock.Lock()
+		defer lock.Unlock()
+		r := make(map[string]string)
+		for k, v := range received {
+			r[k] = v
+		}
+		return r
+	}
+
+	setResponseStatus := func(status int) {
+		lock.Lock()
+		responseStatus = status
+		lock.Unlock()
+	}
+
+	createStagingDir := func(name string) (os.FileInfo, string) {
+		dirPath := filepath.Join(localAnalyticsStagingDir, name)
+		Expect(os.Mkdir(dirPath, dirPermissions)).To(Succeed())
+		fp := filepath.Join(dirPath, "fakefile.txt.gz")
+		Expect(ioutil.WriteFile(fp, []byte("records"), filePermissions)).To(Succeed())
+		dir, _ := os.Stat(dirPath)
+		return dir, fp
+	}
+
+	BeforeEach(func() {
+		received = make(map[string]string)
+		responseStatus = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+				if req.Method == "PUT" && responseStatus == http.StatusOK {
+					body, _ := ioutil.ReadAll(req.Body)
+					received[req.URL.Path] = req.Header.Get("Authorization") +
+						" " + string(body)
+				}
+				w.WriteHeader(responseStatus)
+			}))
+
+		config.Set(analyticsDestinations, "backup")
+		config.Set(analyticsDestinationPrefix+"backup_url", server.URL+"/analytics/")
+		config.Set(analyticsDestinationPrefix+"backup_token", "secret")
+		config.Set(analyticsDestinationPrefix+"backup_required", true)
+		config.Set(analyticsDestinationPrefix+"backup_tenants", "")
+		Expect(initDestinations()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsDestinations, "")
+		Expect(initDestinations()).To(Succeed())
+		server.Close()
+	})
+
+	It("should deliver files to UAP and the destination", func() {
+		dir, fp := createStagingDir("testorg~testenv~20170130155400")
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(getReceived()).To(Equal(map[string]string{
+			"/analytics/testorg~testenv/date=2017-01-30/time=15-54-00/fakefile.txt.gz": "Bearer secret records",
+		}))
+	})
+
+	It("should keep directory till a required destination succeeds", func() {
+		dir, fp := createStagingDir("testorg~testenv~20170130155600")
+		defer os.RemoveAll(filepath.Dir(fp))
+		setResponseStatus(http.StatusServiceUnavailable)
+
+		Expect(uploadDir(dir)).To(BeFalse())
+		Expect(fp).To(BeAnExistingFile())
+		Expect(getReceived()).To(BeEmpty())
+
+		state := loadDeliveryState(filepath.Dir(fp), getDestinations("testorg~testenv"))
+		Expect(state.isDelivered(uapDestinationName, "fakefile.txt.gz")).To(BeTrue())
+		Expect(state.isDelivered("backup", "fakefile.txt.gz")).To(BeFalse())
+
+		Expect(popLastUploadError(dir.Name())).To(ContainSubstring("destination backup"))
+
+		setResponseStatus(http.StatusOK)
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(getReceived()).To(HaveLen(1))
+	})
+
+	It("should not block upload if an optional destination fails", func() {
+		config.Set(analyticsDestinationPrefix+"backup_required", false)
+		Expect(initDestinations()).To(Succeed())
+		dir, fp := createStagingDir("testorg~testenv~20170130155800")
+		defer os.RemoveAll(filepath.Dir(fp))
+		setResponseStatus(http.StatusInternalServerError)
+
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(getReceived()).To(BeEmpty())
+	})
+
+	It("should deliver files of configured tenants only", func() {
+		config.Set(analyticsDestinationPrefix+"backup_tenants", "otherorg~otherenv")
+		Expect(initDestinations()).To(Succeed())
+		Expect(getDestinations("testorg~testenv")).To(BeEmpty())
+		Expect(getDestinations("otherorg~otherenv")).To(HaveLen(1))
+
+		dir, fp := createStagingDir("testorg~testenv~20170130160000")
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(fp).ToNot(BeAnExistingFile())
+		Expect(getReceived()).To(BeEmpty())
+	})
+
+	It("should not treat delivery state as data", func() {
+		Expect(isDeliveryStateFile(deliveryStateFileName)).To(BeTrue())
+		Expect(isDataFile(deliveryStateFileName)).To(BeFalse())
+	})
+
+	It("should reject invalid destinations", func() {
+		config.Set(analyticsDestinations, "uap")
+		Expect(initDestinations()).ToNot(Succeed())
+
+		config.Set(analyticsDestinations, "backup")
+		config.Set(analyticsDestinationPrefix+"backup_type", "ftp")
+		Expect(initDestinations()).ToNot(Succeed())
+
+		config.Set(analyticsDestinationPrefix+"backup_type", "http")
+		config.Set(analyticsDestinationPrefix+"backup_url", "")
+		Expect(initDestinations()).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,377 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+Buffered analytics files are optionally encrypted at rest using AES-GCM
+envelope encryption. A random data key is generated for each file and
+stored in the file header encrypted with the configured master key.
+Since AES-GCM cannot encrypt a stream, the gzip data is sealed in frames,
+one for each flush of the gzip writer, so that complete records written
+before a crash can still be recovered.
+
+File format:
+magic (4 bytes) | wrapped key length (2 bytes) | nonce + wrapped data key |
+frames of: ciphertext length (4 bytes) | ciphertext
+Nonce of each frame is its index as the data key is never reused.
+*/
+
+const (
+	// Data is sealed into a frame when buffered data exceeds this size
+	maxFramePlaintext = 64 * 1024
+	frameLengthSize   = 4
+)
+
+var encryptedFileMagic = []byte("AXE1")
+
+// Master key used to encrypt the data key of each file.
+// Encryption is disabled if it is nil.
+var encryptionKey []byte
+
+var errEncryptionKeyMissing = errors.New("File is encrypted but " +
+	"no encryption key is configured")
+
+// Load master key from configured file. Key is 32 bytes base64 encoded.
+func initEncryption() error {
+	path := config.GetString(analyticsEncryptionKeyFile)
+	if path == "" {
+		encryptionKey = nil
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read encryption key file '%s': %v", path, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("Encryption key in '%s' should be 32 "+
+			"bytes base64 encoded", path)
+	}
+	encryptionKey = key
+	log.Infof("Analytics files will be encrypted at rest")
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func frameNonce(gcm cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[gcm.NonceSize()-8:], index)
+	return nonce
+}
+
+// Writes file header and seals data into frames on each Flush
+type encryptingWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	buf    bytes.Buffer
+	frames uint64
+}
+
+func newEncryptingWriter(w io.Writer, masterKey []byte) (*encryptingWriter, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	masterGCM, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, masterGCM.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrappedKey := masterGCM.Seal(nonce, nonce, dataKey, encryptedFileMagic)
+
+	header := make([]byte, 0, len(encryptedFileMagic)+2+len(wrappedKey))
+	header = append(header, encryptedFileMagic...)
+	header = append(header, byte(len(wrappedKey)>>8), byte(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, gcm: gcm}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	n, _ := e.buf.Write(p)
+	if e.buf.Len() >= maxFramePlaintext {
+		if err := e.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Seal buffered data into a frame and write it
+func (e *encryptingWriter) Flush() error {
+	if e.buf.Len() == 0 {
+		return nil
+	}
+	sealed := e.gcm.Seal(nil, frameNonce(e.gcm, e.frames), e.buf.Bytes(), nil)
+	frame := make([]byte, frameLengthSize, frameLengthSize+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	frame = append(frame, sealed...)
+	if _, err := e.w.Write(frame); err != nil {
+		return err
+	}
+	e.frames++
+	e.buf.Reset()
+	return nil
+}
+
+// Reads file header and returns cipher for the data key.
+// Returns nil if the file is not encrypted.
+func readEncryptionHeader(r io.ReaderAt) (cipher.AEAD, int64, error) {
+	magic := make([]byte, len(encryptedFileMagic)+2)
+	if _, err := r.ReadAt(magic, 0); err != nil ||
+		!bytes.Equal(magic[:len(encryptedFileMagic)], encryptedFileMagic) {
+		return nil, 0, nil
+	}
+	if encryptionKey == nil {
+		return nil, 0, errEncryptionKeyMissing
+	}
+
+	keyLen := int(magic[len(magic)-2])<<8 | int(magic[len(magic)-1])
+	wrappedKey := make([]byte, keyLen)
+	if _, err := r.ReadAt(wrappedKey, int64(len(magic))); err != nil {
+		return nil, 0, fmt.Errorf("Cannot read encryption header: %v", err)
+	}
+
+	masterGCM, err := newGCM(encryptionKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonceSize := masterGCM.NonceSize()
+	if keyLen < nonceSize {
+		return nil, 0, fmt.Errorf("Invalid encryption header")
+	}
+	dataKey, err := masterGCM.Open(nil, wrappedKey[:nonceSize],
+		wrappedKey[nonceSize:], encryptedFileMagic)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Cannot decrypt data key: %v", err)
+	}
+	gcm, err := newGCM(dataKey)
+	return gcm, int64(len(magic) + keyLen), err
+}
+
+// Decrypts frames sequentially. Returns io.ErrUnexpectedEOF
+// if the last frame is incomplete i.e. file was not closed.
+type decryptingReader struct {
+	r      *bufio.Reader
+	gcm    cipher.AEAD
+	buf    []byte
+	frames uint64
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		length := make([]byte, frameLengthSize)
+		if _, err := io.ReadFull(d.r, length); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(length))
+		if _, err := io.ReadFull(d.r, sealed); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		plain, err := d.gcm.Open(nil, frameNonce(d.gcm, d.frames), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot decrypt frame %d: %v", d.frames, err)
+		}
+		d.frames++
+		d.buf = plain
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Returns a reader for the plain gzip data of a possibly encrypted file
+func newFileReader(file *os.File) (io.Reader, error) {
+	gcm, offset, err := readEncryptionHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if gcm == nil {
+		return file, nil
+	}
+	return &decryptingReader{
+		r:   bufio.NewReader(io.NewSectionReader(file, offset, 1<<62)),
+		gcm: gcm}, nil
+}
+
+// Staged file opened for upload which provides random access
+// to the plain gzip data whether or not the file is encrypted
+type stagedFile interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+type plainStagedFile struct {
+	*os.File
+	size int64
+}
+
+func (p plainStagedFile) Size() int64 {
+	return p.size
+}
+
+type frameIndex struct {
+	fileOffset  int64
+	plainOffset int64
+	plainLength int64
+}
+
+// Decrypts frames covering the requested range on demand
+// so that decrypted data is never written to disk
+type encryptedStagedFile struct {
+	file   *os.File
+	gcm    cipher.AEAD
+	frames []frameIndex
+	size   int64
+	// last decrypted frame
+	cached      int
+	cachedPlain []byte
+}
+
+func openStagedFile(completeFilePath string) (stagedFile, error) {
+	file, err := os.Open(completeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Could not get content length for "+
+			"file '%v'", err)
+	}
+
+	gcm, offset, err := readEncryptionHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if gcm == nil {
+		return plainStagedFile{File: file, size: info.Size()}, nil
+	}
+
+	e := &encryptedStagedFile{file: file, gcm: gcm, cached: -1}
+	length := make([]byte, frameLengthSize)
+	for offset+frameLengthSize <= info.Size() {
+		if _, err := file.ReadAt(length, offset); err != nil {
+			file.Close()
+			return nil, err
+		}
+		sealedLength := int64(binary.BigEndian.Uint32(length))
+		if offset+frameLengthSize+sealedLength > info.Size() ||
+			sealedLength < int64(gcm.Overhead()) {
+			file.Close()
+			return nil, fmt.Errorf("Encrypted file '%s' is "+
+				"incomplete", completeFilePath)
+		}
+		plainLength := sealedLength - int64(gcm.Overhead())
+		e.frames = append(e.frames, frameIndex{
+			fileOffset:  offset + frameLengthSize,
+			plainOffset: e.size,
+			plainLength: plainLength})
+		e.size += plainLength
+		offset += frameLengthSize + sealedLength
+	}
+	return e, nil
+}
+
+func (e *encryptedStagedFile) Size() int64 {
+	return e.size
+}
+
+func (e *encryptedStagedFile) Close() error {
+	return e.file.Close()
+}
+
+func (e *encryptedStagedFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= e.size {
+			return n, io.EOF
+		}
+		i := e.findFrame(off)
+		plain, err := e.decryptFrame(i)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plain[off-e.frames[i].plainOffset:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// binary search for the frame containing plain offset
+func (e *encryptedStagedFile) findFrame(off int64) int {
+	lo, hi := 0, len(e.frames)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if e.frames[mid].plainOffset <= off {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+func (e *encryptedStagedFile) decryptFrame(i int) ([]byte, error) {
+	if e.cached == i {
+		return e.cachedPlain, nil
+	}
+	frame := e.frames[i]
+	sealed := make([]byte, frame.plainLength+int64(e.gcm.Overhead()))
+	if _, err := e.file.ReadAt(sealed, frame.fileOffset); err != nil {
+		return nil, err
+	}
+	plain, err := e.gcm.Open(nil, frameNonce(e.gcm, uint64(i)), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt frame %d: %v", i, err)
+	}
+	e.cached, e.cachedPlain = i, plain
+	return plain, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test encryption at rest", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = filepath.Join(testTempDir, "encryption")
+		os.MkdirAll(dir, os.ModePerm)
+		encryptionKey = bytes.Repeat([]byte{1}, 32)
+	})
+
+	AfterEach(func() {
+		encryptionKey = nil
+		os.RemoveAll(dir)
+	})
+
+	readRecords := func(r io.Reader) []string {
+		gzReader, err := gzip.NewReader(r)
+		Expect(err).ShouldNot(HaveOccurred())
+		var lines []string
+		scanner := bufio.NewScanner(gzReader)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		return lines
+	}
+
+	writeFile := func(fp string, batches int) {
+		fw, err := createGzipFile(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		for i := 0; i < batches; i++ {
+			writeGzipFile(fw, []interface{}{
+				map[string]int{"batch": i}})
+		}
+		closeGzipFile(fw)
+	}
+
+	It("should write encrypted file with restricted permissions", func() {
+		fp := filepath.Join(dir, "encrypted.txt.gz")
+		writeFile(fp, 3)
+
+		info, err := os.Stat(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(filePermissions))
+
+		b, _ := ioutil.ReadFile(fp)
+		Expect(b[:len(encryptedFileMagic)]).To(Equal(encryptedFileMagic))
+		Expect(bytes.Contains(b, []byte("batch"))).To(BeFalse())
+	})
+
+	It("should decrypt file for upload", func() {
+		fp := filepath.Join(dir, "encrypted.txt.gz")
+		writeFile(fp, 3)
+
+		f, err := openStagedFile(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		records := readRecords(io.NewSectionReader(f, 0, f.Size()))
+		Expect(records).To(Equal([]string{
+			`{"batch":0}`, `{"batch":1}`, `{"batch":2}`}))
+
+		By("key is not configured")
+		encryptionKey = nil
+		_, err = openStagedFile(fp)
+		Expect(err).To(Equal(errEncryptionKeyMissing))
+	})
+
+	It("should read plain files when encryption is enabled", func() {
+		encryptionKey = nil
+		fp := filepath.Join(dir, "plain.txt.gz")
+		writeFile(fp, 1)
+
+		encryptionKey = bytes.Repeat([]byte{1}, 32)
+		f, err := openStagedFile(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		Expect(readRecords(io.NewSectionReader(f, 0, f.Size()))).To(
+			Equal([]string{`{"batch":0}`}))
+	})
+
+	It("should recover complete frames from partial file", func() {
+		fp := filepath.Join(dir, "partial.txt.gz")
+		fw, err := createGzipFile(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		writeGzipFile(fw, []interface{}{map[string]int{"batch": 0}})
+		writeGzipFile(fw, []interface{}{map[string]int{"batch": 1}})
+		fw.file.Close()
+
+		// simulate crash in the middle of writing last frame
+		b, _ := ioutil.ReadFile(fp)
+		ioutil.WriteFile(fp, b[:len(b)-5], filePermissions)
+
+		recovered := filepath.Join(dir, "recovered.txt.gz")
+		copyPartialFile(fp, recovered)
+
+		f, err := openStagedFile(recovered)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		Expect(readRecords(io.NewSectionReader(f, 0, f.Size()))).To(
+			Equal([]string{`{"batch":0}`}))
+	})
+
+	It("should compare plain size of encrypted files to the multipart threshold", func() {
+		fp := filepath.Join(dir, "large.txt.gz")
+		writeFile(fp, 3)
+		defer config.Set(analyticsMultipartThreshold, analyticsMultipartThresholdDefault)
+
+		info, _ := os.Stat(fp)
+		f, err := openStagedFile(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		plainSize := f.Size()
+		f.Close()
+		Expect(plainSize).To(BeNumerically("<", info.Size()))
+
+		config.Set(analyticsMultipartThreshold, plainSize)
+		Expect(isLargeFile(fp)).To(BeFalse())
+		config.Set(analyticsMultipartThreshold, plainSize-1)
+		Expect(isLargeFile(fp)).To(BeTrue())
+	})
+
+	It("should load key from configured file", func() {
+		keyFile := filepath.Join(dir, "key")
+		defer config.Set(analyticsEncryptionKeyFile, "")
+
+		By("invalid key")
+		ioutil.WriteFile(keyFile, []byte("short"), filePermissions)
+		config.Set(analyticsEncryptionKeyFile, keyFile)
+		Expect(initEncryption()).ToNot(Succeed())
+
+		By("valid key")
+		key := bytes.Repeat([]byte{2}, 32)
+		ioutil.WriteFile(keyFile, []byte(
+			base64.StdEncoding.EncodeToString(key)+"\n"), filePermissions)
+		Expect(initEncryption()).To(Succeed())
+		Expect(encryptionKey).To(Equal(key))
+	})
+})
@@ -0,0 +1,315 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+// Sidecar file in each directory which keeps track of failed
+// upload attempts. It moves along with the directory between
+// staging and failed directories and is never uploaded.
+const failureInfoFileName = ".failure.json"
+
+// Lock for moving directories in and out of the failed directory
+// since they are managed by the upload manager and the admin API
+var failedDirLock = sync.Mutex{}
+
+// Last upload error of each staging directory till
+// it is recorded in the failure sidecar
+var lastUploadErrors = make(map[string]string)
+
+var lastUploadErrorsLock = sync.Mutex{}
+
+type failureInfo struct {
+	Attempts     int    `json:"attempts"`
+	LastError    string `json:"lastError"`
+	LastFailedAt int64  `json:"lastFailedAt"`
+}
+
+// Failed directory as returned by the admin API
+type failedDir struct {
+	Name         string `json:"name"`
+	Tenant       string `json:"tenant"`
+	Files        int    `json:"files"`
+	SizeBytes    int64  `json:"sizeBytes"`
+	AgeSeconds   int64  `json:"ageSeconds"`
+	Attempts     int    `json:"attempts"`
+	LastError    string `json:"lastError"`
+	LastFailedAt int64  `json:"lastFailedAt"`
+}
+
+func isFailureInfoFile(fileName string) bool {
+	return fileName == failureInfoFileName
+}
+
+func readFailureInfo(dirPath string) failureInfo {
+	var info failureInfo
+	b, err := ioutil.ReadFile(filepath.Join(dirPath, failureInfoFileName))
+	if err == nil {
+		json.Unmarshal(b, &info)
+	}
+	return info
+}
+
+func setLastUploadError(dirName, lastError string) {
+	lastUploadErrorsLock.Lock()
+	defer lastUploadErrorsLock.Unlock()
+	lastUploadErrors[dirName] = lastError
+}
+
+// Returns last upload error of the directory and forgets it
+func popLastUploadError(dirName string) string {
+	lastUploadErrorsLock.Lock()
+	defer lastUploadErrorsLock.Unlock()
+	lastError := lastUploadErrors[dirName]
+	delete(lastUploadErrors, dirName)
+	return lastError
+}
+
+// Increment attempts and save last error for the directory
+func recordUploadFailure(dirPath, lastError string) {
+	info := readFailureInfo(dirPath)
+	info.Attempts++
+	info.LastError = lastError
+	info.LastFailedAt = time.Now().Unix()
+
+	b, _ := json.Marshal(info)
+	err := ioutil.WriteFile(filepath.Join(dirPath, failureInfoFileName),
+		b, filePermissions)
+	if err != nil {
+		log.Errorf("Cannot save failure info for '%s': %v", dirPath, err)
+	}
+}
+
+func listFailedDirs() ([]failedDir, error) {
+	dirs, err := ioutil.ReadDir(localAnalyticsFailedDir)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := []failedDir{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		dirPath := filepath.Join(localAnalyticsFailedDir, dir.Name())
+		tenant, timestamp := splitDirName(dir.Name())
+		info := readFailureInfo(dirPath)
+		f := failedDir{
+			Name:         dir.Name(),
+			Tenant:       tenant,
+			Attempts:     info.Attempts,
+			LastError:    info.LastError,
+			LastFailedAt: info.LastFailedAt,
+		}
+		if t, err := time.Parse(timestampLayout, timestamp); err == nil {
+			f.AgeSeconds = int64(time.Since(t).Seconds())
+		}
+		files, _ := ioutil.ReadDir(dirPath)
+		for _, file := range files {
+			if !isDataFile(file.Name()) {
+				continue
+			}
+			f.Files++
+			f.SizeBytes += file.Size()
+		}
+		failed = append(failed, f)
+	}
+	return failed, nil
+}
+
+// Returns path of the failed directory if it exists. Names with path
+// separators are rejected so that only failed directories are accessed
+func getFailedDirPath(name string) (string, bool) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", false
+	}
+	dirPath := filepath.Join(localAnalyticsFailedDir, name)
+	info, err := os.Stat(dirPath)
+	if err != nil || !info.IsDir() {
+		return "", false
+	}
+	return dirPath, true
+}
+
+// Move failed directory back to staging so that upload manager retries it
+func retryFailedDir(name string) error {
+	return os.Rename(filepath.Join(localAnalyticsFailedDir, name),
+		filepath.Join(localAnalyticsStagingDir, name))
+}
+
+func getFailedUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	failedDirLock.Lock()
+	failed, err := listFailedDirs()
+	failedDirLock.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError,
+			"INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	writeJson(w, failed)
+}
+
+// Retry one failed directory if name is given, else all failed directories
+func retryFailedUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	name, single := apid.API().Vars(r)["failed_dir"]
+
+	failedDirLock.Lock()
+	defer failedDirLock.Unlock()
+
+	names, e := getFailedDirNames(name, single)
+	if e.ErrorCode != "" {
+		writeError(w, http.StatusNotFound, e.ErrorCode, e.Reason)
+		return
+	}
+	retried := []string{}
+	for _, n := range names {
+		if err := retryFailedDir(n); err != nil {
+			log.Errorf("Cannot move directory '%s'"+
+				" from failed to staging folder", n)
+			continue
+		}
+		retried = append(retried, n)
+	}
+	log.Infof("Retrying %d failed directories on request", len(retried))
+	writeJson(w, map[string][]string{"retried": retried})
+}
+
+// Delete one failed directory if name is given, else all failed directories
+func deleteFailedUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	name, single := apid.API().Vars(r)["failed_dir"]
+
+	failedDirLock.Lock()
+	defer failedDirLock.Unlock()
+
+	names, e := getFailedDirNames(name, single)
+	if e.ErrorCode != "" {
+		writeError(w, http.StatusNotFound, e.ErrorCode, e.Reason)
+		return
+	}
+	deleted := []string{}
+	for _, n := range names {
+		if err := os.RemoveAll(filepath.Join(localAnalyticsFailedDir, n)); err != nil {
+			log.Errorf("Cannot delete failed directory '%s': %v", n, err)
+			continue
+		}
+		deleted = append(deleted, n)
+	}
+	log.Warnf("Deleted %d failed directories on request", len(deleted))
+	writeJson(w, map[string][]string{"deleted": deleted})
+}
+
+func getFailedDirNames(name string, single bool) ([]string, errResponse) {
+	if single {
+		if _, exists := getFailedDirPath(name); !exists {
+			return nil, errResponse{ErrorCode: "NOT_FOUND",
+				Reason: "Failed directory '" + name + "' does not exist"}
+		}
+		return []string{name}, errResponse{}
+	}
+	dirs, _ := ioutil.ReadDir(localAnalyticsFailedDir)
+	names := []string{}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			names = append(names, dir.Name())
+		}
+	}
+	return names, errResponse{}
+}
+
+// Stream files of a failed directory as a tar archive so that they can be
+// shipped manually. Encrypted files are decrypted while being archived.
+func downloadFailedDir(w http.ResponseWriter, r *http.Request) {
+	name := apid.API().Vars(r)["failed_dir"]
+
+	failedDirLock.Lock()
+	defer failedDirLock.Unlock()
+
+	dirPath, exists := getFailedDirPath(name)
+	if !exists {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		writeError(w, http.StatusNotFound, "NOT_FOUND",
+			"Failed directory '"+name+"' does not exist")
+		return
+	}
+
+	files, _ := ioutil.ReadDir(dirPath)
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".tar\"")
+	w.WriteHeader(http.StatusOK)
+
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for _, file := range files {
+		if file.IsDir() || isFailureInfoFile(file.Name()) ||
+			isUploadStateFile(file.Name()) || isDeliveryStateFile(file.Name()) {
+			continue
+		}
+		if err := writeTarEntry(tw, filepath.Join(dirPath, file.Name()),
+			file); err != nil {
+			// headers are already sent so archive is left incomplete
+			log.Errorf("Cannot archive file '%s': %v", file.Name(), err)
+			return
+		}
+	}
+}
+
+func writeTarEntry(tw *tar.Writer, completeFilePath string, info os.FileInfo) error {
+	file, err := openStagedFile(completeFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    info.Name(),
+		Mode:    int64(filePermissions),
+		Size:    file.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, io.NewSectionReader(file, 0, file.Size()))
+	return err
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("unable to marshal response: %v", err)
+		writeError(w, http.StatusInternalServerError,
+			"INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
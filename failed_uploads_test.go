@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test recordUploadFailure()", func() {
+	It("should keep attempts and last error with the directory", func() {
+		dirName := "testorg~testenv~20160101540000"
+		dirPath := filepath.Join(localAnalyticsStagingDir, dirName)
+		Expect(os.Mkdir(dirPath, os.ModePerm)).To(Succeed())
+		defer os.RemoveAll(dirPath)
+
+		setLastUploadError(dirName, "first error")
+		info, _ := os.Stat(dirPath)
+		handleUploadDirStatus(info, false)
+		recordUploadFailure(dirPath, "second error")
+
+		failure := readFailureInfo(dirPath)
+		Expect(failure.Attempts).To(Equal(2))
+		Expect(failure.LastError).To(Equal("second error"))
+		Expect(failure.LastFailedAt).ToNot(BeZero())
+		delete(retriesMap, dirName)
+	})
+})
+
+var _ = Describe("test getFailedDirPath()", func() {
+	It("should only return existing failed directories", func() {
+		dirName := "testorg~testenv~20160101550000"
+		dirPath := filepath.Join(localAnalyticsFailedDir, dirName)
+		Expect(os.Mkdir(dirPath, os.ModePerm)).To(Succeed())
+		defer os.RemoveAll(dirPath)
+
+		p, exists := getFailedDirPath(dirName)
+		Expect(exists).To(BeTrue())
+		Expect(p).To(Equal(dirPath))
+
+		_, exists = getFailedDirPath("testorg~testenv~20160101560000")
+		Expect(exists).To(BeFalse())
+		_, exists = getFailedDirPath("../staging")
+		Expect(exists).To(BeFalse())
+		_, exists = getFailedDirPath("..")
+		Expect(exists).To(BeFalse())
+	})
+})
+
+var _ = Describe("admin API for failed uploads", func() {
+	var dirName, dirPath string
+
+	BeforeEach(func() {
+		dirName = "failedorg~testenv~20160101570000"
+		dirPath = filepath.Join(localAnalyticsFailedDir, dirName)
+		Expect(os.Mkdir(dirPath, os.ModePerm)).To(Succeed())
+		ioutil.WriteFile(filepath.Join(dirPath, "fakefile.txt.gz"),
+			[]byte("data"), filePermissions)
+		recordUploadFailure(dirPath, "Final Datastore (S3/GCS)returned Error")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dirPath)
+		os.RemoveAll(filepath.Join(localAnalyticsStagingDir, dirName))
+	})
+
+	It("should list failed directories", func() {
+		res, body := makeFailedRequest("GET", "")
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		var failed []failedDir
+		Expect(json.Unmarshal(body, &failed)).To(Succeed())
+		var found *failedDir
+		for i := range failed {
+			if failed[i].Name == dirName {
+				found = &failed[i]
+			}
+		}
+		Expect(found).ToNot(BeNil())
+		Expect(found.Tenant).To(Equal("failedorg~testenv"))
+		Expect(found.Files).To(Equal(1))
+		Expect(found.SizeBytes).To(Equal(int64(4)))
+		Expect(found.AgeSeconds).To(BeNumerically(">", 0))
+		Expect(found.Attempts).To(Equal(1))
+		Expect(found.LastError).To(ContainSubstring("Final Datastore"))
+	})
+
+	It("should retry failed directory", func() {
+		res, body := makeFailedRequest("POST", "/"+dirName+"/retry")
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(ContainSubstring(dirName))
+		Expect(dirPath).ToNot(BeADirectory())
+
+		By("unknown directory")
+		res, body = makeFailedRequest("POST", "/"+dirName+"/retry")
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+		var e errResponse
+		json.Unmarshal(body, &e)
+		Expect(e.ErrorCode).To(Equal("NOT_FOUND"))
+	})
+
+	It("should delete failed directory", func() {
+		res, body := makeFailedRequest("DELETE", "/"+dirName)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(ContainSubstring(dirName))
+		Expect(dirPath).ToNot(BeADirectory())
+	})
+
+	It("should download failed directory as tar", func() {
+		res, body := makeFailedRequest("GET", "/"+dirName+"/download")
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.Header.Get("Content-Type")).To(Equal("application/x-tar"))
+
+		tr := tar.NewReader(bytes.NewReader(body))
+		header, err := tr.Next()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(header.Name).To(Equal("fakefile.txt.gz"))
+		data, _ := ioutil.ReadAll(tr)
+		Expect(string(data)).To(Equal("data"))
+
+		// failure sidecar is not part of the archive
+		_, err = tr.Next()
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+func makeFailedRequest(method, path string) (*http.Response, []byte) {
+	uri, err := url.Parse(testServer.URL)
+	Expect(err).ShouldNot(HaveOccurred())
+	uri.Path = analyticsBasePath + "/admin/failed" + path
+
+	req, _ := http.NewRequest(method, uri.String(), nil)
+	return makeAdminRequest(req)
+}
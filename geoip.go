@@ -0,0 +1,242 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Records are enriched with the location of the client IP looked up in
+local MaxMind DB files i.e. a GeoIP2/GeoLite2 City (or Country) database
+and optionally an ASN database. Files are reloaded when they change and
+lookups are cached since the same clients send many requests.
+*/
+
+// Interval at which database files are checked for changes
+const geoIPReloadInterval = time.Minute
+
+// Fields added to the record
+const (
+	geoCountryField  = "ax_geo_country"
+	geoRegionField   = "ax_geo_region"
+	geoCityField     = "ax_geo_city"
+	geoASNField      = "ax_geo_asn"
+	geoASOrgField    = "ax_geo_as_organization"
+	geoDefaultLocale = "en"
+)
+
+type geoIPDB struct {
+	path    string
+	reader  *mmdbReader
+	modTime time.Time
+	size    int64
+}
+
+var geoIPDBs []*geoIPDB
+
+// Cache from IP to fields added for it
+var geoIPCache *lruCache
+
+// Lock for geoIPDBs and geoIPCache since databases are reloaded
+var geoIPLock = sync.RWMutex{}
+
+// Reload is started once even if GeoIP is initialized again
+var geoIPReloadOnce sync.Once
+
+// Addresses which are not looked up, eg. of a load balancer in X-Forwarded-For
+var geoIPPrivateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12",
+		"192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16", "100.64.0.0/10",
+		"::1/128", "fc00::/7", "fe80::/10"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		geoIPPrivateNets = append(geoIPPrivateNets, n)
+	}
+}
+
+func initGeoIP() error {
+	var dbs []*geoIPDB
+	for _, key := range []string{analyticsGeoIPDBFile, analyticsGeoIPASNDBFile} {
+		path := config.GetString(key)
+		if path == "" {
+			continue
+		}
+		db := &geoIPDB{path: path}
+		if err := db.load(); err != nil {
+			return err
+		}
+		dbs = append(dbs, db)
+	}
+
+	geoIPLock.Lock()
+	geoIPDBs = dbs
+	geoIPCache = newLRUCache(config.GetInt(analyticsGeoIPCacheSize))
+	geoIPLock.Unlock()
+
+	if len(dbs) > 0 {
+		log.Infof("Enriching records with location of client IP")
+		geoIPReloadOnce.Do(func() {
+			go func() {
+				ticker := time.NewTicker(geoIPReloadInterval)
+				defer ticker.Stop()
+				for range ticker.C {
+					reloadGeoIPDBs()
+				}
+			}()
+		})
+	}
+	return nil
+}
+
+// Should be called with geoIPLock held or before db is shared
+func (db *geoIPDB) load() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("Cannot read GeoIP database '%s': %v", db.path, err)
+	}
+	reader, err := openMMDB(db.path)
+	if err != nil {
+		return fmt.Errorf("Cannot read GeoIP database '%s': %v", db.path, err)
+	}
+	db.reader, db.modTime, db.size = reader, info.ModTime(), info.Size()
+	return nil
+}
+
+// Reload database files which changed since they were loaded. If the
+// new file cannot be read then the previous database is still used.
+func reloadGeoIPDBs() {
+	geoIPLock.Lock()
+	defer geoIPLock.Unlock()
+	for _, db := range geoIPDBs {
+		info, err := os.Stat(db.path)
+		if err != nil || (info.ModTime().Equal(db.modTime) && info.Size() == db.size) {
+			continue
+		}
+		if err := db.load(); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		log.Infof("Reloaded GeoIP database '%s'", db.path)
+		geoIPCache = newLRUCache(config.GetInt(analyticsGeoIPCacheSize))
+	}
+}
+
+// Add location of the first public IP in the configured fields
+func enrichGeo(recordMap map[string]interface{}) {
+	geoIPLock.RLock()
+	defer geoIPLock.RUnlock()
+	if len(geoIPDBs) == 0 {
+		return
+	}
+
+	ip := getClientIP(recordMap)
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	fields, cached := geoIPCache.get(key)
+	if !cached {
+		fields = lookupGeoFields(ip)
+		geoIPCache.add(key, fields)
+	}
+	for field, value := range fields.(map[string]interface{}) {
+		recordMap[field] = value
+	}
+}
+
+// Eg. X-Forwarded-For has comma separated list of client and proxies
+func getClientIP(recordMap map[string]interface{}) net.IP {
+	for _, field := range strings.Split(config.GetString(analyticsGeoIPFields), ",") {
+		value, ok := recordMap[strings.TrimSpace(field)].(string)
+		if !ok {
+			continue
+		}
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip != nil && !isPrivateIP(ip) {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range geoIPPrivateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Should be called with geoIPLock held
+func lookupGeoFields(ip net.IP) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, db := range geoIPDBs {
+		v, err := db.reader.lookup(ip)
+		if err != nil {
+			log.Debugf("Cannot lookup '%s' in GeoIP database '%s': %v",
+				ip, db.path, err)
+			continue
+		}
+		result, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if country := getGeoName(result["country"], "iso_code"); country != "" {
+			fields[geoCountryField] = country
+		}
+		if subdivisions, ok := result["subdivisions"].([]interface{}); ok &&
+			len(subdivisions) > 0 {
+			if region := getGeoName(subdivisions[0], "iso_code"); region != "" {
+				fields[geoRegionField] = region
+			}
+		}
+		if city := getGeoName(result["city"], "names"); city != "" {
+			fields[geoCityField] = city
+		}
+		if asn, ok := result["autonomous_system_number"].(uint64); ok {
+			fields[geoASNField] = asn
+		}
+		if org, ok := result["autonomous_system_organization"].(string); ok {
+			fields[geoASOrgField] = org
+		}
+	}
+	return fields
+}
+
+// Returns iso_code or english name of a country, subdivision or city
+func getGeoName(v interface{}, key string) string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch value := m[key].(type) {
+	case string:
+		return value
+	case map[string]interface{}:
+		name, _ := value[geoDefaultLocale].(string)
+		return name
+	}
+	return ""
+}
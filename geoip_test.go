@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test GeoIP enrichment", func() {
+	var cityDB, asnDB string
+
+	writeCityDB := func(city string) {
+		b := buildTestMMDB(map[string]interface{}{
+			"1.2.3.0/24": map[string]interface{}{
+				"country": map[string]interface{}{"iso_code": "US",
+					"names": map[string]interface{}{"en": "United States"}},
+				"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA"}},
+				"city": map[string]interface{}{
+					"names": map[string]interface{}{"en": city, "de": city + "-de"}},
+			},
+		})
+		Expect(ioutil.WriteFile(cityDB, b, filePermissions)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		cityDB = filepath.Join(testTempDir, "city.mmdb")
+		asnDB = filepath.Join(testTempDir, "asn.mmdb")
+		writeCityDB("Mountain View")
+		b := buildTestMMDB(map[string]interface{}{
+			"1.2.0.0/16": map[string]interface{}{
+				"autonomous_system_number":       uint32(15169),
+				"autonomous_system_organization": "Test AS",
+			},
+		})
+		Expect(ioutil.WriteFile(asnDB, b, filePermissions)).To(Succeed())
+
+		config.Set(analyticsGeoIPDBFile, cityDB)
+		config.Set(analyticsGeoIPASNDBFile, asnDB)
+		Expect(initGeoIP()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsGeoIPDBFile, "")
+		config.Set(analyticsGeoIPASNDBFile, "")
+		Expect(initGeoIP()).To(Succeed())
+		os.Remove(cityDB)
+		os.Remove(asnDB)
+	})
+
+	It("should add location of first public IP", func() {
+		record := map[string]interface{}{
+			"client_ip":          "10.1.1.1",
+			"x_forwarded_for_ip": "192.168.1.1, 1.2.3.4, 5.6.7.8",
+		}
+		enrichGeo(record)
+		Expect(record[geoCountryField]).To(Equal("US"))
+		Expect(record[geoRegionField]).To(Equal("CA"))
+		Expect(record[geoCityField]).To(Equal("Mountain View"))
+		Expect(record[geoASNField]).To(Equal(uint64(15169)))
+		Expect(record[geoASOrgField]).To(Equal("Test AS"))
+		Expect(geoIPCache.len()).To(Equal(1))
+
+		By("address not in database")
+		record = map[string]interface{}{"client_ip": "5.6.7.8"}
+		enrichGeo(record)
+		Expect(record).ToNot(HaveKey(geoCountryField))
+
+		By("no public IP")
+		record = map[string]interface{}{"client_ip": "127.0.0.1"}
+		enrichGeo(record)
+		Expect(record).To(HaveLen(1))
+	})
+
+	It("should reload database when file changes", func() {
+		writeCityDB("Sunnyvale")
+		reloadGeoIPDBs()
+
+		record := map[string]interface{}{"client_ip": "1.2.3.4"}
+		enrichGeo(record)
+		Expect(record[geoCityField]).To(Equal("Sunnyvale"))
+
+		By("previous database is used if file is invalid")
+		Expect(ioutil.WriteFile(cityDB, []byte("invalid"), filePermissions)).To(Succeed())
+		reloadGeoIPDBs()
+		record = map[string]interface{}{"client_ip": "1.2.3.4"}
+		enrichGeo(record)
+		Expect(record[geoCityField]).To(Equal("Sunnyvale"))
+	})
+
+	It("should fail if database cannot be read", func() {
+		config.Set(analyticsGeoIPDBFile, filepath.Join(testTempDir, "missing.mmdb"))
+		Expect(initGeoIP()).ToNot(Succeed())
+	})
+})
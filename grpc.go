@@ -0,0 +1,243 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apid/apidAnalytics/analyticspb"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+gRPC ingestion service defined in analytics.proto, whose code is generated
+in analyticspb. It is served on its own listener over HTTP/2 so that calls
+are authenticated like the HTTP API before they reach the gRPC server.
+
+Gateways stream batches on a single Publish call. Each batch is resolved to
+a tenant, authorized, validated, enriched and published to the internal
+buffer exactly like the body of POST /analytics. Rejected batches do not
+fail the call, they are returned in the summary when the client closes the
+stream.
+*/
+
+//go:generate protoc --go_out=analyticspb --go_opt=paths=source_relative --go-grpc_out=analyticspb --go-grpc_opt=paths=source_relative analytics.proto
+
+var (
+	grpcServer     *http.Server
+	grpcService    *grpc.Server
+	grpcListener   net.Listener
+	grpcServerLock = sync.Mutex{}
+)
+
+type analyticsIngestionServer struct {
+	analyticspb.UnimplementedAnalyticsIngestionServer
+}
+
+// Start the gRPC ingestion service if a listen address is configured
+func initGRPC() error {
+	addr := config.GetString(analyticsGRPCListenAddress)
+	if addr == "" {
+		return nil
+	}
+	maxSize := config.GetInt(analyticsGRPCMaxMessageSize)
+	if maxSize <= 0 {
+		return fmt.Errorf("%s should be positive", analyticsGRPCMaxMessageSize)
+	}
+
+	// gzip compressed messages are accepted since the codec is
+	// registered, max size applies to decompressed messages too
+	service := grpc.NewServer(grpc.MaxRecvMsgSize(maxSize))
+	analyticspb.RegisterAnalyticsIngestionServer(service, analyticsIngestionServer{})
+	handler := withStreamAuth(service.ServeHTTP)
+
+	server := &http.Server{Handler: handler}
+	h2 := &http2.Server{}
+	certFile := config.GetString(analyticsGRPCTLSCertFile)
+	keyFile := config.GetString(analyticsGRPCTLSKeyFile)
+	if certFile != "" || keyFile != "" {
+		tlsConfig, err := getGRPCTLSConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	} else {
+		server.Handler = h2c.NewHandler(handler, h2)
+	}
+	// Also registers graceful shutdown of HTTP/2 connections
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on '%s' for gRPC: %v", addr, err)
+	}
+	grpcServerLock.Lock()
+	grpcServer = server
+	grpcService = service
+	grpcListener = listener
+	grpcServerLock.Unlock()
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("gRPC ingestion service stopped: %v", err)
+		}
+	}()
+	log.Infof("gRPC ingestion service listening on %s", listener.Addr())
+	return nil
+}
+
+// Client certificates are verified if a CA is configured so that
+// they can be used by the client certificate authenticator
+func getGRPCTLSConfig() (*tls.Config, error) {
+	if config.GetString(analyticsGRPCTLSCertFile) == "" ||
+		config.GetString(analyticsGRPCTLSKeyFile) == "" {
+		return nil, fmt.Errorf("Both %s and %s should be configured",
+			analyticsGRPCTLSCertFile, analyticsGRPCTLSKeyFile)
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFile := config.GetString(analyticsGRPCTLSClientCAFile)
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read client CA file '%s': %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in client CA file '%s'", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+func getGRPCAddress() string {
+	grpcServerLock.Lock()
+	defer grpcServerLock.Unlock()
+	if grpcListener == nil {
+		return ""
+	}
+	return grpcListener.Addr().String()
+}
+
+// Stop the gRPC ingestion service and wait for streams in progress
+func closeGRPC() {
+	grpcServerLock.Lock()
+	server, service := grpcServer, grpcService
+	grpcServer = nil
+	grpcService = nil
+	grpcListener = nil
+	grpcServerLock.Unlock()
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Cannot shutdown gRPC ingestion service: %v", err)
+	}
+	// streams still in progress after the timeout are closed
+	service.Stop()
+}
+
+func (analyticsIngestionServer) Publish(stream analyticspb.AnalyticsIngestion_PublishServer) error {
+	if getDB() == nil {
+		return status.Error(codes.Unavailable, "Service is not initialized completely")
+	}
+
+	summary := &analyticspb.PublishSummary{}
+	for index := int64(0); ; index++ {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// eg. message is too large or cannot be decoded
+			return err
+		}
+
+		records, e := publishGRPCBatch(stream.Context(), batch)
+		if e.ErrorCode != "" {
+			summary.Errors = append(summary.Errors, &analyticspb.BatchError{
+				BatchIndex: index,
+				ErrorCode:  e.ErrorCode,
+				Reason:     e.Reason,
+			})
+			continue
+		}
+		summary.AcceptedBatches++
+		summary.AcceptedRecords += int64(records)
+	}
+	return stream.SendAndClose(summary)
+}
+
+// Resolve tenant of the batch and check its rate limit, then validate,
+// enrich and publish its records. Returns the number of records.
+func publishGRPCBatch(ctx context.Context, batch *analyticspb.Batch) (int, errResponse) {
+	t, e := getTenantForBatch(batch.GetBundleScopeUuid(),
+		batch.GetOrganization(), batch.GetEnvironment())
+	if e.ErrorCode != "" {
+		return 0, e
+	}
+
+	var scopes []string
+	if batch.GetBundleScopeUuid() != "" {
+		scopes = append(scopes, batch.GetBundleScopeUuid())
+	}
+	orgEnv := getKeyForOrgEnvCache(t.Org, t.Env)
+	scopes = append(scopes, orgEnv)
+	if e := checkScope(ctx, scopes...); e.ErrorCode != "" {
+		return 0, e
+	}
+	// bytes of the decompressed message
+	numBytes := int64(proto.Size(batch))
+	allowed, _, exceeded := checkRateLimits(scopes, int64(len(batch.GetRecords())), numBytes)
+	if !allowed {
+		return 0, errResponse{
+			ErrorCode: "RATE_LIMITED",
+			Reason:    "Rate limit exceeded for tenant: " + exceeded}
+	}
+
+	records, err := getRecordsFromProto(batch)
+	if err != nil {
+		return 0, errResponse{
+			ErrorCode: "BAD_DATA",
+			Reason:    "Batch cannot be decoded: " + err.Error()}
+	}
+	return len(records), validateEnrichPublish(t, map[string]interface{}{"records": records})
+}
@@ -0,0 +1,251 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apid/apidAnalytics/analyticspb"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("test gRPC ingestion service", func() {
+	// HTTP/2 client without TLS for requests which grpc clients do not send
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	// Returns grpc-status of a call with given length prefixed messages
+	publishRaw := func(headers map[string]string, messages ...[]byte) string {
+		var body bytes.Buffer
+		for _, message := range messages {
+			var prefix [5]byte
+			binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+			body.Write(prefix[:])
+			body.Write(message)
+		}
+		req, err := http.NewRequest("POST", "http://"+getGRPCAddress()+
+			"/apidanalytics.AnalyticsIngestion/Publish", &body)
+		Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := h2cClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		ioutil.ReadAll(res.Body)
+		return res.Trailer.Get("Grpc-Status")
+	}
+
+	// Returns response summary and status code of the call
+	publish := func(ctx context.Context, opts []grpc.CallOption,
+		batches ...*analyticspb.Batch) (*analyticspb.PublishSummary, codes.Code) {
+		conn, err := grpc.NewClient(getGRPCAddress(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		stream, err := analyticspb.NewAnalyticsIngestionClient(conn).Publish(ctx, opts...)
+		Expect(err).ShouldNot(HaveOccurred())
+		for _, batch := range batches {
+			if stream.Send(batch) != nil {
+				// error of the call is returned by CloseAndRecv
+				break
+			}
+		}
+		summary, err := stream.CloseAndRecv()
+		return summary, status.Code(err)
+	}
+
+	BeforeEach(func() {
+		config.Set(analyticsGRPCListenAddress, "127.0.0.1:0")
+		Expect(initGRPC()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		closeGRPC()
+		config.Set(analyticsGRPCListenAddress, "")
+		config.Set(analyticsGRPCMaxMessageSize, analyticsGRPCMaxMessageSizeDefault)
+	})
+
+	It("should accept batches for scope and org/env", func() {
+		summary, code := publish(context.Background(), nil,
+			newTestBatch("testid", "", "", newTestRecord(), newTestRecord()),
+			newTestBatch("", "testorg", "testenv", newTestRecord()))
+		Expect(code).To(Equal(codes.OK))
+		Expect(summary.AcceptedBatches).To(Equal(int64(2)))
+		Expect(summary.AcceptedRecords).To(Equal(int64(3)))
+		Expect(summary.Errors).To(BeEmpty())
+	})
+
+	It("should return errors of rejected batches", func() {
+		oldRecord := newTestRecord()
+		oldRecord.ClientReceivedStartTimestamp = 0
+		summary, code := publish(context.Background(), nil,
+			newTestBatch("wrongid", "", "", newTestRecord()),
+			newTestBatch("testid", "", "", newTestRecord()),
+			newTestBatch("", "testorg", "", newTestRecord()),
+			newTestBatch("testid", "", "", oldRecord),
+			newTestBatch("testid", "", ""))
+		Expect(code).To(Equal(codes.OK))
+		Expect(summary.AcceptedBatches).To(Equal(int64(1)))
+		Expect(summary.AcceptedRecords).To(Equal(int64(1)))
+
+		errorCodes := make(map[int64]string)
+		for _, e := range summary.Errors {
+			errorCodes[e.BatchIndex] = e.ErrorCode
+		}
+		Expect(errorCodes).To(Equal(map[int64]string{
+			0: "UNKNOWN_SCOPE",
+			2: "MISSING_FIELD",
+			3: "MISSING_FIELD",
+			4: "NO_RECORDS",
+		}))
+	})
+
+	It("should reject batches once the rate limit is exceeded", func() {
+		config.Set(analyticsRateLimitRecords, 1)
+		config.Set(analyticsRateLimitBurst, 1)
+		defer func() {
+			config.Set(analyticsRateLimitRecords, 0)
+			config.Set(analyticsRateLimitBurst, analyticsRateLimitBurstDefault)
+			rateLimitersLock.Lock()
+			rateLimiters = make(map[string]*tenantRateLimiter)
+			rateLimitCountersByKey = make(map[string]*rateLimitCounters)
+			rateLimitersLock.Unlock()
+		}()
+
+		summary, code := publish(context.Background(), nil,
+			newTestBatch("testid", "", "", newTestRecord()),
+			newTestBatch("", "testorg", "testenv", newTestRecord()))
+		Expect(code).To(Equal(codes.OK))
+		Expect(summary.AcceptedBatches).To(Equal(int64(1)))
+		Expect(summary.Errors).To(HaveLen(1))
+		Expect(summary.Errors[0].BatchIndex).To(Equal(int64(1)))
+		Expect(summary.Errors[0].ErrorCode).To(Equal("RATE_LIMITED"))
+	})
+
+	It("should accept gzip compressed messages", func() {
+		summary, code := publish(context.Background(),
+			[]grpc.CallOption{grpc.UseCompressor(gzip.Name)},
+			newTestBatch("testid", "", "", newTestRecord()))
+		Expect(code).To(Equal(codes.OK))
+		Expect(summary.AcceptedBatches).To(Equal(int64(1)))
+	})
+
+	It("should authenticate calls", func() {
+		config.Set(analyticsAuthMethods, "bearer")
+		config.Set(analyticsAuthBearerToken, "secrettoken")
+		defer func() {
+			config.Set(analyticsAuthMethods, "")
+			config.Set(analyticsAuthBearerToken, "")
+		}()
+
+		_, code := publish(context.Background(), nil,
+			newTestBatch("testid", "", "", newTestRecord()))
+		Expect(code).To(Equal(codes.Unauthenticated))
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(),
+			"authorization", "Bearer secrettoken")
+		summary, code := publish(ctx, nil, newTestBatch("testid", "", "", newTestRecord()))
+		Expect(code).To(Equal(codes.OK))
+		Expect(summary.AcceptedBatches).To(Equal(int64(1)))
+	})
+
+	It("should authorize batches for the scopes of the caller", func() {
+		identity := &authIdentity{Name: "gateway1", Scopes: map[string]bool{"otherid": true}}
+		ctx := context.WithValue(context.Background(), authContextKey{}, identity)
+		_, e := publishGRPCBatch(ctx, newTestBatch("testid", "", "", newTestRecord()))
+		Expect(e.ErrorCode).To(Equal("FORBIDDEN"))
+
+		identity.Scopes["testid"] = true
+		n, e := publishGRPCBatch(ctx, newTestBatch("testid", "", "", newTestRecord()))
+		Expect(e.ErrorCode).To(BeEmpty())
+		Expect(n).To(Equal(1))
+	})
+
+	It("should fail the call for messages larger than allowed", func() {
+		closeGRPC()
+		config.Set(analyticsGRPCMaxMessageSize, 10)
+		Expect(initGRPC()).To(Succeed())
+		_, code := publish(context.Background(), nil,
+			newTestBatch("testid", "", "", newTestRecord()))
+		Expect(code).To(Equal(codes.ResourceExhausted))
+	})
+
+	It("should fail the call for messages which cannot be decoded", func() {
+		// records field with a length beyond the end of the message
+		Expect(publishRaw(nil, []byte{0x22, 0x05})).To(Equal(
+			strconv.Itoa(int(codes.Internal))))
+	})
+
+	It("should fail the call for unsupported encoding", func() {
+		Expect(publishRaw(map[string]string{"Grpc-Encoding": "snappy"}, []byte{})).To(Equal(
+			strconv.Itoa(int(codes.Unimplemented))))
+	})
+
+	It("should fail the call if DB is not initialized", func() {
+		db := getDB()
+		setDB(nil)
+		defer setDB(db)
+		_, code := publish(context.Background(), nil,
+			newTestBatch("testid", "", "", newTestRecord()))
+		Expect(code).To(Equal(codes.Unavailable))
+	})
+
+	It("should reject requests which are not gRPC", func() {
+		req, err := http.NewRequest("POST", "http://"+getGRPCAddress()+
+			"/apidanalytics.AnalyticsIngestion/Publish", bytes.NewReader([]byte("{}")))
+		Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/json")
+		res, err := h2cClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusUnsupportedMediaType))
+	})
+
+	It("should not start if listen address is not configured", func() {
+		closeGRPC()
+		config.Set(analyticsGRPCListenAddress, "")
+		Expect(initGRPC()).To(Succeed())
+		Expect(getGRPCAddress()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,198 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Gateways retry a batch if the request times out while the records are
+still waiting to be published to the internal buffer. If a batch has an
+Idempotency-Key (or X-Batch-Id) header, then the outcome of the first
+request is remembered per tenant for the configured window and returned
+for duplicates without publishing the records again. A duplicate received
+while the first request is in progress waits for its outcome.
+*/
+
+const maxIdempotencyKeyLength = 256
+
+// Recently seen keys of each tenant
+var idempotencyStores = make(map[string]*idempotencyStore)
+
+var idempotencyStoresLock = sync.Mutex{}
+
+type idempotencyStore struct {
+	entries map[string]*list.Element
+	// keys in the order they were seen, oldest first
+	order *list.List
+}
+
+type idempotencyEntry struct {
+	key     string
+	expiry  time.Time
+	done    chan struct{}
+	outcome errResponse
+	// false while the first request is in progress
+	completed bool
+}
+
+// Tracks the outcome of a request which is the first with its key.
+// Methods are no-op if the request has no key.
+type idempotentRequest struct {
+	tenant string
+	entry  *idempotencyEntry
+}
+
+func getIdempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.Header.Get("X-Batch-Id")
+}
+
+/*
+Returns true if the request is a duplicate and the outcome of the first
+request has been written as the response. Otherwise the request should be
+processed and completed or abandoned using the returned idempotentRequest.
+*/
+func beginIdempotentRequest(w http.ResponseWriter, r *http.Request,
+	tenant string) (*idempotentRequest, bool) {
+	key := getIdempotencyKey(r)
+	window := config.GetDuration(analyticsIdempotencyWindow)
+	if key == "" || window <= 0 {
+		return &idempotentRequest{}, false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, http.StatusBadRequest, "BAD_DATA",
+			"Idempotency key should not be longer than 256 characters")
+		return nil, true
+	}
+
+	for {
+		idempotencyStoresLock.Lock()
+		store := getIdempotencyStore(tenant)
+		store.removeExpired(time.Now())
+		element, exists := store.entries[key]
+		if !exists {
+			entry := &idempotencyEntry{key: key, done: make(chan struct{})}
+			store.add(entry)
+			idempotencyStoresLock.Unlock()
+			return &idempotentRequest{tenant: tenant, entry: entry}, false
+		}
+		entry := element.Value.(*idempotencyEntry)
+		if entry.completed {
+			outcome := entry.outcome
+			idempotencyStoresLock.Unlock()
+			log.Debugf("Duplicate batch with key '%s' for tenant %s",
+				key, tenant)
+			writeIdempotentOutcome(w, outcome)
+			return nil, true
+		}
+		done := entry.done
+		idempotencyStoresLock.Unlock()
+
+		// wait for first request and check again since it
+		// might have been abandoned instead of completed
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return nil, true
+		}
+	}
+}
+
+func writeIdempotentOutcome(w http.ResponseWriter, outcome errResponse) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	if outcome.ErrorCode == "" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		writeError(w, http.StatusBadRequest, outcome.ErrorCode, outcome.Reason)
+	}
+}
+
+// Remember outcome of the request for duplicates
+func (i *idempotentRequest) complete(outcome errResponse) {
+	if i.entry == nil {
+		return
+	}
+	idempotencyStoresLock.Lock()
+	defer idempotencyStoresLock.Unlock()
+	i.entry.outcome = outcome
+	i.entry.completed = true
+	i.entry.expiry = time.Now().Add(time.Second *
+		config.GetDuration(analyticsIdempotencyWindow))
+	close(i.entry.done)
+	i.entry = nil
+}
+
+// Forget the key if request was not completed eg. it was rate limited,
+// so that a duplicate is processed again
+func (i *idempotentRequest) abandon() {
+	if i.entry == nil {
+		return
+	}
+	idempotencyStoresLock.Lock()
+	defer idempotencyStoresLock.Unlock()
+	store := getIdempotencyStore(i.tenant)
+	if element, exists := store.entries[i.entry.key]; exists &&
+		element.Value == i.entry {
+		store.remove(element)
+	}
+	close(i.entry.done)
+	i.entry = nil
+}
+
+// Should be called with idempotencyStoresLock held
+func getIdempotencyStore(tenant string) *idempotencyStore {
+	store, exists := idempotencyStores[tenant]
+	if !exists {
+		store = &idempotencyStore{
+			entries: make(map[string]*list.Element),
+			order:   list.New(),
+		}
+		idempotencyStores[tenant] = store
+	}
+	return store
+}
+
+// Oldest keys are evicted once the store is full
+func (s *idempotencyStore) add(entry *idempotencyEntry) {
+	maxKeys := config.GetInt(analyticsIdempotencyMaxKeys)
+	for s.order.Len() > 0 && s.order.Len() >= maxKeys {
+		s.remove(s.order.Front())
+	}
+	s.entries[entry.key] = s.order.PushBack(entry)
+}
+
+func (s *idempotencyStore) remove(element *list.Element) {
+	delete(s.entries, element.Value.(*idempotencyEntry).key)
+	s.order.Remove(element)
+}
+
+// Keys expire in the order they were seen. A request in progress at
+// the front delays expiry of later keys till it completes.
+func (s *idempotencyStore) removeExpired(now time.Time) {
+	for s.order.Len() > 0 {
+		entry := s.order.Front().Value.(*idempotencyEntry)
+		if !entry.completed || now.Before(entry.expiry) {
+			return
+		}
+		s.remove(s.order.Front())
+	}
+}
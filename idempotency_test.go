@@ -0,0 +1,152 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test batch idempotency keys", func() {
+	now := time.Now().Unix() * 1000
+	validPayload := []byte(`{
+			"records":[{
+				"response_status_code": 200,
+				"client_id":"testapikey",
+				"client_received_start_timestamp":` + fmt.Sprintf("%v", now) + `,
+				"client_received_end_timestamp":` + fmt.Sprintf("%v", now+60000) + `
+			}]
+		}`)
+	invalidPayload := []byte(`{
+			"records":[{
+				"response_status_code": 200,
+				"client_id":"testapikey"
+			}]
+		}`)
+
+	Context("API", func() {
+		It("should return outcome of first request for duplicates", func() {
+			By("first request")
+			req := getRequestWithScope("testid", validPayload)
+			req.Header.Set("Idempotency-Key", "batch-1")
+			res, _ := makeRequest(req)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Idempotent-Replayed")).To(BeEmpty())
+
+			By("duplicate is not validated or published again")
+			req = getRequestWithScope("testid", invalidPayload)
+			req.Header.Set("Idempotency-Key", "batch-1")
+			res, _ = makeRequest(req)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Idempotent-Replayed")).To(Equal("true"))
+
+			By("same key is independent for another batch id header")
+			req = getRequestWithScope("testid", invalidPayload)
+			req.Header.Set("X-Batch-Id", "batch-2")
+			res, e := makeRequest(req)
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(e.ErrorCode).To(Equal("MISSING_FIELD"))
+
+			req = getRequestWithScope("testid", validPayload)
+			req.Header.Set("X-Batch-Id", "batch-2")
+			res, e = makeRequest(req)
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(e.ErrorCode).To(Equal("MISSING_FIELD"))
+			Expect(res.Header.Get("Idempotent-Replayed")).To(Equal("true"))
+		})
+	})
+
+	Context("store", func() {
+		newRequest := func(key string) *http.Request {
+			req := httptest.NewRequest("POST", "/analytics", nil)
+			req.Header.Set("Idempotency-Key", key)
+			return req
+		}
+
+		It("should forget abandoned requests", func() {
+			w := httptest.NewRecorder()
+			i, duplicate := beginIdempotentRequest(w, newRequest("k1"), "store~abandon")
+			Expect(duplicate).To(BeFalse())
+			i.abandon()
+
+			i, duplicate = beginIdempotentRequest(w, newRequest("k1"), "store~abandon")
+			Expect(duplicate).To(BeFalse())
+			i.complete(errResponse{})
+		})
+
+		It("should make duplicate wait for request in progress", func() {
+			i, duplicate := beginIdempotentRequest(httptest.NewRecorder(),
+				newRequest("k1"), "store~wait")
+			Expect(duplicate).To(BeFalse())
+
+			w := httptest.NewRecorder()
+			done := make(chan bool)
+			go func() {
+				_, d := beginIdempotentRequest(w, newRequest("k1"), "store~wait")
+				done <- d
+			}()
+			Consistently(done).ShouldNot(Receive())
+
+			i.complete(errResponse{ErrorCode: "BAD_DATA", Reason: "bad"})
+			Eventually(done).Should(Receive(BeTrue()))
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should evict oldest keys when full", func() {
+			original := config.GetInt(analyticsIdempotencyMaxKeys)
+			config.Set(analyticsIdempotencyMaxKeys, 2)
+			defer config.Set(analyticsIdempotencyMaxKeys, original)
+
+			for _, key := range []string{"k1", "k2", "k3"} {
+				i, duplicate := beginIdempotentRequest(httptest.NewRecorder(),
+					newRequest(key), "store~evict")
+				Expect(duplicate).To(BeFalse())
+				i.complete(errResponse{})
+			}
+
+			_, duplicate := beginIdempotentRequest(httptest.NewRecorder(),
+				newRequest("k3"), "store~evict")
+			Expect(duplicate).To(BeTrue())
+			i, duplicate := beginIdempotentRequest(httptest.NewRecorder(),
+				newRequest("k1"), "store~evict")
+			Expect(duplicate).To(BeFalse())
+			i.complete(errResponse{})
+		})
+
+		It("should forget keys after the window", func() {
+			original := config.GetInt(analyticsIdempotencyWindow)
+			config.Set(analyticsIdempotencyWindow, 1)
+			defer config.Set(analyticsIdempotencyWindow, original)
+
+			i, _ := beginIdempotentRequest(httptest.NewRecorder(),
+				newRequest("k1"), "store~expiry")
+			i.complete(errResponse{})
+
+			Eventually(func() bool {
+				i, duplicate := beginIdempotentRequest(httptest.NewRecorder(),
+					newRequest("k1"), "store~expiry")
+				if !duplicate {
+					i.complete(errResponse{})
+				}
+				return duplicate
+			}, "3s").Should(BeFalse())
+		})
+	})
+})
@@ -56,6 +56,203 @@ const (
 	// cache to avoid DB calls for each analytics message
 	useCaching        = "apidanalytics_use_caching"
 	useCachingDefault = false
+
+	// Maximum number of records and bytes per second accepted for
+	// each org~env or bundle scope uuid. 0 disables the limit
+	analyticsRateLimitRecords        = "apidanalytics_rate_limit_records_per_sec"
+	analyticsRateLimitRecordsDefault = 0
+	analyticsRateLimitBytes          = "apidanalytics_rate_limit_bytes_per_sec"
+	analyticsRateLimitBytesDefault   = 0
+
+	// Number of seconds worth of records/bytes that can be
+	// accepted in a burst above the configured rate
+	analyticsRateLimitBurst        = "apidanalytics_rate_limit_burst"
+	analyticsRateLimitBurstDefault = 10
+
+	// Comma separated list of authentication methods accepted for the
+	// API's exposed by this plugin i.e. bearer, hmac and clientcert.
+	// If empty then requests are not authenticated
+	analyticsAuthMethods = "apidanalytics_auth_methods"
+
+	// Shared bearer token for bearer authentication
+	analyticsAuthBearerToken = "apidanalytics_auth_bearer_token"
+
+	// Shared secret and allowed clock skew in seconds for HMAC authentication
+	analyticsAuthHMACSecret         = "apidanalytics_auth_hmac_secret"
+	analyticsAuthHMACMaxSkew        = "apidanalytics_auth_hmac_max_skew"
+	analyticsAuthHMACMaxSkewDefault = 300
+
+	// JSON file mapping client certificate common name to
+	// allowed scopes (org~env, bundle scope uuid or *)
+	analyticsAuthClientCertScopes = "apidanalytics_auth_client_cert_scopes"
+
+	// Maximum size in bytes of a request body, bodies are
+	// read before authentication to verify HMAC signatures
+	analyticsMaxPayloadSize        = "apidanalytics_max_payload_size"
+	analyticsMaxPayloadSizeDefault = 10 * 1024 * 1024
+
+	// If UAP collection endpoint supports it, then signed URL's for
+	// all files in a directory are requested in a single call
+	analyticsSignedUrlBatch        = "apidanalytics_signed_url_batch"
+	analyticsSignedUrlBatchDefault = false
+
+	// Seconds for which a signed URL is cached if
+	// UAP collection endpoint does not return its expiry
+	analyticsSignedUrlTTL        = "apidanalytics_signed_url_ttl"
+	analyticsSignedUrlTTLDefault = 300
+
+	// Files bigger than threshold (bytes) are uploaded in parts of
+	// part size (bytes) if UAP collection endpoint supports it. 0 disables it
+	analyticsMultipartThreshold        = "apidanalytics_multipart_threshold"
+	analyticsMultipartThresholdDefault = 32 * 1024 * 1024
+	analyticsMultipartPartSize         = "apidanalytics_multipart_part_size"
+	analyticsMultipartPartSizeDefault  = 8 * 1024 * 1024
+
+	// Send checksum of each upload to S3/GCS and verify
+	// it against the hash returned by the datastore
+	analyticsUploadChecksum        = "apidanalytics_upload_checksum"
+	analyticsUploadChecksumDefault = true
+
+	// File containing base64 encoded 32 byte AES key. If set, buffered
+	// analytics files are encrypted at rest
+	analyticsEncryptionKeyFile = "apidanalytics_encryption_key_file"
+
+	// Upload manifest of each directory after its data files
+	analyticsUploadManifest        = "apidanalytics_upload_manifest"
+	analyticsUploadManifestDefault = false
+
+	// Record outcome of each upload in a persistent ledger so that
+	// files are not uploaded again after a restart. Entries are
+	// kept for the configured number of days
+	analyticsUploadLedger                 = "apidanalytics_upload_ledger"
+	analyticsUploadLedgerDefault          = true
+	analyticsUploadLedgerRetention        = "apidanalytics_upload_ledger_retention_days"
+	analyticsUploadLedgerRetentionDefault = 7
+
+	// Window in seconds for which outcome of a batch with an idempotency
+	// key is remembered, 0 disables it. Max keys remembered per tenant
+	analyticsIdempotencyWindow         = "apidanalytics_idempotency_window"
+	analyticsIdempotencyWindowDefault  = 600
+	analyticsIdempotencyMaxKeys        = "apidanalytics_idempotency_max_keys"
+	analyticsIdempotencyMaxKeysDefault = 10000
+
+	// Fraction of records kept, globally and for specific
+	// org~env or org~env~apiproxy eg. "org~env=0.5,org~env~proxy=0.1".
+	// Records are sampled deterministically on the key field if set
+	analyticsSampleRate        = "apidanalytics_sample_rate"
+	analyticsSampleRateDefault = 1.0
+	analyticsSampleRates       = "apidanalytics_sample_rates"
+	analyticsSampleKey         = "apidanalytics_sample_key"
+
+	// Write per minute rollups of each directory which are uploaded
+	// under the path prefix instead of the raw records partition
+	analyticsRollups                 = "apidanalytics_rollups"
+	analyticsRollupsDefault          = false
+	analyticsRollupPathPrefix        = "apidanalytics_rollup_path_prefix"
+	analyticsRollupPathPrefixDefault = "rollups"
+
+	// Window in seconds for which records are kept in memory for the
+	// local query API, 0 disables it. Oldest records are dropped once
+	// max records are kept. Disabled by default since records are added
+	// to the store while the buffering manager holds its write lock
+	analyticsQueryWindow            = "apidanalytics_query_window"
+	analyticsQueryWindowDefault     = 0
+	analyticsQueryMaxRecords        = "apidanalytics_query_max_records"
+	analyticsQueryMaxRecordsDefault = 100000
+
+	// Records buffered per tail subscriber before they are
+	// dropped and max number of connected tail subscribers
+	analyticsTailBufferSize            = "apidanalytics_tail_buffer_size"
+	analyticsTailBufferSizeDefault     = 100
+	analyticsTailMaxSubscribers        = "apidanalytics_tail_max_subscribers"
+	analyticsTailMaxSubscribersDefault = 10
+
+	// Comma separated list of latencies derived from record timestamps
+	// during enrichment eg. total_response_time,target_response_time,
+	// request_processing_latency,response_processing_latency.
+	// Disabled by default so that records are unchanged
+	analyticsDerivedFields        = "apidanalytics_derived_fields"
+	analyticsDerivedFieldsDefault = ""
+
+	// If true, records with client_* and target_* timestamps
+	// which are not in order are rejected during validation
+	analyticsValidateTimestampOrder        = "apidanalytics_validate_timestamp_order"
+	analyticsValidateTimestampOrderDefault = false
+
+	// MaxMind DB files (eg. GeoIP2 City and ASN) used to add location of
+	// the first public IP in the comma separated list of record fields
+	analyticsGeoIPDBFile           = "apidanalytics_geoip_db_file"
+	analyticsGeoIPASNDBFile        = "apidanalytics_geoip_asn_db_file"
+	analyticsGeoIPFields           = "apidanalytics_geoip_fields"
+	analyticsGeoIPFieldsDefault    = "client_ip,x_forwarded_for_ip"
+	analyticsGeoIPCacheSize        = "apidanalytics_geoip_cache_size"
+	analyticsGeoIPCacheSizeDefault = 10000
+
+	// Parse useragent field of records using embedded rules
+	// or rules from the file if configured
+	analyticsUserAgentParsing          = "apidanalytics_useragent_parsing"
+	analyticsUserAgentParsingDefault   = false
+	analyticsUserAgentRulesFile        = "apidanalytics_useragent_rules_file"
+	analyticsUserAgentCacheSize        = "apidanalytics_useragent_cache_size"
+	analyticsUserAgentCacheSizeDefault = 10000
+
+	// Seconds by which client_received_start_timestamp can be ahead of
+	// apid clock and days after which records are rejected as too old.
+	// Timestamps sent as ISO-8601 or epoch seconds/microseconds are
+	// converted to epoch milliseconds if normalization is enabled
+	analyticsMaxClockSkew               = "apidanalytics_max_clock_skew"
+	analyticsMaxClockSkewDefault        = 0
+	analyticsMaxRecordAge               = "apidanalytics_max_record_age_days"
+	analyticsMaxRecordAgeDefault        = 90
+	analyticsNormalizeTimestamps        = "apidanalytics_normalize_timestamps"
+	analyticsNormalizeTimestampsDefault = false
+
+	// Comma separated names of destinations to which staged files are
+	// delivered in addition to UAP. Each destination is configured with
+	// keys starting with apidanalytics_destination_<name>_
+	analyticsDestinations      = "apidanalytics_destinations"
+	analyticsDestinationPrefix = "apidanalytics_destination_"
+
+	// Max seconds spent delivering to other destinations in one
+	// upload pass so that they do not hold up uploads to UAP
+	analyticsDestinationTimeout        = "apidanalytics_destination_timeout"
+	analyticsDestinationTimeoutDefault = 60
+
+	// Comma separated host:port of Kafka brokers to which saved records
+	// are published, empty disables it. Acks is -1 (all in-sync
+	// replicas), 0 (none) or 1 (leader)
+	analyticsKafkaBrokers          = "apidanalytics_kafka_brokers"
+	analyticsKafkaTopic            = "apidanalytics_kafka_topic"
+	analyticsKafkaTopicDefault     = "apid-analytics"
+	analyticsKafkaAcks             = "apidanalytics_kafka_acks"
+	analyticsKafkaAcksDefault      = 1
+	analyticsKafkaBatchSize        = "apidanalytics_kafka_batch_size"
+	analyticsKafkaBatchSizeDefault = 500
+	analyticsKafkaLingerMs         = "apidanalytics_kafka_linger_ms"
+	analyticsKafkaLingerMsDefault  = 1000
+	analyticsKafkaRetries          = "apidanalytics_kafka_retries"
+	analyticsKafkaRetriesDefault   = 3
+	analyticsKafkaTimeout          = "apidanalytics_kafka_timeout"
+	analyticsKafkaTimeoutDefault   = 10
+	analyticsKafkaQueueSize        = "apidanalytics_kafka_queue_size"
+	analyticsKafkaQueueSizeDefault = 10000
+
+	// host:port on which the gRPC ingestion service listens, empty
+	// disables it. TLS is used if certificate and key are configured,
+	// otherwise HTTP/2 without TLS (h2c)
+	analyticsGRPCListenAddress         = "apidanalytics_grpc_listen_address"
+	analyticsGRPCTLSCertFile           = "apidanalytics_grpc_tls_cert_file"
+	analyticsGRPCTLSKeyFile            = "apidanalytics_grpc_tls_key_file"
+	analyticsGRPCTLSClientCAFile       = "apidanalytics_grpc_tls_client_ca_file"
+	analyticsGRPCMaxMessageSize        = "apidanalytics_grpc_max_message_size"
+	analyticsGRPCMaxMessageSizeDefault = 4 * 1024 * 1024 // in bytes
+)
+
+// Permissions for local directories and files since they contain
+// analytics data which should only be readable by apid
+const (
+	dirPermissions  os.FileMode = 0700
+	filePermissions os.FileMode = 0600
 )
 
 // keep track of the services that this plugin will use
@@ -73,6 +270,7 @@ var (
 	localAnalyticsStagingDir   string
 	localAnalyticsFailedDir    string
 	localAnalyticsRecoveredDir string
+	localAnalyticsKafkaDir     string
 )
 
 // apid.RegisterPlugin() is required to be called in init()
@@ -129,6 +327,54 @@ func initPlugin(services apid.Services) (apid.PluginData, error) {
 			"required local directories: %v ", err)
 	}
 
+	err = initAuth()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initEncryption()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initSampling()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initDerivedFields()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initGeoIP()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initUserAgent()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initDestinations()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initKafka()
+	if err != nil {
+		return pluginData, err
+	}
+
+	err = initGRPC()
+	if err != nil {
+		return pluginData, err
+	}
+
+	// Initialize upload ledger before any upload is attempted
+	initUploadLedger()
+
 	// Initialize one time crash recovery to be performed by the plugin on start up
 	initCrashRecovery()
 
@@ -140,6 +386,10 @@ func initPlugin(services apid.Services) (apid.PluginData, error) {
 	// for new messages and dump them to files
 	initBufferingManager()
 
+	// Listen for records published by other plugins once
+	// the internal buffer is ready to accept them
+	events.Listen(PublishEventSelector, &publishHandler{})
+
 	// Create a listener for shutdown event and register callback
 	h := func(event apid.Event) {
 		log.Infof("Received ApidShutdown event. %v", event)
@@ -173,6 +423,7 @@ func setConfig(services apid.Services) error {
 	localAnalyticsStagingDir = filepath.Join(localAnalyticsBaseDir, "staging")
 	localAnalyticsFailedDir = filepath.Join(localAnalyticsBaseDir, "failed")
 	localAnalyticsRecoveredDir = filepath.Join(localAnalyticsBaseDir, "recovered")
+	localAnalyticsKafkaDir = filepath.Join(localAnalyticsBaseDir, "kafka")
 
 	// set default config for collection interval
 	config.SetDefault(analyticsCollectionInterval, analyticsCollectionIntervalDefault)
@@ -186,6 +437,96 @@ func setConfig(services apid.Services) error {
 	// set default config for internal buffer size
 	config.SetDefault(analyticsBufferChannelSize, analyticsBufferChannelSizeDefault)
 
+	// set default config for rate limiting
+	config.SetDefault(analyticsRateLimitRecords, analyticsRateLimitRecordsDefault)
+	config.SetDefault(analyticsRateLimitBytes, analyticsRateLimitBytesDefault)
+	config.SetDefault(analyticsRateLimitBurst, analyticsRateLimitBurstDefault)
+
+	// set default config for authentication
+	config.SetDefault(analyticsAuthHMACMaxSkew, analyticsAuthHMACMaxSkewDefault)
+	config.SetDefault(analyticsMaxPayloadSize, analyticsMaxPayloadSizeDefault)
+
+	// set default config for signed URL's
+	config.SetDefault(analyticsSignedUrlBatch, analyticsSignedUrlBatchDefault)
+	config.SetDefault(analyticsSignedUrlTTL, analyticsSignedUrlTTLDefault)
+
+	// set default config for multipart uploads
+	config.SetDefault(analyticsMultipartThreshold, analyticsMultipartThresholdDefault)
+	config.SetDefault(analyticsMultipartPartSize, analyticsMultipartPartSizeDefault)
+
+	// set default config for upload checksum
+	config.SetDefault(analyticsUploadChecksum, analyticsUploadChecksumDefault)
+
+	// set default config for encryption key file
+	config.SetDefault(analyticsEncryptionKeyFile, "")
+
+	// set default config for manifest upload
+	config.SetDefault(analyticsUploadManifest, analyticsUploadManifestDefault)
+
+	// set default config for upload ledger
+	config.SetDefault(analyticsUploadLedger, analyticsUploadLedgerDefault)
+	config.SetDefault(analyticsUploadLedgerRetention,
+		analyticsUploadLedgerRetentionDefault)
+
+	// set default config for batch idempotency keys
+	config.SetDefault(analyticsIdempotencyWindow, analyticsIdempotencyWindowDefault)
+	config.SetDefault(analyticsIdempotencyMaxKeys, analyticsIdempotencyMaxKeysDefault)
+
+	// set default config for record sampling
+	config.SetDefault(analyticsSampleRate, analyticsSampleRateDefault)
+	config.SetDefault(analyticsSampleRates, "")
+	config.SetDefault(analyticsSampleKey, "")
+
+	// set default config for rollups
+	config.SetDefault(analyticsRollups, analyticsRollupsDefault)
+	config.SetDefault(analyticsRollupPathPrefix, analyticsRollupPathPrefixDefault)
+
+	// set default config for local query API
+	config.SetDefault(analyticsQueryWindow, analyticsQueryWindowDefault)
+	config.SetDefault(analyticsQueryMaxRecords, analyticsQueryMaxRecordsDefault)
+
+	// set default config for live tail
+	config.SetDefault(analyticsTailBufferSize, analyticsTailBufferSizeDefault)
+	config.SetDefault(analyticsTailMaxSubscribers, analyticsTailMaxSubscribersDefault)
+
+	// set default config for derived fields
+	config.SetDefault(analyticsDerivedFields, analyticsDerivedFieldsDefault)
+	config.SetDefault(analyticsValidateTimestampOrder, analyticsValidateTimestampOrderDefault)
+
+	// set default config for GeoIP enrichment
+	config.SetDefault(analyticsGeoIPDBFile, "")
+	config.SetDefault(analyticsGeoIPASNDBFile, "")
+	config.SetDefault(analyticsGeoIPFields, analyticsGeoIPFieldsDefault)
+	config.SetDefault(analyticsGeoIPCacheSize, analyticsGeoIPCacheSizeDefault)
+
+	// set default config for user agent parsing
+	config.SetDefault(analyticsUserAgentParsing, analyticsUserAgentParsingDefault)
+	config.SetDefault(analyticsUserAgentRulesFile, "")
+	config.SetDefault(analyticsUserAgentCacheSize, analyticsUserAgentCacheSizeDefault)
+
+	// set default config for timestamp validation
+	config.SetDefault(analyticsMaxClockSkew, analyticsMaxClockSkewDefault)
+	config.SetDefault(analyticsMaxRecordAge, analyticsMaxRecordAgeDefault)
+	config.SetDefault(analyticsNormalizeTimestamps, analyticsNormalizeTimestampsDefault)
+
+	// set default config for additional destinations
+	config.SetDefault(analyticsDestinations, "")
+	config.SetDefault(analyticsDestinationTimeout, analyticsDestinationTimeoutDefault)
+
+	// set default config for Kafka producer
+	config.SetDefault(analyticsKafkaBrokers, "")
+	config.SetDefault(analyticsKafkaTopic, analyticsKafkaTopicDefault)
+	config.SetDefault(analyticsKafkaAcks, analyticsKafkaAcksDefault)
+	config.SetDefault(analyticsKafkaBatchSize, analyticsKafkaBatchSizeDefault)
+	config.SetDefault(analyticsKafkaLingerMs, analyticsKafkaLingerMsDefault)
+	config.SetDefault(analyticsKafkaRetries, analyticsKafkaRetriesDefault)
+	config.SetDefault(analyticsKafkaTimeout, analyticsKafkaTimeoutDefault)
+	config.SetDefault(analyticsKafkaQueueSize, analyticsKafkaQueueSizeDefault)
+
+	// set default config for gRPC ingestion service, disabled by default
+	config.SetDefault(analyticsGRPCListenAddress, "")
+	config.SetDefault(analyticsGRPCMaxMessageSize, analyticsGRPCMaxMessageSizeDefault)
+
 	client = &http.Client{
 		Transport: util.Transport(config.GetString(util.ConfigfwdProxyPortURL)),
 		//set default timeout of 60 seconds while connecting to s3/GCS
@@ -198,12 +539,17 @@ func setConfig(services apid.Services) error {
 func createDirectories(directories []string) error {
 	for _, path := range directories {
 		if _, err := os.Stat(path); os.IsNotExist(err) {
-			error := os.Mkdir(path, os.ModePerm)
+			error := os.Mkdir(path, dirPermissions)
 			if error != nil {
 				return error
 			}
 			log.Infof("created directory for analytics "+
 				"data collection: %s", path)
+		} else if err == nil {
+			// restrict directories created by older versions
+			if error := os.Chmod(path, dirPermissions); error != nil {
+				return error
+			}
 		}
 	}
 	return nil
@@ -212,8 +558,13 @@ func createDirectories(directories []string) error {
 func shutdownPlugin() {
 	log.Info("Shutting down apidAnalytics plugin")
 
+	// stop accepting records over gRPC before closing the internal buffer
+	closeGRPC()
+
 	// close channel so new records cannot be inserted
+	internalBufferLock.Lock()
 	close(internalBuffer)
+	internalBufferLock.Unlock()
 	log.Debugf("sent signal to close internal buffer channel")
 
 	// close channel so new events for closing bucket cannot be posted
@@ -232,13 +583,12 @@ func shutdownPlugin() {
 	bucketMaplock.RLock()
 	for _, bucket := range bucketMap {
 		log.Infof("closing bucket '%s' as a part of shutdown", bucket.DirName)
-		closeGzipFile(bucket.FileWriter)
-
-		dirToBeClosed := filepath.Join(localAnalyticsTempDir, bucket.DirName)
-		stagingPath := filepath.Join(localAnalyticsStagingDir, bucket.DirName)
+		if bucket.closeTimer != nil {
+			bucket.closeTimer.Stop()
+		}
 		// close files in tmp folder and move directory to
 		// staging to indicate its ready for upload
-		err := os.Rename(dirToBeClosed, stagingPath)
+		err := closeBucket(bucket)
 		if err != nil {
 			log.Errorf("Cannot move directory '%s' from"+
 				" tmp to staging folder due to '%s", bucket.DirName, err)
@@ -250,4 +600,7 @@ func shutdownPlugin() {
 	bucketMaplock.Lock()
 	bucketMap = nil
 	bucketMaplock.Unlock()
+
+	// Flush records queued for Kafka, they are spooled if it is unreachable
+	closeKafka()
 }
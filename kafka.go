@@ -0,0 +1,399 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+/*
+If Kafka brokers are configured, records saved by the buffering manager are
+also published to a Kafka topic so that they are available in real time
+instead of after the upload interval. Each record is a message keyed by
+org~env which is hashed to a partition so that records of a tenant stay in
+order. Messages are batched by size and linger time and produced with
+kafka-go, which retries failed writes. Messages which still cannot be
+produced, or which do not fit in the producer queue, are appended to a
+spool file which is rotated every replay interval, and produced again once
+the broker is reachable. Delivery is at least once.
+*/
+
+const (
+	kafkaSpoolFileSuffix = ".json.gz"
+
+	// Spool files which cannot be read completely (eg. encrypted with a key
+	// which is no longer configured or truncated) are renamed with this
+	// suffix after the records which could be read are produced, so that
+	// they are kept for recovery but not replayed again
+	kafkaBadSpoolFileSuffix = ".bad"
+
+	// Interval at which the spool file is rotated and
+	// spooled messages are produced again
+	kafkaSpoolReplayInterval = 30 * time.Second
+
+	// Batches are assembled by the producer before they are written,
+	// so partitions of a batch are flushed by the writer right away
+	kafkaWriterBatchTimeout = 10 * time.Millisecond
+
+	kafkaClientID = "apidAnalytics"
+)
+
+type kafkaMessage struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	// epoch milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Implemented by *kafka.Writer
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Replaced by tests to produce without a broker
+var newKafkaWriter = func(c kafka.WriterConfig) kafkaWriter {
+	return kafka.NewWriter(c)
+}
+
+type kafkaProducer struct {
+	writer    kafkaWriter
+	batchSize int
+	linger    time.Duration
+	// max time to write a batch including retries
+	timeout time.Duration
+}
+
+// nil if Kafka is not configured
+var kafkaQueue chan kafkaMessage
+
+// closed once the producer has flushed queued messages
+var kafkaDone chan bool
+
+var kafkaQueueLock = sync.RWMutex{}
+
+// Spool file which messages are appended to till it is rotated.
+// Path is empty if no messages were spooled since the last rotation
+var kafkaSpool struct {
+	sync.Mutex
+	fw   fileWriter
+	path string
+}
+
+func initKafka() error {
+	var brokers []string
+	for _, b := range strings.Split(config.GetString(analyticsKafkaBrokers), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil
+	}
+
+	acks := config.GetInt(analyticsKafkaAcks)
+	if acks != -1 && acks != 0 && acks != 1 {
+		return fmt.Errorf("Invalid %s '%d', should be -1, 0 or 1",
+			analyticsKafkaAcks, acks)
+	}
+	if err := createDirectories([]string{localAnalyticsKafkaDir}); err != nil {
+		return fmt.Errorf("Cannot create Kafka spool directory: %v", err)
+	}
+	recoverIncompleteSpoolFiles()
+
+	topic := config.GetString(analyticsKafkaTopic)
+	timeout := time.Duration(config.GetInt(analyticsKafkaTimeout)) * time.Second
+	retries := config.GetInt(analyticsKafkaRetries)
+	p := &kafkaProducer{
+		batchSize: config.GetInt(analyticsKafkaBatchSize),
+		linger:    time.Duration(config.GetInt(analyticsKafkaLingerMs)) * time.Millisecond,
+		// each attempt can take the timeout to dial and to write
+		timeout: 2 * timeout * time.Duration(retries+1),
+	}
+	if p.batchSize <= 0 || p.linger <= 0 {
+		return fmt.Errorf("Kafka batch size and linger should be positive")
+	}
+	if retries < 0 {
+		return fmt.Errorf("%s should not be negative", analyticsKafkaRetries)
+	}
+	p.writer = newKafkaWriter(kafka.WriterConfig{
+		Brokers:      brokers,
+		Topic:        topic,
+		Dialer:       &kafka.Dialer{ClientID: kafkaClientID, Timeout: timeout},
+		Balancer:     &kafka.Hash{},
+		MaxAttempts:  retries + 1,
+		BatchSize:    p.batchSize,
+		BatchTimeout: kafkaWriterBatchTimeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		RequiredAcks: acks,
+	})
+
+	queue := make(chan kafkaMessage, config.GetInt(analyticsKafkaQueueSize))
+	done := make(chan bool)
+	kafkaQueueLock.Lock()
+	kafkaQueue, kafkaDone = queue, done
+	kafkaQueueLock.Unlock()
+
+	go p.run(queue, done)
+	log.Infof("Publishing records to Kafka topic '%s'", topic)
+	return nil
+}
+
+// Flush queued messages and stop the producer
+func closeKafka() {
+	kafkaQueueLock.Lock()
+	queue, done := kafkaQueue, kafkaDone
+	kafkaQueue = nil
+	kafkaQueueLock.Unlock()
+	if queue == nil {
+		return
+	}
+	close(queue)
+	<-done
+	rotateKafkaSpool()
+	log.Debugf("closed Kafka producer successfully")
+}
+
+// Queue records to be produced without blocking the buffering manager
+func publishToKafka(tenant tenant, records []interface{}) {
+	kafkaQueueLock.RLock()
+	defer kafkaQueueLock.RUnlock()
+	if kafkaQueue == nil {
+		return
+	}
+
+	key := tenant.Org + "~" + tenant.Env
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var overflow []kafkaMessage
+	for _, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			log.Errorf("Cannot publish record to Kafka: %v", err)
+			continue
+		}
+		m := kafkaMessage{Key: key, Value: value, Timestamp: now}
+		if r, ok := record.(map[string]interface{}); ok {
+			if ts, ok := getInt64Field(r, "client_received_start_timestamp"); ok {
+				m.Timestamp = ts
+			}
+		}
+		select {
+		case kafkaQueue <- m:
+		default:
+			overflow = append(overflow, m)
+		}
+	}
+	if len(overflow) > 0 {
+		log.Warnf("Kafka producer queue is full, spooling %d records", len(overflow))
+		spoolKafkaMessages(overflow)
+	}
+}
+
+func (p *kafkaProducer) run(queue chan kafkaMessage, done chan bool) {
+	defer close(done)
+	defer p.writer.Close()
+	ticker := time.NewTicker(p.linger)
+	defer ticker.Stop()
+
+	var batch []kafkaMessage
+	lastReplay := time.Now()
+	for {
+		select {
+		case m, ok := <-queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) < p.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		produced := p.flush(batch)
+		batch = nil
+		if time.Since(lastReplay) >= kafkaSpoolReplayInterval {
+			rotateKafkaSpool()
+			// spooled messages are produced again only if the broker is reachable
+			if produced {
+				p.replaySpool()
+			}
+			lastReplay = time.Now()
+		}
+	}
+}
+
+// Produce and spool the batch if it could not be produced.
+// Returns false if messages were spooled.
+func (p *kafkaProducer) flush(batch []kafkaMessage) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	if err := p.produce(batch); err != nil {
+		// messages of a failed write might have been produced partly,
+		// so all of them are spooled
+		log.Errorf("Cannot publish %d records to Kafka, spooling them: %v",
+			len(batch), err)
+		spoolKafkaMessages(batch)
+		return false
+	}
+	return true
+}
+
+func (p *kafkaProducer) produce(messages []kafkaMessage) error {
+	msgs := make([]kafka.Message, len(messages))
+	for i, m := range messages {
+		msgs[i] = kafka.Message{
+			Key:   []byte(m.Key),
+			Value: m.Value,
+			Time:  time.Unix(0, m.Timestamp*int64(time.Millisecond)),
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	return p.writer.WriteMessages(ctx, msgs...)
+}
+
+// Produce spooled messages oldest file first and stop at the first failure
+func (p *kafkaProducer) replaySpool() {
+	files, _ := ioutil.ReadDir(localAnalyticsKafkaDir)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), kafkaSpoolFileSuffix) {
+			continue
+		}
+		completeFilePath := filepath.Join(localAnalyticsKafkaDir, file.Name())
+		messages, readErr := readKafkaSpoolFile(completeFilePath)
+		if len(messages) > 0 {
+			// file is kept and produced again in full if the write fails
+			if err := p.produce(messages); err != nil {
+				log.Debugf("Cannot publish spooled records to Kafka: %v", err)
+				return
+			}
+			log.Infof("Published %d spooled records to Kafka", len(messages))
+		}
+		removeSpoolFile(completeFilePath, readErr)
+	}
+}
+
+// Remove a replayed spool file, or move it aside if it could not be read completely
+func removeSpoolFile(completeFilePath string, readErr error) {
+	if readErr == nil {
+		os.Remove(completeFilePath)
+		return
+	}
+	log.Errorf("Cannot read Kafka spool file '%s' completely, moving it aside: %v",
+		filepath.Base(completeFilePath), readErr)
+	if err := os.Rename(completeFilePath,
+		completeFilePath+kafkaBadSpoolFileSuffix); err != nil {
+		log.Errorf("Cannot move Kafka spool file '%s': %v",
+			filepath.Base(completeFilePath), err)
+	}
+}
+
+// Spool files which were being written when apid stopped have the records
+// of each completed write, so they are renamed to be replayed like others
+func recoverIncompleteSpoolFiles() {
+	files, _ := ioutil.ReadDir(localAnalyticsKafkaDir)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), kafkaSpoolFileSuffix+".tmp") {
+			continue
+		}
+		log.Warnf("Recovering incomplete Kafka spool file '%s'", file.Name())
+		tmpFilePath := filepath.Join(localAnalyticsKafkaDir, file.Name())
+		if err := os.Rename(tmpFilePath,
+			strings.TrimSuffix(tmpFilePath, ".tmp")); err != nil {
+			log.Errorf("Cannot recover Kafka spool file '%s': %v", file.Name(), err)
+		}
+	}
+}
+
+// Spool file is written like buffered files so that it is encrypted
+// if a key is configured, and each write is flushed to the file
+func spoolKafkaMessages(messages []kafkaMessage) {
+	kafkaSpool.Lock()
+	defer kafkaSpool.Unlock()
+	if kafkaSpool.path == "" {
+		name := fmt.Sprintf("%d%s", time.Now().UnixNano(), kafkaSpoolFileSuffix)
+		path := filepath.Join(localAnalyticsKafkaDir, name)
+		fw, err := createGzipFile(path + ".tmp")
+		if err != nil {
+			log.Errorf("Cannot spool %d Kafka records: %v", len(messages), err)
+			return
+		}
+		kafkaSpool.fw, kafkaSpool.path = fw, path
+	}
+	records := make([]interface{}, len(messages))
+	for i := range messages {
+		records[i] = messages[i]
+	}
+	writeGzipFile(kafkaSpool.fw, records)
+}
+
+// Close the spool file and rename it so that it is replayed
+func rotateKafkaSpool() {
+	kafkaSpool.Lock()
+	defer kafkaSpool.Unlock()
+	if kafkaSpool.path == "" {
+		return
+	}
+	closeGzipFile(kafkaSpool.fw)
+	if err := os.Rename(kafkaSpool.path+".tmp", kafkaSpool.path); err != nil {
+		log.Errorf("Cannot rotate Kafka spool file: %v", err)
+	}
+	kafkaSpool.fw, kafkaSpool.path = fileWriter{}, ""
+}
+
+func readKafkaSpoolFile(completeFilePath string) ([]kafkaMessage, error) {
+	file, err := os.Open(completeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
+	}
+	gzReader, err := gzip.NewReader(bufio.NewReader(reader))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+
+	var messages []kafkaMessage
+	scanner := bufio.NewScanner(gzReader)
+	scanner.Buffer(nil, 10*1024*1024)
+	for scanner.Scan() {
+		var m kafkaMessage
+		if json.Unmarshal(scanner.Bytes(), &m) == nil {
+			messages = append(messages, m)
+		}
+	}
+	// messages read before a truncated end are still returned
+	// so that they are produced before the file is moved aside
+	return messages, scanner.Err()
+}
@@ -0,0 +1,244 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Writer which keeps produced messages instead of writing them to a broker
+type fakeKafkaWriter struct {
+	lock     sync.Mutex
+	config   kafka.WriterConfig
+	messages []kafka.Message
+	// returned by writes if set
+	err error
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeKafkaWriter) Close() error {
+	return nil
+}
+
+func (w *fakeKafkaWriter) setError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.err = err
+}
+
+func (w *fakeKafkaWriter) getMessages() []kafka.Message {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]kafka.Message{}, w.messages...)
+}
+
+func (w *fakeKafkaWriter) getMessageCount() int {
+	return len(w.getMessages())
+}
+
+func newTestKafkaMessages(key string, n int) []kafkaMessage {
+	var messages []kafkaMessage
+	for i := 0; i < n; i++ {
+		messages = append(messages, kafkaMessage{Key: key,
+			Value: []byte(fmt.Sprintf(`{"i":%d}`, i)), Timestamp: 1486406248277 + int64(i)})
+	}
+	return messages
+}
+
+var _ = Describe("test kafka producer", func() {
+	var writer *fakeKafkaWriter
+	var origNewKafkaWriter func(kafka.WriterConfig) kafkaWriter
+
+	getSpoolFiles := func() []os.FileInfo {
+		files, _ := ioutil.ReadDir(localAnalyticsKafkaDir)
+		return files
+	}
+
+	BeforeEach(func() {
+		writer = &fakeKafkaWriter{}
+		origNewKafkaWriter = newKafkaWriter
+		newKafkaWriter = func(c kafka.WriterConfig) kafkaWriter {
+			writer.config = c
+			return writer
+		}
+		config.Set(analyticsKafkaBrokers, "127.0.0.1:9092, 127.0.0.2:9092")
+		config.Set(analyticsKafkaAcks, 1)
+		config.Set(analyticsKafkaLingerMs, 50)
+		config.Set(analyticsKafkaRetries, 0)
+		config.Set(analyticsKafkaQueueSize, 100)
+	})
+
+	AfterEach(func() {
+		closeKafka()
+		newKafkaWriter = origNewKafkaWriter
+		config.Set(analyticsKafkaBrokers, "")
+		config.Set(analyticsKafkaQueueSize, analyticsKafkaQueueSizeDefault)
+		os.RemoveAll(localAnalyticsKafkaDir)
+	})
+
+	It("should configure the writer", func() {
+		config.Set(analyticsKafkaRetries, 2)
+		Expect(initKafka()).To(Succeed())
+		Expect(writer.config.Brokers).To(Equal([]string{"127.0.0.1:9092", "127.0.0.2:9092"}))
+		Expect(writer.config.Topic).To(Equal(analyticsKafkaTopicDefault))
+		Expect(writer.config.RequiredAcks).To(Equal(1))
+		Expect(writer.config.MaxAttempts).To(Equal(3))
+		Expect(writer.config.Balancer).To(BeAssignableToTypeOf(&kafka.Hash{}))
+	})
+
+	It("should publish records keyed by org~env", func() {
+		Expect(initKafka()).To(Succeed())
+		records := []interface{}{
+			map[string]interface{}{
+				"apiproxy":                        "api1",
+				"client_received_start_timestamp": json.Number("1486406248277"),
+			},
+		}
+		publishToKafka(tenant{Org: "testorg", Env: "testenv"}, records)
+
+		Eventually(writer.getMessageCount).Should(Equal(1))
+		m := writer.getMessages()[0]
+		Expect(string(m.Key)).To(Equal("testorg~testenv"))
+		Expect(m.Time.UnixNano() / int64(time.Millisecond)).To(Equal(int64(1486406248277)))
+		Expect(string(m.Value)).To(ContainSubstring(`"apiproxy":"api1"`))
+	})
+
+	It("should not publish if brokers are not configured", func() {
+		config.Set(analyticsKafkaBrokers, "")
+		Expect(initKafka()).To(Succeed())
+		publishToKafka(tenant{Org: "testorg", Env: "testenv"},
+			[]interface{}{map[string]interface{}{}})
+		Expect(writer.getMessageCount()).To(Equal(0))
+	})
+
+	It("should reject invalid acks", func() {
+		config.Set(analyticsKafkaAcks, 2)
+		Expect(initKafka()).ToNot(Succeed())
+	})
+
+	It("should spool records when broker is unreachable and replay them", func() {
+		writer.setError(errors.New("dial tcp: connection refused"))
+		Expect(initKafka()).To(Succeed())
+		publishToKafka(tenant{Org: "testorg", Env: "testenv"},
+			[]interface{}{map[string]interface{}{"apiproxy": "api1"}})
+		publishToKafka(tenant{Org: "testorg", Env: "testenv"},
+			[]interface{}{map[string]interface{}{"apiproxy": "api2"}})
+		Eventually(getSpoolFiles, 2*time.Second).Should(HaveLen(1))
+		closeKafka()
+
+		By("appending records of both batches to one spool file")
+		files := getSpoolFiles()
+		Expect(files).To(HaveLen(1))
+		Expect(files[0].Name()).To(HaveSuffix(kafkaSpoolFileSuffix))
+
+		writer.setError(nil)
+		p := &kafkaProducer{writer: writer, timeout: 5 * time.Second}
+		p.replaySpool()
+		Expect(writer.getMessageCount()).To(Equal(2))
+		Expect(getSpoolFiles()).To(BeEmpty())
+	})
+
+	It("should keep spool files if they cannot be produced", func() {
+		Expect(createDirectories([]string{localAnalyticsKafkaDir})).To(Succeed())
+		spoolKafkaMessages(newTestKafkaMessages("testorg~testenv", 2))
+		rotateKafkaSpool()
+
+		writer.setError(errors.New("dial tcp: connection refused"))
+		p := &kafkaProducer{writer: writer, timeout: 5 * time.Second}
+		p.replaySpool()
+		Expect(getSpoolFiles()).To(HaveLen(1))
+
+		writer.setError(nil)
+		p.replaySpool()
+		Expect(writer.getMessageCount()).To(Equal(2))
+		Expect(getSpoolFiles()).To(BeEmpty())
+	})
+
+	It("should read spooled records back", func() {
+		Expect(createDirectories([]string{localAnalyticsKafkaDir})).To(Succeed())
+		spoolKafkaMessages(newTestKafkaMessages("testorg~testenv", 2))
+		spoolKafkaMessages(newTestKafkaMessages("otherorg~otherenv", 1))
+		rotateKafkaSpool()
+		files := getSpoolFiles()
+		Expect(files).To(HaveLen(1))
+
+		messages, err := readKafkaSpoolFile(filepath.Join(localAnalyticsKafkaDir,
+			files[0].Name()))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(messages).To(Equal(append(newTestKafkaMessages("testorg~testenv", 2),
+			newTestKafkaMessages("otherorg~otherenv", 1)...)))
+	})
+
+	It("should keep spool files which cannot be read", func() {
+		Expect(createDirectories([]string{localAnalyticsKafkaDir})).To(Succeed())
+		badFilePath := filepath.Join(localAnalyticsKafkaDir, "1"+kafkaSpoolFileSuffix)
+		Expect(ioutil.WriteFile(badFilePath, []byte("not gzip"), 0644)).To(Succeed())
+		spoolKafkaMessages(newTestKafkaMessages("testorg~testenv", 2))
+		rotateKafkaSpool()
+
+		p := &kafkaProducer{writer: writer, timeout: 5 * time.Second}
+		p.replaySpool()
+		Expect(writer.getMessageCount()).To(Equal(2))
+		files := getSpoolFiles()
+		Expect(files).To(HaveLen(1))
+		Expect(files[0].Name()).To(Equal("1" + kafkaSpoolFileSuffix + kafkaBadSpoolFileSuffix))
+
+		By("replaying again")
+		p.replaySpool()
+		Expect(writer.getMessageCount()).To(Equal(2))
+		Expect(getSpoolFiles()).To(HaveLen(1))
+	})
+
+	It("should replay records of incomplete spool files on startup", func() {
+		Expect(createDirectories([]string{localAnalyticsKafkaDir})).To(Succeed())
+		spoolKafkaMessages(newTestKafkaMessages("testorg~testenv", 2))
+		rotateKafkaSpool()
+		files := getSpoolFiles()
+		Expect(files).To(HaveLen(1))
+		// gzip footer is missing as if apid stopped while writing
+		spoolFilePath := filepath.Join(localAnalyticsKafkaDir, files[0].Name())
+		Expect(os.Truncate(spoolFilePath, files[0].Size()-8)).To(Succeed())
+		Expect(os.Rename(spoolFilePath, spoolFilePath+".tmp")).To(Succeed())
+
+		recoverIncompleteSpoolFiles()
+		Expect(spoolFilePath).To(BeAnExistingFile())
+
+		p := &kafkaProducer{writer: writer, timeout: 5 * time.Second}
+		p.replaySpool()
+		Expect(writer.getMessageCount()).To(Equal(2))
+		Expect(spoolFilePath + kafkaBadSpoolFileSuffix).To(BeAnExistingFile())
+	})
+})
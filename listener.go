@@ -28,10 +28,14 @@ func (h *handler) String() string {
 func (h *handler) Handle(e apid.Event) {
 	snapData, ok := e.(*common.Snapshot)
 	if ok {
+		// ApigeeSync delivers events only after authenticating
+		// so the bearer token might have been refreshed
+		resumeUploads()
 		processSnapshot(snapData)
 	} else {
 		changeSet, ok := e.(*common.ChangeList)
 		if ok {
+			resumeUploads()
 			processChange(changeSet)
 		} else {
 			log.Errorf("Received Invalid event. Ignoring. %v", e)
@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test LRU cache", func() {
+	It("should evict least recently used entry", func() {
+		c := newLRUCache(2)
+		c.add("a", 1)
+		c.add("b", 2)
+		v, ok := c.get("a")
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal(1))
+
+		c.add("c", 3)
+		Expect(c.len()).To(Equal(2))
+		_, ok = c.get("b")
+		Expect(ok).To(BeFalse())
+		_, ok = c.get("c")
+		Expect(ok).To(BeTrue())
+
+		By("updating existing entry")
+		c.add("a", 4)
+		v, _ = c.get("a")
+		Expect(v).To(Equal(4))
+		Expect(c.len()).To(Equal(2))
+	})
+
+	It("should not cache if size is 0", func() {
+		c := newLRUCache(0)
+		c.add("a", 1)
+		_, ok := c.get("a")
+		Expect(ok).To(BeFalse())
+		Expect(c.len()).To(Equal(0))
+	})
+})
@@ -0,0 +1,320 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format: <4DigitRandomHex>_<TSStart>.<TSEnd>_<APIDINSTANCEUUID>_manifest.json
+const manifestFileSuffix = "_manifest.json"
+
+// Describes the data files of a directory so that missing or
+// modified files can be detected before and after upload
+type manifest struct {
+	Tenant         string         `json:"tenant"`
+	IntervalStart  string         `json:"intervalStart"`
+	IntervalEnd    string         `json:"intervalEnd"`
+	ApidInstanceId string         `json:"apidInstanceId"`
+	PluginVersion  string         `json:"pluginVersion"`
+	CreatedAt      string         `json:"createdAt"`
+	Files          []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Name      string `json:"name"`
+	Records   int64  `json:"records"`
+	SizeBytes int64  `json:"sizeBytes"`
+	MD5       string `json:"md5"`
+	CRC32C    string `json:"crc32c"`
+}
+
+// Error returned when files of a directory do not match its manifest
+type manifestMismatchError struct {
+	file   string
+	reason string
+}
+
+func (e manifestMismatchError) Error() string {
+	return fmt.Sprintf("File '%s' does not match manifest: %s",
+		e.file, e.reason)
+}
+
+func isManifestFile(fileName string) bool {
+	return strings.HasSuffix(fileName, manifestFileSuffix)
+}
+
+// Returns true if the file contains analytics records
+func isDataFile(fileName string) bool {
+	return !isManifestFile(fileName) && !isUploadStateFile(fileName) &&
+		!isFailureInfoFile(fileName) && !isDeliveryStateFile(fileName)
+}
+
+func findManifest(dirPath string) string {
+	files, _ := ioutil.ReadDir(dirPath)
+	for _, file := range files {
+		if isManifestFile(file.Name()) {
+			return filepath.Join(dirPath, file.Name())
+		}
+	}
+	return ""
+}
+
+// Write manifest for all data files in the directory.
+// Called before the directory is moved to staging.
+func writeManifest(dirPath string) error {
+	tenant, _ := splitDirName(filepath.Base(dirPath))
+	start, end, err := getDirInterval(dirPath)
+	if err != nil {
+		return err
+	}
+
+	m := manifest{
+		Tenant:         tenant,
+		ApidInstanceId: config.GetString("apigeesync_apid_instance_id"),
+		PluginVersion:  pluginData.Version,
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+		Files:          []manifestFile{},
+	}
+
+	files, _ := ioutil.ReadDir(dirPath)
+	for _, file := range files {
+		if file.IsDir() || !isDataFile(file.Name()) {
+			continue
+		}
+		f, err := describeFile(filepath.Join(dirPath, file.Name()))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, f)
+	}
+	m.IntervalStart = start.UTC().Format(time.RFC3339)
+	m.IntervalEnd = end.UTC().Format(time.RFC3339)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fileName := getIntervalFileName(start, end, manifestFileSuffix)
+	return ioutil.WriteFile(filepath.Join(dirPath, fileName), b, filePermissions)
+}
+
+// Returns start of the interval from the directory name and end of the
+// interval from the name of data files which were created with the
+// collection interval at that time
+func getDirInterval(dirPath string) (time.Time, time.Time, error) {
+	dirName := filepath.Base(dirPath)
+	_, timestamp := splitDirName(dirName)
+	start, err := time.Parse(timestampLayout, timestamp)
+	if err != nil {
+		return start, start, fmt.Errorf("Invalid directory name '%s'", dirName)
+	}
+	end := start.Add(time.Second * config.GetDuration(analyticsCollectionInterval))
+
+	files, _ := ioutil.ReadDir(dirPath)
+	for _, file := range files {
+		if e, ok := getIntervalEndFromFileName(file.Name()); ok &&
+			isDataFile(file.Name()) {
+			end = e
+			break
+		}
+	}
+	return start, end, nil
+}
+
+// Files describing a directory are named like data files so that
+// they are unique when uploaded to the same partition
+func getIntervalFileName(start, end time.Time, suffix string) string {
+	return getRandomHex() + "_" + start.UTC().Format(timestampLayout) +
+		"." + end.UTC().Format(timestampLayout) + "_" +
+		config.GetString("apigeesync_apid_instance_id") + suffix
+}
+
+// Eg. 5be1_20170130155400.20170130155600_<APIDINSTANCEUUID>_writer_0.txt.gz
+func getIntervalEndFromFileName(fileName string) (time.Time, bool) {
+	parts := strings.Split(fileName, "_")
+	if len(parts) < 2 {
+		return time.Time{}, false
+	}
+	timestamps := strings.Split(parts[1], ".")
+	if len(timestamps) != 2 {
+		return time.Time{}, false
+	}
+	end, err := time.Parse(timestampLayout, timestamps[1])
+	return end, err == nil
+}
+
+// Count records and compute checksum of the data that will be uploaded
+// i.e. after decryption if the file is encrypted
+func describeFile(completeFilePath string) (manifestFile, error) {
+	file, err := openStagedFile(completeFilePath)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	defer file.Close()
+
+	c, err := computeChecksum(io.NewSectionReader(file, 0, file.Size()))
+	if err != nil {
+		return manifestFile{}, err
+	}
+	f := manifestFile{
+		Name:      filepath.Base(completeFilePath),
+		SizeBytes: file.Size(),
+		MD5:       c.md5Base64(),
+		CRC32C:    c.crc32cBase64(),
+	}
+	if file.Size() == 0 {
+		return f, nil
+	}
+
+	gzReader, err := gzip.NewReader(io.NewSectionReader(file, 0, file.Size()))
+	if err != nil {
+		return manifestFile{}, fmt.Errorf("Cannot read gzip file '%s': %v",
+			f.Name, err)
+	}
+	defer gzReader.Close()
+	// each record is written as a line
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := gzReader.Read(buf)
+		f.Records += int64(bytes.Count(buf[:n], []byte("\n")))
+		if err == io.EOF {
+			return f, nil
+		} else if err != nil {
+			return manifestFile{}, fmt.Errorf("Cannot read gzip "+
+				"file '%s': %v", f.Name, err)
+		}
+	}
+}
+
+// Map from directory path to the fingerprint of its data files when they
+// were last verified, so that files are not decrypted and hashed again
+// on every upload attempt unless they changed
+var verifiedManifests = make(map[string]string)
+
+var verifiedManifestsLock = sync.Mutex{}
+
+// Name, size and modification time of each data file in the directory
+func getDataFilesFingerprint(dirPath string) string {
+	var fingerprint bytes.Buffer
+	files, _ := ioutil.ReadDir(dirPath)
+	for _, file := range files {
+		if file.IsDir() || !isDataFile(file.Name()) {
+			continue
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d\n", file.Name(),
+			file.Size(), file.ModTime().UnixNano())
+	}
+	return fingerprint.String()
+}
+
+/*
+Verify data files in the directory against its manifest. Files listed in
+the manifest which are missing have already been uploaded in a previous
+attempt since files are deleted after a successful upload. Directories
+without a manifest are not verified. Files are verified once unless their
+size or modification time changes afterwards.
+*/
+func verifyManifest(dirPath string) error {
+	manifestPath := findManifest(dirPath)
+	if manifestPath == "" {
+		return nil
+	}
+	fingerprint := getDataFilesFingerprint(dirPath)
+	verifiedManifestsLock.Lock()
+	verified := verifiedManifests[dirPath] == fingerprint
+	verifiedManifestsLock.Unlock()
+	if verified {
+		return nil
+	}
+	if err := verifyManifestFiles(dirPath, manifestPath); err != nil {
+		return err
+	}
+
+	verifiedManifestsLock.Lock()
+	defer verifiedManifestsLock.Unlock()
+	// forget directories which have been uploaded or moved
+	for path := range verifiedManifests {
+		if _, err := os.Stat(path); err != nil {
+			delete(verifiedManifests, path)
+		}
+	}
+	verifiedManifests[dirPath] = fingerprint
+	return nil
+}
+
+func verifyManifestFiles(dirPath, manifestPath string) error {
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("Cannot parse manifest '%s': %v", manifestPath, err)
+	}
+
+	listed := make(map[string]manifestFile)
+	for _, f := range m.Files {
+		listed[f.Name] = f
+	}
+
+	files, _ := ioutil.ReadDir(dirPath)
+	for _, file := range files {
+		if file.IsDir() || !isDataFile(file.Name()) {
+			continue
+		}
+		expected, ok := listed[file.Name()]
+		if !ok {
+			return manifestMismatchError{file.Name(), "not listed"}
+		}
+		actual, err := describeFile(filepath.Join(dirPath, file.Name()))
+		if err != nil {
+			return err
+		}
+		if actual.SizeBytes != expected.SizeBytes {
+			return manifestMismatchError{file.Name(), fmt.Sprintf(
+				"size %d != %d", actual.SizeBytes, expected.SizeBytes)}
+		}
+		if actual.MD5 != expected.MD5 || actual.CRC32C != expected.CRC32C {
+			return manifestMismatchError{file.Name(), "checksum"}
+		}
+	}
+	return nil
+}
+
+// Returns manifest of the directory if it should be uploaded along with
+// the data files. It is uploaded last so that its presence in the
+// datastore means that all files listed in it have been uploaded.
+func getManifestToUpload(dirPath string) (os.FileInfo, bool) {
+	if !config.GetBool(analyticsUploadManifest) {
+		return nil, false
+	}
+	manifestPath := findManifest(dirPath)
+	if manifestPath == "" {
+		return nil, false
+	}
+	info, err := os.Stat(manifestPath)
+	return info, err == nil
+}
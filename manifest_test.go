@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test manifest", func() {
+	var dirPath, fileName string
+
+	BeforeEach(func() {
+		dirPath = filepath.Join(testTempDir, "manifest", "testorg~testenv~20170130155400")
+		Expect(os.MkdirAll(dirPath, os.ModePerm)).To(Succeed())
+
+		fileName = "5be1_20170130155400.20170130155600_abcd_writer_0.txt.gz"
+		fw, err := createGzipFile(filepath.Join(dirPath, fileName))
+		Expect(err).ShouldNot(HaveOccurred())
+		writeGzipFile(fw, []interface{}{
+			map[string]int{"record": 1}, map[string]int{"record": 2}})
+		closeGzipFile(fw)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(filepath.Join(testTempDir, "manifest"))
+	})
+
+	It("should describe data files in the directory", func() {
+		Expect(writeManifest(dirPath)).To(Succeed())
+
+		manifestPath := findManifest(dirPath)
+		Expect(manifestPath).To(ContainSubstring(
+			"_20170130155400.20170130155600_abcdefgh-ijkl-mnop-qrst-uvwxyz123456_manifest.json"))
+		b, _ := ioutil.ReadFile(manifestPath)
+		var m manifest
+		Expect(json.Unmarshal(b, &m)).To(Succeed())
+
+		Expect(m.Tenant).To(Equal("testorg~testenv"))
+		Expect(m.IntervalStart).To(Equal("2017-01-30T15:54:00Z"))
+		Expect(m.IntervalEnd).To(Equal("2017-01-30T15:56:00Z"))
+		Expect(m.PluginVersion).To(Equal(pluginData.Version))
+		Expect(m.Files).To(HaveLen(1))
+		Expect(m.Files[0].Name).To(Equal(fileName))
+		Expect(m.Files[0].Records).To(Equal(int64(2)))
+
+		info, _ := os.Stat(filepath.Join(dirPath, fileName))
+		Expect(m.Files[0].SizeBytes).To(Equal(info.Size()))
+		Expect(m.Files[0].MD5).ToNot(BeEmpty())
+		Expect(m.Files[0].CRC32C).ToNot(BeEmpty())
+	})
+
+	It("should verify data files against manifest", func() {
+		By("no manifest")
+		Expect(verifyManifest(dirPath)).To(Succeed())
+
+		Expect(writeManifest(dirPath)).To(Succeed())
+		Expect(verifyManifest(dirPath)).To(Succeed())
+
+		By("file is modified")
+		fp := filepath.Join(dirPath, fileName)
+		original, _ := ioutil.ReadFile(fp)
+		modified := append([]byte{}, original...)
+		modified[len(modified)-1] ^= 0xff
+		ioutil.WriteFile(fp, modified, filePermissions)
+		err := verifyManifest(dirPath)
+		_, ok := err.(manifestMismatchError)
+		Expect(ok).To(BeTrue())
+		ioutil.WriteFile(fp, original, filePermissions)
+
+		By("file is not listed")
+		extra := filepath.Join(dirPath, "extra.txt.gz")
+		ioutil.WriteFile(extra, []byte{}, filePermissions)
+		err = verifyManifest(dirPath)
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not listed"))
+		os.Remove(extra)
+
+		By("file was already uploaded")
+		os.Remove(fp)
+		Expect(verifyManifest(dirPath)).To(Succeed())
+	})
+
+	It("should not verify files again unless they change", func() {
+		Expect(writeManifest(dirPath)).To(Succeed())
+		Expect(verifyManifest(dirPath)).To(Succeed())
+
+		By("manifest no longer matches but files are unchanged")
+		manifestPath := findManifest(dirPath)
+		b, _ := ioutil.ReadFile(manifestPath)
+		var m manifest
+		Expect(json.Unmarshal(b, &m)).To(Succeed())
+		m.Files[0].MD5 = "tampered"
+		b, _ = json.Marshal(m)
+		Expect(ioutil.WriteFile(manifestPath, b, filePermissions)).To(Succeed())
+		Expect(verifyManifest(dirPath)).To(Succeed())
+
+		By("file is touched")
+		info, _ := os.Stat(filepath.Join(dirPath, fileName))
+		later := info.ModTime().Add(time.Second)
+		Expect(os.Chtimes(filepath.Join(dirPath, fileName), later, later)).To(Succeed())
+		Expect(verifyManifest(dirPath)).ToNot(Succeed())
+	})
+
+	It("should use content type of the file for its signed URL", func() {
+		Expect(getFileContentType("x" + manifestFileSuffix)).To(Equal("application/json"))
+		Expect(getFileContentType(fileName)).To(Equal("application/x-gzip"))
+	})
+
+	It("should not upload directory which does not match manifest", func() {
+		Expect(writeManifest(dirPath)).To(Succeed())
+		fp := filepath.Join(dirPath, fileName)
+		ioutil.WriteFile(fp, []byte("tampered"), filePermissions)
+
+		stagingPath := filepath.Join(localAnalyticsStagingDir, "testorg~testenv~20170130155900")
+		Expect(os.Rename(dirPath, stagingPath)).To(Succeed())
+		defer os.RemoveAll(stagingPath)
+
+		dir, _ := os.Stat(stagingPath)
+		Expect(uploadDir(dir)).To(BeFalse())
+		Expect(filepath.Join(stagingPath, fileName)).To(BeAnExistingFile())
+	})
+
+	It("should upload manifest after data files if enabled", func() {
+		config.Set(analyticsUploadManifest, true)
+		defer config.Set(analyticsUploadManifest, false)
+		Expect(writeManifest(dirPath)).To(Succeed())
+
+		stagingPath := filepath.Join(localAnalyticsStagingDir, "testorg~testenv~20170130160000")
+		Expect(os.Rename(dirPath, stagingPath)).To(Succeed())
+		defer os.RemoveAll(stagingPath)
+
+		dir, _ := os.Stat(stagingPath)
+		Expect(uploadDir(dir)).To(BeTrue())
+		files, _ := ioutil.ReadDir(stagingPath)
+		Expect(files).To(BeEmpty())
+	})
+})
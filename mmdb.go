@@ -0,0 +1,327 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+/*
+Reader for MaxMind DB (mmdb) files such as GeoIP2/GeoLite2 City and ASN
+databases. The file is a binary search tree on the bits of the IP address
+whose leaves point into a data section, followed by metadata.
+See http://maxmind.github.io/MaxMind-DB/ for the format.
+*/
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Size of the zero separator between search tree and data section
+const mmdbDataSeparatorSize = 16
+
+// Max nesting of maps, arrays and pointers in a value so
+// that a malformed DB cannot exhaust the stack
+const mmdbMaxDepth = 512
+
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// data section of the buffer
+	data []byte
+	// node from which IPv4 addresses are looked up in an IPv6 tree
+	ipv4Start uint
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("Not a MaxMind DB file")
+	}
+	metadataStart := i + len(mmdbMetadataMarker)
+	d := mmdbDecoder{buf: buf[metadataStart:]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read MaxMind DB metadata: %v", err)
+	}
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid MaxMind DB metadata")
+	}
+	r := &mmdbReader{buf: buf}
+	for key, dest := range map[string]*uint{"node_count": &r.nodeCount,
+		"record_size": &r.recordSize, "ip_version": &r.ipVersion} {
+		n, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("Missing %s in MaxMind DB metadata", key)
+		}
+		*dest = uint(n)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("Unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := int(r.nodeCount * r.recordSize / 4)
+	if treeSize+mmdbDataSeparatorSize > i {
+		return nil, fmt.Errorf("Invalid MaxMind DB search tree size")
+	}
+	r.data = buf[treeSize+mmdbDataSeparatorSize : i]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are mapped to ::a.b.c.d i.e. 96 zero bits
+		for j := 0; j < 96 && r.ipv4Start < r.nodeCount; j++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Returns the data record for the IP or nil if it is not in the database
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 0
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for bits < len(ip)*8 && node < r.nodeCount {
+		bit := uint(ip[bits/8]>>(7-uint(bits%8))) & 1
+		node = r.readNode(node, bit)
+		bits++
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	} else if node < r.nodeCount {
+		return nil, fmt.Errorf("Invalid MaxMind DB search tree")
+	}
+	offset := int(node-r.nodeCount) - mmdbDataSeparatorSize
+	if offset < 0 || offset >= len(r.data) {
+		return nil, fmt.Errorf("Invalid MaxMind DB data pointer")
+	}
+	d := mmdbDecoder{buf: r.data}
+	v, _, err := d.decode(offset)
+	return v, err
+}
+
+// Returns left (bit 0) or right (bit 1) record of the node
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.buf[node*8+bit*4:]))
+	}
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// Decodes the value at offset and returns offset of the next value
+func (d mmdbDecoder) decode(offset int) (interface{}, int, error) {
+	return d.decodeValue(offset, 0)
+}
+
+func (d mmdbDecoder) decodeValue(offset, depth int) (interface{}, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("MaxMind DB data is nested deeper than %d", mmdbMaxDepth)
+	}
+	if offset >= len(d.buf) {
+		return nil, 0, fmt.Errorf("Unexpected end of MaxMind DB data")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typeNum := int(ctrl >> 5)
+
+	if typeNum == mmdbPointer {
+		pointer, next, err := d.decodePointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// a pointer to a pointer is invalid as per the spec
+		if pointer < len(d.buf) && int(d.buf[pointer]>>5) == mmdbPointer {
+			return nil, 0, fmt.Errorf("MaxMind DB pointer points to a pointer")
+		}
+		v, _, err := d.decodeValue(pointer, depth+1)
+		return v, next, err
+	}
+
+	if typeNum == mmdbExtended {
+		if offset >= len(d.buf) {
+			return nil, 0, fmt.Errorf("Unexpected end of MaxMind DB data")
+		}
+		typeNum = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.buf) {
+			return nil, 0, fmt.Errorf("Unexpected end of MaxMind DB data")
+		}
+		extra := 0
+		for _, b := range d.buf[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typeNum {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("MaxMind DB map key should be a string")
+			}
+			v, next, err := d.decodeValue(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > len(d.buf) {
+		return nil, 0, fmt.Errorf("Unexpected end of MaxMind DB data")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+	switch typeNum {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return append([]byte{}, b...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("Invalid MaxMind DB float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), next, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("Unknown MaxMind DB data type %d", typeNum)
+}
+
+func (d mmdbDecoder) decodePointer(ctrl byte, offset int) (int, int, error) {
+	size := int(ctrl>>3) & 0x3
+	if offset+size+1 > len(d.buf) {
+		return 0, 0, fmt.Errorf("Unexpected end of MaxMind DB data")
+	}
+	b := d.buf[offset : offset+size+1]
+	pointer := 0
+	if size < 3 {
+		pointer = int(ctrl & 0x7)
+	}
+	for _, c := range b {
+		pointer = pointer<<8 | int(c)
+	}
+	switch size {
+	case 1:
+		pointer += 2048
+	case 2:
+		pointer += 526336
+	}
+	return pointer, offset + size + 1, nil
+}
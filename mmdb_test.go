@@ -0,0 +1,185 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"net"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test MaxMind DB reader", func() {
+	It("should lookup IPv4 and IPv6 networks", func() {
+		r, err := newMMDBReader(buildTestMMDB(map[string]interface{}{
+			"1.2.3.0/24": map[string]interface{}{
+				"country": map[string]interface{}{"iso_code": "US"},
+				"ids":     []interface{}{uint32(1), uint64(1) << 40},
+			},
+			"2001:db8::/32": map[string]interface{}{"name": "v6"},
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		v, err := r.lookup(net.ParseIP("1.2.3.4"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(v).To(Equal(map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "US"},
+			"ids":     []interface{}{uint64(1), uint64(1) << 40},
+		}))
+
+		v, err = r.lookup(net.ParseIP("2001:db8::1"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(v).To(Equal(map[string]interface{}{"name": "v6"}))
+
+		By("address not in database")
+		v, err = r.lookup(net.ParseIP("1.2.4.1"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(v).To(BeNil())
+	})
+
+	It("should decode pointers", func() {
+		// "ab" followed by a pointer to it
+		d := mmdbDecoder{buf: []byte{2<<5 | 2, 'a', 'b', 1 << 5, 0}}
+		v, next, err := d.decode(3)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(v).To(Equal("ab"))
+		Expect(next).To(Equal(5))
+	})
+
+	It("should reject pointers to pointers", func() {
+		// pointer to itself
+		d := mmdbDecoder{buf: []byte{1 << 5, 0}}
+		_, _, err := d.decode(0)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should reject cyclic data", func() {
+		// array of one element which is a pointer to the array
+		d := mmdbDecoder{buf: []byte{1, mmdbArray - 7, 1 << 5, 0}}
+		_, _, err := d.decode(0)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should reject invalid files", func() {
+		_, err := newMMDBReader([]byte("not a database"))
+		Expect(err).Should(HaveOccurred())
+	})
+})
+
+type testMMDBNode [2]int
+
+// Builds a MaxMind DB with 24 bit records and IPv6 search tree
+// with given data for each network
+func buildTestMMDB(networks map[string]interface{}) []byte {
+	// record < 0 is empty and record >= 1<<20 points to data
+	const dataRef = 1 << 20
+	nodes := []testMMDBNode{{-1, -1}}
+	var data []byte
+	var cidrs []string
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		Expect(err).ShouldNot(HaveOccurred())
+		ones, _ := n.Mask.Size()
+		ip := n.IP.To16()
+		if n.IP.To4() != nil {
+			ip = append(make(net.IP, 12), n.IP.To4()...)
+			ones += 96
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = dataRef + len(data)
+			} else if nodes[node][bit] < 0 {
+				nodes = append(nodes, testMMDBNode{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+				node = len(nodes) - 1
+			} else {
+				node = nodes[node][bit]
+			}
+		}
+		data = append(data, encodeTestMMDBValue(networks[cidr])...)
+	}
+
+	var buf []byte
+	for _, node := range nodes {
+		for _, record := range node {
+			v := len(nodes)
+			if record >= dataRef {
+				v = len(nodes) + mmdbDataSeparatorSize + record - dataRef
+			} else if record >= 0 {
+				v = record
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, mmdbDataSeparatorSize)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return append(buf, encodeTestMMDBValue(map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(6),
+		"database_type": "Test",
+	})...)
+}
+
+func encodeTestMMDBValue(v interface{}) []byte {
+	header := func(typeNum, size int) []byte {
+		if typeNum > 7 {
+			return []byte{byte(size), byte(typeNum - 7)}
+		}
+		return []byte{byte(typeNum<<5 | size)}
+	}
+	uint := func(typeNum int, n uint64) []byte {
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		return append(header(typeNum, len(b)), b...)
+	}
+
+	switch value := v.(type) {
+	case string:
+		return append(header(mmdbString, len(value)), value...)
+	case uint16:
+		return uint(mmdbUint16, uint64(value))
+	case uint32:
+		return uint(mmdbUint32, uint64(value))
+	case uint64:
+		return uint(mmdbUint64, value)
+	case []interface{}:
+		b := header(mmdbArray, len(value))
+		for _, e := range value {
+			b = append(b, encodeTestMMDBValue(e)...)
+		}
+		return b
+	case map[string]interface{}:
+		b := header(mmdbMap, len(value))
+		for k, e := range value {
+			b = append(b, encodeTestMMDBValue(k)...)
+			b = append(b, encodeTestMMDBValue(e)...)
+		}
+		return b
+	}
+	Fail("unsupported type")
+	return nil
+}
@@ -0,0 +1,490 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+Files bigger than the configured threshold are uploaded in parts so that
+a slow uplink does not fail the complete upload. The type of upload is
+negotiated with the UAP collection endpoint which responds with either
+	S3 multipart upload:
+	{"upload_type": "s3_multipart", "upload_id": "..", "part_size": 8388608,
+	 "part_urls": ["<signed url for part 1>", ..], "complete_url": ".."}
+	GCS resumable upload:
+	{"upload_type": "gcs_resumable", "session_url": "..", "part_size": 8388608}
+	or a single signed URL if parts are not supported:
+	{"url": ".."}
+The state of the upload is persisted in a file next to the file being
+uploaded so that an interrupted upload continues after a restart.
+*/
+
+const (
+	uploadTypeS3Multipart  = "s3_multipart"
+	uploadTypeGCSResumable = "gcs_resumable"
+
+	// Extension of the file where upload state is persisted
+	uploadStateExtension = ".upload"
+
+	// Extension of the file the upload state is written to before
+	// it is renamed, left behind if apid stops while writing it
+	uploadStateTmpExtension = uploadStateExtension + ".tmp"
+
+	// Each part is retried these many times before the upload is aborted
+	maxPartRetries = 3
+)
+
+type resumableUpload struct {
+	Type        string   `json:"upload_type"`
+	UploadId    string   `json:"upload_id,omitempty"`
+	PartUrls    []string `json:"part_urls,omitempty"`
+	CompleteUrl string   `json:"complete_url,omitempty"`
+	SessionUrl  string   `json:"session_url,omitempty"`
+	PartSize    int64    `json:"part_size"`
+	// ETags of uploaded S3 parts, empty if part is not uploaded yet
+	ETags []string `json:"etags,omitempty"`
+	// Number of bytes persisted by GCS
+	Offset int64 `json:"offset"`
+}
+
+// Request body to complete S3 multipart upload
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Returns true if file is a persisted upload state and not data to be uploaded
+func isUploadStateFile(fileName string) bool {
+	return strings.HasSuffix(fileName, uploadStateExtension) ||
+		strings.HasSuffix(fileName, uploadStateTmpExtension)
+}
+
+func getUploadStatePath(completeFilePath string) string {
+	return completeFilePath + uploadStateExtension
+}
+
+// Returns true if file should be uploaded in parts. Size of plain
+// data is compared since parts are cut from the decrypted file
+func isLargeFile(completeFilePath string) bool {
+	threshold := int64(config.GetInt(analyticsMultipartThreshold))
+	if threshold <= 0 {
+		return false
+	}
+	file, err := openStagedFile(completeFilePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return file.Size() > threshold
+}
+
+func loadUploadState(completeFilePath string) (*resumableUpload, error) {
+	b, err := ioutil.ReadFile(getUploadStatePath(completeFilePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state resumableUpload
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("Cannot parse upload state for "+
+			"file '%s': %v", completeFilePath, err)
+	}
+	return &state, nil
+}
+
+func saveUploadState(completeFilePath string, state *resumableUpload) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename so that a crash
+	// while writing does not leave a corrupt state file
+	statePath := getUploadStatePath(completeFilePath)
+	tmpPath := completeFilePath + uploadStateTmpExtension
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+func deleteUploadState(completeFilePath string) {
+	err := os.Remove(getUploadStatePath(completeFilePath))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Cannot delete upload state for file '%s': %v",
+			completeFilePath, err)
+	}
+}
+
+/*
+Uploads a large file in parts resuming from the persisted state if a
+previous attempt was interrupted. Upload state is deleted once the upload
+completes or if the upload session is no longer valid so that the next
+attempt starts a new upload.
+*/
+func uploadLargeFile(tenant, relativeFilePath, completeFilePath string) (bool, error) {
+	// size of plain data is used since encrypted files are decrypted
+	file, err := openStagedFile(completeFilePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	state, err := loadUploadState(completeFilePath)
+	if err != nil {
+		log.Warnf("Starting new upload: %v", err)
+		deleteUploadState(completeFilePath)
+	}
+	if state == nil {
+		var signedUrl string
+		state, signedUrl, err = startResumableUpload(tenant,
+			relativeFilePath, file.Size())
+		if err != nil {
+			return false, err
+		}
+		if state == nil {
+			// parts are not supported by the server
+			return uploadFileToDatastore(completeFilePath, signedUrl)
+		}
+		if err := saveUploadState(completeFilePath, state); err != nil {
+			return false, fmt.Errorf("Cannot save upload state: %v", err)
+		}
+	} else {
+		log.Infof("Resuming upload of file '%s'", completeFilePath)
+	}
+
+	var status bool
+	switch state.Type {
+	case uploadTypeS3Multipart:
+		status, err = uploadS3Parts(file, file.Size(), completeFilePath, state)
+	case uploadTypeGCSResumable:
+		status, err = uploadGCSChunks(file, file.Size(), completeFilePath, state)
+	default:
+		status, err = false, fmt.Errorf("Unsupported upload type '%s'", state.Type)
+	}
+
+	if status {
+		deleteUploadState(completeFilePath)
+	} else if _, ok := err.(uploadSessionExpiredError); ok {
+		deleteUploadState(completeFilePath)
+	}
+	return status, err
+}
+
+// Error returned when the upload session or part URL's are no longer valid
+type uploadSessionExpiredError struct {
+	status string
+}
+
+func (e uploadSessionExpiredError) Error() string {
+	return fmt.Sprintf("Upload session is no longer valid '%v'", e.status)
+}
+
+// Negotiate type of upload with UAP collection endpoint. Returns nil
+// state and a signed URL if the server does not support parts.
+func startResumableUpload(tenant, relativeFilePath string,
+	size int64) (*resumableUpload, string, error) {
+	params := url.Values{}
+	params.Add("multipart", "true")
+	params.Add("file_size", strconv.FormatInt(size, 10))
+	params.Add("part_size", strconv.Itoa(config.GetInt(analyticsMultipartPartSize)))
+
+	body, err := requestUapCollection(tenant, []string{relativeFilePath}, params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	uploadType, _ := body["upload_type"].(string)
+	if uploadType == "" {
+		signedUrl, ok := body["url"].(string)
+		if !ok {
+			return nil, "", fmt.Errorf("Signed URL missing in response")
+		}
+		return nil, signedUrl, nil
+	}
+
+	// decode again into the state struct now that we know it has parts
+	b, _ := json.Marshal(body)
+	var state resumableUpload
+	json.Unmarshal(b, &state)
+	if state.PartSize <= 0 {
+		state.PartSize = int64(config.GetInt(analyticsMultipartPartSize))
+	}
+
+	switch state.Type {
+	case uploadTypeS3Multipart:
+		parts := int((size + state.PartSize - 1) / state.PartSize)
+		if len(state.PartUrls) != parts || state.CompleteUrl == "" {
+			return nil, "", fmt.Errorf("Expected %d part URL's and "+
+				"complete URL for multipart upload", parts)
+		}
+		state.ETags = make([]string, parts)
+	case uploadTypeGCSResumable:
+		if state.SessionUrl == "" {
+			return nil, "", fmt.Errorf("Session URL missing for resumable upload")
+		}
+	default:
+		return nil, "", fmt.Errorf("Unsupported upload type '%s'", state.Type)
+	}
+	return &state, "", nil
+}
+
+func uploadS3Parts(file io.ReaderAt, size int64, completeFilePath string,
+	state *resumableUpload) (bool, error) {
+	for i, partUrl := range state.PartUrls {
+		if state.ETags[i] != "" {
+			// uploaded before the previous attempt was interrupted
+			continue
+		}
+		offset := int64(i) * state.PartSize
+		length := state.PartSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		var etag string
+		var err error
+		for attempt := 1; attempt <= maxPartRetries; attempt++ {
+			etag, err = uploadS3Part(file, offset, length, partUrl)
+			if err == nil {
+				break
+			} else if _, ok := err.(uploadSessionExpiredError); ok {
+				return false, err
+			}
+			log.Warnf("Upload of part %d of file '%s' failed in "+
+				"attempt %d: %v", i+1, completeFilePath, attempt, err)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		state.ETags[i] = etag
+		if err := saveUploadState(completeFilePath, state); err != nil {
+			log.Errorf("Cannot save upload state: %v", err)
+		}
+	}
+	return completeS3Upload(state)
+}
+
+func uploadS3Part(file io.ReaderAt, offset, length int64, partUrl string) (string, error) {
+	var c checksum
+	var err error
+	verify := config.GetBool(analyticsUploadChecksum)
+	if verify {
+		c, err = computeChecksum(io.NewSectionReader(file, offset, length))
+		if err != nil {
+			return "", fmt.Errorf("Could not compute checksum for "+
+				"part '%v'", err)
+		}
+	}
+
+	req, err := http.NewRequest("PUT", partUrl,
+		io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return "", fmt.Errorf("Parsing URL failed '%v'", err)
+	}
+	req.ContentLength = length
+	if verify {
+		addChecksumHeaders(req, c)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == 200:
+		if verify {
+			if err := verifyChecksum(resp.Header, c); err != nil {
+				return "", err
+			}
+		}
+		return resp.Header.Get("ETag"), nil
+	case resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusNotFound:
+		// part URL has expired or upload was aborted
+		return "", uploadSessionExpiredError{status: resp.Status}
+	default:
+		return "", fmt.Errorf("Final Datastore (S3/GCS)returned "+
+			"Error '%v'", resp.Status)
+	}
+}
+
+func completeS3Upload(state *resumableUpload) (bool, error) {
+	complete := completeMultipartUpload{}
+	for i, etag := range state.ETags {
+		complete.Parts = append(complete.Parts,
+			completedPart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", state.CompleteUrl, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("Parsing URL failed '%v'", err)
+	}
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// S3 can return an error in the body of a 200 response
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == 200 && !bytes.Contains(respBody, []byte("<Error>")) {
+		return true, nil
+	} else if resp.StatusCode == http.StatusNotFound {
+		return false, uploadSessionExpiredError{status: resp.Status}
+	}
+	return false, fmt.Errorf("Completing multipart upload "+
+		"failed '%v'", resp.Status)
+}
+
+func uploadGCSChunks(file io.ReaderAt, size int64, completeFilePath string,
+	state *resumableUpload) (bool, error) {
+	// GCS returns hash of the complete object once the last chunk is sent
+	var c *checksum
+	if config.GetBool(analyticsUploadChecksum) {
+		fileChecksum, err := computeChecksum(io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return false, fmt.Errorf("Could not compute checksum for "+
+				"file '%v'", err)
+		}
+		c = &fileChecksum
+	}
+
+	// Ask GCS how many bytes it has persisted as the
+	// last chunk might not have been acknowledged
+	offset, done, err := putGCSChunk(state.SessionUrl, nil, 0, 0, size, c)
+	if err != nil {
+		return false, err
+	} else if done {
+		return true, nil
+	}
+	state.Offset = offset
+
+	for state.Offset < size {
+		length := state.PartSize
+		if state.Offset+length > size {
+			length = size - state.Offset
+		}
+
+		var err error
+		for attempt := 1; attempt <= maxPartRetries; attempt++ {
+			chunk := io.NewSectionReader(file, state.Offset, length)
+			offset, done, err = putGCSChunk(state.SessionUrl, chunk,
+				state.Offset, length, size, c)
+			if err == nil {
+				break
+			} else if _, ok := err.(uploadSessionExpiredError); ok {
+				return false, err
+			}
+			log.Warnf("Upload of chunk at offset %d of file '%s' failed "+
+				"in attempt %d: %v", state.Offset, completeFilePath, attempt, err)
+		}
+		if err != nil {
+			return false, err
+		} else if done {
+			return true, nil
+		}
+
+		state.Offset = offset
+		if err := saveUploadState(completeFilePath, state); err != nil {
+			log.Errorf("Cannot save upload state: %v", err)
+		}
+	}
+	return false, fmt.Errorf("Resumable upload did not complete "+
+		"after sending %d bytes", size)
+}
+
+/*
+Sends a chunk to GCS resumable session. If chunk is nil then only the
+status of the upload is queried. Returns the number of bytes persisted
+by GCS and whether the upload is complete. If checksum is given then it
+is verified against the hash of the object once the upload is complete.
+*/
+func putGCSChunk(sessionUrl string, chunk io.Reader, offset, length,
+	size int64, c *checksum) (int64, bool, error) {
+	req, err := http.NewRequest("PUT", sessionUrl, chunk)
+	if err != nil {
+		return 0, false, fmt.Errorf("Parsing URL failed '%v'", err)
+	}
+	if chunk == nil {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d",
+			offset, offset+length-1, size))
+	}
+	req.ContentLength = length
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200, 201:
+		if c != nil {
+			if err := verifyChecksum(resp.Header, *c); err != nil {
+				// object is complete so the upload needs to be
+				// restarted instead of resumed
+				return 0, false, uploadSessionExpiredError{status: err.Error()}
+			}
+		}
+		return size, true, nil
+	case 308:
+		// Resume Incomplete with Range: bytes=0-<last byte persisted>
+		persisted := resp.Header.Get("Range")
+		if persisted == "" {
+			return 0, false, nil
+		}
+		last, err := strconv.ParseInt(
+			persisted[strings.LastIndex(persisted, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("Invalid range '%s' "+
+				"returned by GCS", persisted)
+		}
+		return last + 1, false, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, false, uploadSessionExpiredError{status: resp.Status}
+	default:
+		return 0, false, fmt.Errorf("Final Datastore (S3/GCS)returned "+
+			"Error '%v'", resp.Status)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Fake S3/GCS server which supports multipart and resumable uploads
+type fakeMultipartStore struct {
+	sync.Mutex
+	server     *httptest.Server
+	uploadType string
+	parts      map[int][]byte
+	partPuts   int
+	completed  []byte
+	gcsData    []byte
+	failChunk  bool
+}
+
+func newFakeMultipartStore() *fakeMultipartStore {
+	f := &fakeMultipartStore{parts: make(map[int][]byte)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeMultipartStore) handle(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case req.URL.Path == "/analytics":
+		size, _ := strconv.Atoi(req.URL.Query().Get("file_size"))
+		partSize, _ := strconv.Atoi(req.URL.Query().Get("part_size"))
+		body := map[string]interface{}{}
+		switch f.uploadType {
+		case uploadTypeS3Multipart:
+			var urls []string
+			for i := 1; (i-1)*partSize < size; i++ {
+				urls = append(urls, fmt.Sprintf("%s/part?partNumber=%d",
+					f.server.URL, i))
+			}
+			body["upload_type"] = uploadTypeS3Multipart
+			body["upload_id"] = "uploadid"
+			body["part_size"] = partSize
+			body["part_urls"] = urls
+			body["complete_url"] = f.server.URL + "/complete"
+		case uploadTypeGCSResumable:
+			body["upload_type"] = uploadTypeGCSResumable
+			body["session_url"] = f.server.URL + "/session"
+			body["part_size"] = partSize
+		default:
+			body["url"] = f.server.URL + "/single"
+		}
+		b, _ := json.Marshal(body)
+		w.Write(b)
+	case req.URL.Path == "/part":
+		n, _ := strconv.Atoi(req.URL.Query().Get("partNumber"))
+		b, _ := ioutil.ReadAll(req.Body)
+		f.parts[n] = b
+		f.partPuts++
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%d"`, n))
+	case req.URL.Path == "/complete":
+		f.completed, _ = ioutil.ReadAll(req.Body)
+	case req.URL.Path == "/session":
+		b, _ := ioutil.ReadAll(req.Body)
+		contentRange := req.Header.Get("Content-Range")
+		if !strings.HasPrefix(contentRange, "bytes */") {
+			if f.failChunk {
+				f.failChunk = false
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			f.gcsData = append(f.gcsData, b...)
+		}
+		total, _ := strconv.Atoi(contentRange[strings.Index(contentRange, "/")+1:])
+		if len(f.gcsData) == total {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if len(f.gcsData) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(f.gcsData)-1))
+		}
+		w.WriteHeader(308)
+	case req.URL.Path == "/single":
+		f.gcsData, _ = ioutil.ReadAll(req.Body)
+	}
+}
+
+var _ = Describe("test uploadLargeFile()", func() {
+	var store *fakeMultipartStore
+	var uapServer string
+	var fp string
+	content := bytes.Repeat([]byte("0123456789"), 25)
+
+	BeforeEach(func() {
+		store = newFakeMultipartStore()
+		uapServer = config.GetString(uapServerBase)
+		config.Set(uapServerBase, store.server.URL)
+		config.Set(analyticsMultipartPartSize, 100)
+
+		// kept outside staging so that upload manager does not pick it up
+		fakeDir := filepath.Join(testTempDir, "multipart")
+		os.MkdirAll(fakeDir, os.ModePerm)
+		fp = filepath.Join(fakeDir, "largefile.txt.gz")
+		Expect(ioutil.WriteFile(fp, content, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(uapServerBase, uapServer)
+		config.Set(analyticsMultipartPartSize, analyticsMultipartPartSizeDefault)
+		store.server.Close()
+		os.Remove(fp)
+		deleteUploadState(fp)
+	})
+
+	It("should upload parts and complete S3 multipart upload", func() {
+		store.uploadType = uploadTypeS3Multipart
+
+		status, err := uploadLargeFile("testorg~testenv", "date=2006-01-02/largefile.txt.gz", fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(BeTrue())
+		Expect(store.parts).To(HaveLen(3))
+		Expect(append(append(store.parts[1], store.parts[2]...), store.parts[3]...)).
+			To(Equal(content))
+
+		var complete completeMultipartUpload
+		Expect(xml.Unmarshal(store.completed, &complete)).To(Succeed())
+		Expect(complete.Parts).To(HaveLen(3))
+		Expect(complete.Parts[2].ETag).To(Equal(`"etag3"`))
+		Expect(getUploadStatePath(fp)).ToNot(BeAnExistingFile())
+	})
+
+	It("should resume S3 multipart upload from persisted state", func() {
+		state := &resumableUpload{
+			Type:     uploadTypeS3Multipart,
+			UploadId: "uploadid",
+			PartUrls: []string{
+				store.server.URL + "/part?partNumber=1",
+				store.server.URL + "/part?partNumber=2",
+				store.server.URL + "/part?partNumber=3",
+			},
+			CompleteUrl: store.server.URL + "/complete",
+			PartSize:    100,
+			ETags:       []string{`"etag1"`, "", ""},
+		}
+		Expect(saveUploadState(fp, state)).To(Succeed())
+
+		status, err := uploadLargeFile("testorg~testenv", "date=2006-01-02/largefile.txt.gz", fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(BeTrue())
+		Expect(store.partPuts).To(Equal(2))
+		Expect(store.parts[2]).To(Equal(content[100:200]))
+	})
+
+	It("should upload chunks to GCS resumable session and retry failed chunk", func() {
+		store.uploadType = uploadTypeGCSResumable
+		store.failChunk = true
+
+		status, err := uploadLargeFile("testorg~testenv", "date=2006-01-02/largefile.txt.gz", fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(BeTrue())
+		Expect(store.gcsData).To(Equal(content))
+	})
+
+	It("should resume GCS upload from offset persisted by GCS", func() {
+		store.gcsData = append([]byte{}, content[:150]...)
+		state := &resumableUpload{
+			Type:       uploadTypeGCSResumable,
+			SessionUrl: store.server.URL + "/session",
+			PartSize:   100,
+			Offset:     100,
+		}
+		Expect(saveUploadState(fp, state)).To(Succeed())
+
+		status, err := uploadLargeFile("testorg~testenv", "date=2006-01-02/largefile.txt.gz", fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(BeTrue())
+		Expect(store.gcsData).To(Equal(content))
+	})
+
+	It("should fall back to single upload if parts are not supported", func() {
+		status, err := uploadLargeFile("testorg~testenv", "date=2006-01-02/largefile.txt.gz", fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(BeTrue())
+		Expect(store.gcsData).To(Equal(content))
+	})
+})
+
+var _ = Describe("test isUploadStateFile()", func() {
+	It("should identify upload state files", func() {
+		Expect(isUploadStateFile("a.txt.gz" + uploadStateExtension)).To(BeTrue())
+		Expect(isUploadStateFile("a.txt.gz" + uploadStateTmpExtension)).To(BeTrue())
+		Expect(isDataFile("a.txt.gz" + uploadStateTmpExtension)).To(BeFalse())
+		Expect(isUploadStateFile("a.txt.gz")).To(BeFalse())
+	})
+})
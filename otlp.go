@@ -0,0 +1,370 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Records of staged files are exported as OpenTelemetry log records over
+OTLP/HTTP with JSON encoding by a destination of type otlp, eg.
+
+    apidanalytics_destinations: otel
+    apidanalytics_destination_otel_type: otlp
+    apidanalytics_destination_otel_url: http://collector:4318/v1/logs
+
+Each record is a LogRecord with record fields as attributes, and org, env
+and apid instance id as resource attributes. Records are exported in
+batches which are retried on network errors, 429 and 502/503/504 with
+exponential backoff, or after Retry-After if the collector sends it. Retries
+stop once the deadline of the upload pass is reached. If a file fails part
+way it is exported again in full so delivery is at least once.
+Manifests and rollups are not exported.
+*/
+
+const (
+	otlpBatchSizeDefault      = 1000
+	otlpRetriesDefault        = 3
+	otlpRetryBackoffMsDefault = 1000
+	otlpScopeName             = "apidAnalytics"
+
+	// Upper bound of the backoff and of Retry-After sent by the collector
+	otlpMaxRetryDelay = 30 * time.Second
+)
+
+// Severity numbers as defined by the OpenTelemetry log data model
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityWarn  = 13
+	otlpSeverityError = 17
+)
+
+type otlpDestination struct {
+	destinationConfig
+	name       string
+	url        string
+	token      string
+	batchSize  int
+	retries    int
+	retryDelay time.Duration
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string                 `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano string                 `json:"observedTimeUnixNano"`
+	SeverityNumber       int                    `json:"severityNumber"`
+	SeverityText         string                 `json:"severityText"`
+	Body                 map[string]interface{} `json:"body"`
+	Attributes           []otlpKeyValue         `json:"attributes"`
+}
+
+type otlpPartialSuccess struct {
+	PartialSuccess struct {
+		RejectedLogRecords json.Number `json:"rejectedLogRecords"`
+		ErrorMessage       string      `json:"errorMessage"`
+	} `json:"partialSuccess"`
+}
+
+func newOTLPDestination(name string, c destinationConfig) (destination, error) {
+	url := config.GetString(getDestinationConfigKey(name, "url"))
+	if url == "" {
+		return nil, fmt.Errorf("URL of destination '%s' is not configured", name)
+	}
+	config.SetDefault(getDestinationConfigKey(name, "batch_size"), otlpBatchSizeDefault)
+	config.SetDefault(getDestinationConfigKey(name, "retries"), otlpRetriesDefault)
+	config.SetDefault(getDestinationConfigKey(name, "retry_backoff_ms"),
+		otlpRetryBackoffMsDefault)
+
+	d := &otlpDestination{
+		destinationConfig: c,
+		name:              name,
+		url:               url,
+		token:             config.GetString(getDestinationConfigKey(name, "token")),
+		batchSize:         config.GetInt(getDestinationConfigKey(name, "batch_size")),
+		retries:           config.GetInt(getDestinationConfigKey(name, "retries")),
+		retryDelay: time.Duration(config.GetInt(
+			getDestinationConfigKey(name, "retry_backoff_ms"))) * time.Millisecond,
+	}
+	if d.batchSize <= 0 {
+		return nil, fmt.Errorf("Batch size of destination '%s' should be positive", name)
+	}
+	return d, nil
+}
+
+func (d *otlpDestination) getName() string {
+	return d.name
+}
+
+func (d *otlpDestination) isRequired() bool {
+	return d.required
+}
+
+func (d *otlpDestination) deliver(ctx context.Context, tenant, relativeFilePath, completeFilePath string) error {
+	fileName := filepath.Base(completeFilePath)
+	if isManifestFile(fileName) || isRollupFile(fileName) {
+		return nil
+	}
+
+	file, err := openStagedFile(completeFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzReader, err := gzip.NewReader(bufio.NewReader(
+		io.NewSectionReader(file, 0, file.Size())))
+	if err != nil {
+		return err
+	}
+	defer gzReader.Close()
+
+	// Eg. org~env
+	org, env := tenant, ""
+	if i := strings.Index(tenant, "~"); i != -1 {
+		org, env = tenant[:i], tenant[i+1:]
+	}
+	var batch []otlpLogRecord
+	scanner := bufio.NewScanner(gzReader)
+	scanner.Buffer(nil, 10*1024*1024)
+	for scanner.Scan() {
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+		var record map[string]interface{}
+		if decoder.Decode(&record) != nil {
+			continue
+		}
+		batch = append(batch, newOTLPLogRecord(record))
+		if len(batch) >= d.batchSize {
+			if err := d.export(ctx, org, env, batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return d.export(ctx, org, env, batch)
+	}
+	return nil
+}
+
+func newOTLPLogRecord(record map[string]interface{}) otlpLogRecord {
+	now := time.Now().UnixNano()
+	l := otlpLogRecord{
+		ObservedTimeUnixNano: strconv.FormatInt(now, 10),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+	}
+	if ts, ok := getInt64Field(record, "client_received_start_timestamp"); ok {
+		l.TimeUnixNano = strconv.FormatInt(ts*int64(time.Millisecond), 10)
+	}
+	if status, ok := getInt64Field(record, "response_status_code"); ok {
+		if status >= 500 {
+			l.SeverityNumber, l.SeverityText = otlpSeverityError, "ERROR"
+		} else if status >= 400 {
+			l.SeverityNumber, l.SeverityText = otlpSeverityWarn, "WARN"
+		}
+	}
+
+	// Eg. GET /v1/orders 200
+	var summary []string
+	for _, field := range []string{"request_verb", "request_uri", "response_status_code"} {
+		if v, ok := record[field]; ok {
+			summary = append(summary, fmt.Sprintf("%v", v))
+		}
+	}
+	l.Body = map[string]interface{}{"stringValue": strings.Join(summary, " ")}
+
+	fields := make([]string, 0, len(record))
+	for field := range record {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if record[field] == nil {
+			continue
+		}
+		l.Attributes = append(l.Attributes,
+			otlpKeyValue{field, getOTLPValue(record[field])})
+	}
+	return l
+}
+
+// Returns AnyValue of the field in OTLP JSON encoding
+func getOTLPValue(v interface{}) map[string]interface{} {
+	switch value := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": value}
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case json.Number:
+		// 64 bit integers are encoded as strings
+		if i, err := value.Int64(); err == nil {
+			return map[string]interface{}{"intValue": strconv.FormatInt(i, 10)}
+		}
+		f, _ := value.Float64()
+		return map[string]interface{}{"doubleValue": f}
+	case float64:
+		return map[string]interface{}{"doubleValue": value}
+	}
+	b, _ := json.Marshal(v)
+	return map[string]interface{}{"stringValue": string(b)}
+}
+
+func getOTLPResourceAttributes(org, env string) []otlpKeyValue {
+	attributes := []otlpKeyValue{
+		{"service.name", getOTLPValue("apid")},
+		{"apigee.organization", getOTLPValue(org)},
+		{"apigee.environment", getOTLPValue(env)},
+	}
+	if id := config.GetString("apigeesync_apid_instance_id"); id != "" {
+		attributes = append(attributes,
+			otlpKeyValue{"service.instance.id", getOTLPValue(id)})
+	}
+	return attributes
+}
+
+func (d *otlpDestination) export(ctx context.Context, org, env string, records []otlpLogRecord) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceLogs": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": getOTLPResourceAttributes(org, env),
+			},
+			"scopeLogs": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{
+					"name":    otlpScopeName,
+					"version": pluginData.Version,
+				},
+				"logRecords": records,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := d.post(ctx, body)
+		if err == nil || !retry || attempt >= d.retries {
+			return err
+		}
+		delay := getOTLPRetryDelay(d.retryDelay, attempt, retryAfter)
+		log.Debugf("Export to destination '%s' failed, retrying in %v: %v",
+			d.name, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%v, not retried: %v", err, ctx.Err())
+		}
+	}
+}
+
+// Retry-After if the collector sent it, else the backoff doubled
+// for each attempt, capped at otlpMaxRetryDelay
+func getOTLPRetryDelay(backoff time.Duration, attempt int, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = backoff
+		for i := 0; i < attempt && delay < otlpMaxRetryDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > otlpMaxRetryDelay {
+		delay = otlpMaxRetryDelay
+	}
+	return delay
+}
+
+// Retry-After is either seconds or an HTTP date, 0 if absent or invalid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if delay := t.Sub(time.Now()); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// Returns true if the request should be retried
+// and the delay requested by the collector if any
+func (d *otlpDestination) post(ctx context.Context, body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		var p otlpPartialSuccess
+		if json.Unmarshal(respBody, &p) == nil &&
+			p.PartialSuccess.RejectedLogRecords != "" &&
+			p.PartialSuccess.RejectedLogRecords != "0" {
+			log.Warnf("Destination '%s' rejected %s log records: %s", d.name,
+				p.PartialSuccess.RejectedLogRecords, p.PartialSuccess.ErrorMessage)
+		}
+		return false, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusServiceUnavailable:
+		return true, parseRetryAfter(resp.Header.Get("Retry-After")),
+			fmt.Errorf("Destination returned error '%v'", resp.Status)
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return true, 0, fmt.Errorf("Destination returned error '%v'", resp.Status)
+	}
+	return false, 0, fmt.Errorf("Destination returned error '%v'", resp.Status)
+}
@@ -0,0 +1,265 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ = Describe("test OTLP export", func() {
+	var collector *httptest.Server
+	var lock sync.Mutex
+	var requests []map[string]interface{}
+	var responseStatuses []int
+	var retryAfter string
+
+	getRequests := func() []map[string]interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]map[string]interface{}{}, requests...)
+	}
+
+	getLogRecords := func(req map[string]interface{}) []interface{} {
+		resourceLogs := req["resourceLogs"].([]interface{})[0].(map[string]interface{})
+		scopeLogs := resourceLogs["scopeLogs"].([]interface{})[0].(map[string]interface{})
+		return scopeLogs["logRecords"].([]interface{})
+	}
+
+	getAttributes := func(v interface{}) map[string]interface{} {
+		attributes := make(map[string]interface{})
+		for _, a := range v.([]interface{}) {
+			kv := a.(map[string]interface{})
+			attributes[kv["key"].(string)] = kv["value"]
+		}
+		return attributes
+	}
+
+	createStagedFile := func(dirName string, records []interface{}) (os.FileInfo, string) {
+		dirPath := filepath.Join(localAnalyticsStagingDir, dirName)
+		Expect(os.Mkdir(dirPath, dirPermissions)).To(Succeed())
+		fp := filepath.Join(dirPath, "fakefile.txt.gz")
+		fw, err := createGzipFile(fp)
+		Expect(err).ShouldNot(HaveOccurred())
+		writeGzipFile(fw, records)
+		closeGzipFile(fw)
+		dir, _ := os.Stat(dirPath)
+		return dir, fp
+	}
+
+	records := []interface{}{
+		map[string]interface{}{
+			"apiproxy":                        "api1",
+			"request_verb":                    "GET",
+			"request_uri":                     "/v1/orders",
+			"response_status_code":            200,
+			"client_received_start_timestamp": 1486406248277,
+			"is_error":                        false,
+		},
+		map[string]interface{}{
+			"apiproxy":             "api1",
+			"response_status_code": 503,
+			"total_response_time":  1.5,
+		},
+		map[string]interface{}{
+			"apiproxy":             "api2",
+			"response_status_code": 404,
+		},
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		responseStatuses = nil
+		retryAfter = ""
+		collector = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+				status := http.StatusOK
+				if len(responseStatuses) > 0 {
+					status, responseStatuses = responseStatuses[0], responseStatuses[1:]
+				}
+				if status == http.StatusOK {
+					Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+					var body map[string]interface{}
+					Expect(json.NewDecoder(req.Body).Decode(&body)).To(Succeed())
+					requests = append(requests, body)
+				} else if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(status)
+				w.Write([]byte("{}"))
+			}))
+
+		config.Set(analyticsDestinations, "otel")
+		config.Set(analyticsDestinationPrefix+"otel_type", "otlp")
+		config.Set(analyticsDestinationPrefix+"otel_url", collector.URL+"/v1/logs")
+		config.Set(analyticsDestinationPrefix+"otel_required", true)
+		config.Set(analyticsDestinationPrefix+"otel_batch_size", 2)
+		config.Set(analyticsDestinationPrefix+"otel_retries", 1)
+		config.Set(analyticsDestinationPrefix+"otel_retry_backoff_ms", 10)
+		Expect(initDestinations()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsDestinations, "")
+		Expect(initDestinations()).To(Succeed())
+		collector.Close()
+	})
+
+	It("should export records as log records in batches", func() {
+		dir, fp := createStagedFile("testorg~testenv~20170130160200", records)
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		Expect(uploadDir(dir)).To(BeTrue())
+		reqs := getRequests()
+		Expect(reqs).To(HaveLen(2))
+		Expect(getLogRecords(reqs[0])).To(HaveLen(2))
+		Expect(getLogRecords(reqs[1])).To(HaveLen(1))
+
+		resourceLogs := reqs[0]["resourceLogs"].([]interface{})[0].(map[string]interface{})
+		resource := getAttributes(resourceLogs["resource"].(map[string]interface{})["attributes"])
+		Expect(resource["apigee.organization"]).To(Equal(map[string]interface{}{"stringValue": "testorg"}))
+		Expect(resource["apigee.environment"]).To(Equal(map[string]interface{}{"stringValue": "testenv"}))
+		Expect(resource["service.instance.id"]).To(Equal(map[string]interface{}{
+			"stringValue": config.GetString("apigeesync_apid_instance_id")}))
+
+		first := getLogRecords(reqs[0])[0].(map[string]interface{})
+		Expect(first["timeUnixNano"]).To(Equal("1486406248277000000"))
+		Expect(first["severityText"]).To(Equal("INFO"))
+		Expect(first["body"]).To(Equal(map[string]interface{}{"stringValue": "GET /v1/orders 200"}))
+		attributes := getAttributes(first["attributes"])
+		Expect(attributes["apiproxy"]).To(Equal(map[string]interface{}{"stringValue": "api1"}))
+		Expect(attributes["response_status_code"]).To(Equal(map[string]interface{}{"intValue": "200"}))
+		Expect(attributes["is_error"]).To(Equal(map[string]interface{}{"boolValue": false}))
+
+		second := getLogRecords(reqs[0])[1].(map[string]interface{})
+		Expect(second["severityText"]).To(Equal("ERROR"))
+		Expect(getAttributes(second["attributes"])["total_response_time"]).
+			To(Equal(map[string]interface{}{"doubleValue": 1.5}))
+		third := getLogRecords(reqs[1])[0].(map[string]interface{})
+		Expect(third["severityText"]).To(Equal("WARN"))
+	})
+
+	It("should retry batches which failed with a retriable status", func() {
+		responseStatuses = []int{http.StatusServiceUnavailable}
+		dir, fp := createStagedFile("testorg~testenv~20170130160400", records[:1])
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(getRequests()).To(HaveLen(1))
+	})
+
+	It("should wait for Retry-After before retrying", func() {
+		responseStatuses = []int{http.StatusTooManyRequests}
+		retryAfter = "1"
+		dir, fp := createStagedFile("testorg~testenv~20170130160500", records[:1])
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		start := time.Now()
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+		Expect(getRequests()).To(HaveLen(1))
+	})
+
+	It("should cap the retry delay", func() {
+		Expect(getOTLPRetryDelay(time.Second, 0, 0)).To(Equal(time.Second))
+		Expect(getOTLPRetryDelay(time.Second, 2, 0)).To(Equal(4 * time.Second))
+		Expect(getOTLPRetryDelay(time.Second, 100, 0)).To(Equal(otlpMaxRetryDelay))
+		Expect(getOTLPRetryDelay(time.Second, 0, 2*time.Second)).To(Equal(2 * time.Second))
+		Expect(getOTLPRetryDelay(time.Second, 0, time.Hour)).To(Equal(otlpMaxRetryDelay))
+
+		Expect(parseRetryAfter("")).To(BeZero())
+		Expect(parseRetryAfter("abc")).To(BeZero())
+		Expect(parseRetryAfter("-1")).To(BeZero())
+		Expect(parseRetryAfter("5")).To(Equal(5 * time.Second))
+		date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+		Expect(parseRetryAfter(date)).To(BeNumerically(">", 58*time.Second))
+	})
+
+	It("should fail without retrying a rejected batch", func() {
+		responseStatuses = []int{http.StatusBadRequest, http.StatusBadRequest}
+		dir, fp := createStagedFile("testorg~testenv~20170130160600", records[:1])
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		Expect(uploadDir(dir)).To(BeFalse())
+		Expect(getRequests()).To(BeEmpty())
+		lock.Lock()
+		Expect(responseStatuses).To(HaveLen(1))
+		lock.Unlock()
+		popLastUploadError(dir.Name())
+	})
+
+	It("should stop retrying once the upload pass deadline is reached", func() {
+		responseStatuses = []int{http.StatusTooManyRequests}
+		retryAfter = "10"
+		config.Set(analyticsDestinationTimeout, 1)
+		defer config.Set(analyticsDestinationTimeout, analyticsDestinationTimeoutDefault)
+		dir, fp := createStagedFile("testorg~testenv~20170130160700", records[:1])
+		defer os.RemoveAll(filepath.Dir(fp))
+
+		start := time.Now()
+		Expect(uploadDir(dir)).To(BeFalse())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(getRequests()).To(BeEmpty())
+		popLastUploadError(dir.Name())
+	})
+
+	It("should skip a destination for the rest of the pass once it failed", func() {
+		responseStatuses = []int{http.StatusBadRequest}
+		dir1, fp1 := createStagedFile("testorg~testenv~20170130160800", records[:1])
+		defer os.RemoveAll(filepath.Dir(fp1))
+		dir2, fp2 := createStagedFile("testorg~testenv~20170130160900", records[:1])
+		defer os.RemoveAll(filepath.Dir(fp2))
+
+		endDeliveryPass := startDeliveryPass()
+		Expect(uploadDir(dir1)).To(BeFalse())
+		Expect(uploadDir(dir2)).To(BeFalse())
+		endDeliveryPass()
+		Expect(getRequests()).To(BeEmpty())
+		Expect(popLastUploadError(dir2.Name())).To(ContainSubstring("skipped for this upload pass"))
+		popLastUploadError(dir1.Name())
+
+		By("attempting it again in the next pass")
+		Expect(uploadDir(dir2)).To(BeTrue())
+		Expect(getRequests()).To(HaveLen(1))
+	})
+
+	It("should not export manifest and rollup files", func() {
+		d := getDestinations("testorg~testenv")[0]
+		Expect(d.deliver(context.Background(), "testorg~testenv", "x_manifest.json", "/nonexistent/x_manifest.json")).To(Succeed())
+		Expect(d.deliver(context.Background(), "testorg~testenv", "x_rollup.json.gz", "/nonexistent/x_rollup.json.gz")).To(Succeed())
+		Expect(getRequests()).To(BeEmpty())
+	})
+
+	It("should require a positive batch size", func() {
+		config.Set(analyticsDestinationPrefix+"otel_batch_size", 0)
+		Expect(initDestinations()).ToNot(Succeed())
+	})
+
+	It("should encode values of record fields", func() {
+		Expect(getOTLPValue(json.Number("12"))).To(Equal(map[string]interface{}{"intValue": "12"}))
+		Expect(getOTLPValue(json.Number("1.25"))).To(Equal(map[string]interface{}{"doubleValue": 1.25}))
+		Expect(getOTLPValue([]interface{}{"a"})).To(Equal(map[string]interface{}{"stringValue": `["a"]`}))
+	})
+})
@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/apid/apidAnalytics/analyticspb"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/*
+Converts messages of analytics.proto into the same record maps as JSON
+payloads. Well known fields of AnalyticsRecord are added with their name in
+analytics.proto if they are set, and custom dimensions are added unless a
+well known field has the same name.
+*/
+
+func getRecordsFromProto(batch *analyticspb.Batch) ([]interface{}, error) {
+	var records []interface{}
+	for _, r := range batch.GetRecords() {
+		record, err := getRecordFromProto(r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Numbers are json.Number like records decoded from JSON payloads
+func getRecordFromProto(r *analyticspb.AnalyticsRecord) (map[string]interface{}, error) {
+	record := make(map[string]interface{})
+	// only fields which are set i.e. not zero are visited
+	r.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch fd.Kind() {
+		case protoreflect.Int64Kind, protoreflect.Int32Kind:
+			record[string(fd.Name())] = json.Number(strconv.FormatInt(v.Int(), 10))
+		case protoreflect.StringKind:
+			record[string(fd.Name())] = v.String()
+		}
+		return true
+	})
+
+	for key, dimension := range r.GetDimensions() {
+		if key == "" {
+			return nil, fmt.Errorf("dimension without a name")
+		}
+		if _, exists := record[key]; exists {
+			continue
+		}
+		value, err := getDimensionValue(dimension)
+		if err != nil {
+			return nil, err
+		}
+		record[key] = value
+	}
+	return record, nil
+}
+
+func getDimensionValue(d *analyticspb.DimensionValue) (interface{}, error) {
+	switch kind := d.GetKind().(type) {
+	case *analyticspb.DimensionValue_StringValue:
+		return kind.StringValue, nil
+	case *analyticspb.DimensionValue_IntValue:
+		return json.Number(strconv.FormatInt(kind.IntValue, 10)), nil
+	case *analyticspb.DimensionValue_DoubleValue:
+		f := kind.DoubleValue
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("dimension is not a finite number")
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	case *analyticspb.DimensionValue_BoolValue:
+		return kind.BoolValue, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math"
+	"time"
+
+	"github.com/apid/apidAnalytics/analyticspb"
+)
+
+// Returns a valid record for the current time with a custom dimension
+func newTestRecord() *analyticspb.AnalyticsRecord {
+	ts := time.Now().Unix() * 1000
+	return &analyticspb.AnalyticsRecord{
+		ClientReceivedStartTimestamp: ts,
+		ClientReceivedEndTimestamp:   ts + 1000,
+		ResponseStatusCode:           200,
+		ClientId:                     "testapikey",
+		Dimensions: map[string]*analyticspb.DimensionValue{
+			"region": {Kind: &analyticspb.DimensionValue_StringValue{StringValue: "us-east"}},
+		},
+	}
+}
+
+func newTestBatch(scopeUUID, org, env string,
+	records ...*analyticspb.AnalyticsRecord) *analyticspb.Batch {
+	return &analyticspb.Batch{
+		BundleScopeUuid: scopeUUID,
+		Organization:    org,
+		Environment:     env,
+		Records:         records,
+	}
+}
+
+var _ = Describe("test protobuf conversion", func() {
+	It("should convert a batch into records", func() {
+		records, err := getRecordsFromProto(newTestBatch("", "testorg", "testenv",
+			&analyticspb.AnalyticsRecord{
+				ClientReceivedStartTimestamp: 1486406248277,
+				ClientReceivedEndTimestamp:   1486406249277,
+				ResponseStatusCode:           200,
+				ClientId:                     "testapikey",
+			},
+			&analyticspb.AnalyticsRecord{ResponseStatusCode: -1}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0]).To(Equal(map[string]interface{}{
+			"client_received_start_timestamp": json.Number("1486406248277"),
+			"client_received_end_timestamp":   json.Number("1486406249277"),
+			"response_status_code":            json.Number("200"),
+			"client_id":                       "testapikey",
+		}))
+		Expect(records[1]).To(Equal(map[string]interface{}{
+			"response_status_code": json.Number("-1"),
+		}))
+	})
+
+	It("should add dimensions without overwriting well known fields", func() {
+		r := newTestRecord()
+		r.Dimensions["retries"] = &analyticspb.DimensionValue{
+			Kind: &analyticspb.DimensionValue_IntValue{IntValue: 2}}
+		r.Dimensions["ratio"] = &analyticspb.DimensionValue{
+			Kind: &analyticspb.DimensionValue_DoubleValue{DoubleValue: 0.5}}
+		r.Dimensions["cached"] = &analyticspb.DimensionValue{
+			Kind: &analyticspb.DimensionValue_BoolValue{BoolValue: true}}
+		r.Dimensions["client_id"] = &analyticspb.DimensionValue{
+			Kind: &analyticspb.DimensionValue_StringValue{StringValue: "overwritten"}}
+		record, err := getRecordFromProto(r)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(record["region"]).To(Equal("us-east"))
+		Expect(record["retries"]).To(Equal(json.Number("2")))
+		Expect(record["ratio"]).To(Equal(json.Number("0.5")))
+		Expect(record["cached"]).To(Equal(true))
+		Expect(record["client_id"]).To(Equal("testapikey"))
+	})
+
+	It("should reject dimensions which are not finite numbers", func() {
+		r := newTestRecord()
+		r.Dimensions["ratio"] = &analyticspb.DimensionValue{
+			Kind: &analyticspb.DimensionValue_DoubleValue{DoubleValue: math.NaN()}}
+		_, err := getRecordFromProto(r)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should reject dimensions without a name", func() {
+		r := newTestRecord()
+		r.Dimensions[""] = &analyticspb.DimensionValue{
+			Kind: &analyticspb.DimensionValue_BoolValue{BoolValue: true}}
+		_, err := getRecordsFromProto(newTestBatch("testid", "", "", r))
+		Expect(err).Should(HaveOccurred())
+	})
+})
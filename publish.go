@@ -0,0 +1,188 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"github.com/apid/apid-core"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+In-process publishing for other apid plugins so that they do not have to
+loop back over HTTP. Batches are validated, sampled, enriched and published
+to the internal buffer like the body of POST /analytics, and count towards
+the rate limits of their tenant like HTTP requests, either by calling
+Publish directly or by emitting a *PublishEvent, eg.
+
+    e := &apidAnalytics.PublishEvent{Batches: batches}
+    <-events.Emit(apidAnalytics.PublishEventSelector, e)
+    for _, err := range e.Errors { ... }
+*/
+
+// Selector of events emitted by other plugins to publish records
+const PublishEventSelector apid.EventSelector = "apidAnalytics publish"
+
+// Batch of analytics records of a tenant which is identified by
+// bundle scope uuid, or organization and environment
+type Batch struct {
+	BundleScopeUUID string
+	Organization    string
+	Environment     string
+	// Numbers (and time.Time for timestamps) are accepted
+	// as is, records are copied before they are enriched
+	Records []map[string]interface{}
+}
+
+// Error of a rejected batch, error codes are the same as the HTTP API
+type BatchError struct {
+	Index     int
+	ErrorCode string
+	Reason    string
+}
+
+// Event emitted with PublishEventSelector. Errors is set
+// by the time the channel returned by Emit delivers the event
+type PublishEvent struct {
+	Batches []Batch
+	Errors  []BatchError
+}
+
+type publishHandler struct{}
+
+func (h *publishHandler) String() string {
+	return "apigeeAnalyticsPublish"
+}
+
+func (h *publishHandler) Handle(e apid.Event) {
+	event, ok := e.(*PublishEvent)
+	if !ok {
+		log.Errorf("Received invalid publish event. Ignoring. %v", e)
+		return
+	}
+	event.Errors = Publish(event.Batches...)
+}
+
+// Publish batches of records synchronously and
+// return errors of the batches which were rejected
+func Publish(batches ...Batch) []BatchError {
+	var errors []BatchError
+	if getDB() == nil {
+		for i := range batches {
+			errors = append(errors, BatchError{
+				Index:     i,
+				ErrorCode: "INTERNAL_SERVER_ERROR",
+				Reason:    "Service is not initialized completely"})
+		}
+		return errors
+	}
+
+	for i, batch := range batches {
+		if e := publishBatch(batch); e.ErrorCode != "" {
+			errors = append(errors, BatchError{
+				Index:     i,
+				ErrorCode: e.ErrorCode,
+				Reason:    e.Reason})
+		}
+	}
+	return errors
+}
+
+// Resolve tenant of the batch and check its rate limit like HTTP
+// requests, then validate, enrich and publish a copy of its records
+func publishBatch(batch Batch) errResponse {
+	t, e := getTenantForBatch(batch.BundleScopeUUID,
+		batch.Organization, batch.Environment)
+	if e.ErrorCode != "" {
+		return e
+	}
+
+	var keys []string
+	if batch.BundleScopeUUID != "" {
+		keys = append(keys, batch.BundleScopeUUID)
+	}
+	keys = append(keys, getKeyForOrgEnvCache(t.Org, t.Env))
+	records := copyRecords(batch.Records)
+	allowed, _, exceeded := checkRateLimits(keys,
+		int64(len(records)), getRecordsSize(records))
+	if !allowed {
+		return errResponse{
+			ErrorCode: "RATE_LIMITED",
+			Reason:    "Rate limit exceeded for tenant: " + exceeded}
+	}
+	return validateEnrichPublish(t, map[string]interface{}{"records": records})
+}
+
+// Bytes of the records encoded as JSON. Records which
+// cannot be encoded are left for validation to reject
+func getRecordsSize(records []interface{}) int64 {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return 0
+	}
+	return int64(len(b))
+}
+
+// Copy records with numbers converted to json.Number
+// like records decoded from JSON payloads
+func copyRecords(records []map[string]interface{}) []interface{} {
+	copied := make([]interface{}, len(records))
+	for i, record := range records {
+		r := make(map[string]interface{}, len(record))
+		for field, value := range record {
+			r[field] = getJsonValue(value)
+		}
+		copied[i] = r
+	}
+	return copied
+}
+
+func getJsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int:
+		return json.Number(strconv.FormatInt(int64(value), 10))
+	case int8:
+		return json.Number(strconv.FormatInt(int64(value), 10))
+	case int16:
+		return json.Number(strconv.FormatInt(int64(value), 10))
+	case int32:
+		return json.Number(strconv.FormatInt(int64(value), 10))
+	case int64:
+		return json.Number(strconv.FormatInt(value, 10))
+	case uint:
+		return json.Number(strconv.FormatUint(uint64(value), 10))
+	case uint8:
+		return json.Number(strconv.FormatUint(uint64(value), 10))
+	case uint16:
+		return json.Number(strconv.FormatUint(uint64(value), 10))
+	case uint32:
+		return json.Number(strconv.FormatUint(uint64(value), 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(value, 10))
+	case float32:
+		return getJsonValue(float64(value))
+	case float64:
+		// not finite numbers are left for validation to reject
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			return json.Number(strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	case time.Time:
+		// epoch milliseconds
+		return json.Number(strconv.FormatInt(value.UnixNano()/int64(time.Millisecond), 10))
+	}
+	return v
+}
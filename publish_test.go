@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math"
+	"time"
+)
+
+var _ = Describe("test in-process publishing", func() {
+	validRecord := func() map[string]interface{} {
+		now := time.Now()
+		return map[string]interface{}{
+			"response_status_code":            200,
+			"client_id":                       "testapikey",
+			"client_received_start_timestamp": now.UnixNano() / int64(time.Millisecond),
+			"client_received_end_timestamp":   now.Add(time.Second),
+		}
+	}
+
+	It("should publish batches for scope and org/env", func() {
+		errors := Publish(
+			Batch{BundleScopeUUID: "testid",
+				Records: []map[string]interface{}{validRecord(), validRecord()}},
+			Batch{Organization: "testorg", Environment: "testenv",
+				Records: []map[string]interface{}{validRecord()}})
+		Expect(errors).To(BeEmpty())
+	})
+
+	It("should return errors of rejected batches", func() {
+		errors := Publish(
+			Batch{BundleScopeUUID: "wrongid",
+				Records: []map[string]interface{}{validRecord()}},
+			Batch{BundleScopeUUID: "testid",
+				Records: []map[string]interface{}{validRecord()}},
+			Batch{Organization: "testorg",
+				Records: []map[string]interface{}{validRecord()}},
+			Batch{BundleScopeUUID: "testid",
+				Records: []map[string]interface{}{{"client_id": "testapikey"}}},
+			Batch{BundleScopeUUID: "testid"})
+		Expect(errors).To(HaveLen(4))
+		Expect(errors[0].Index).To(Equal(0))
+		Expect(errors[0].ErrorCode).To(Equal("UNKNOWN_SCOPE"))
+		Expect(errors[1].Index).To(Equal(2))
+		Expect(errors[1].ErrorCode).To(Equal("MISSING_FIELD"))
+		Expect(errors[2].Index).To(Equal(3))
+		Expect(errors[2].ErrorCode).To(Equal("MISSING_FIELD"))
+		Expect(errors[3].Index).To(Equal(4))
+		Expect(errors[3].ErrorCode).To(Equal("NO_RECORDS"))
+	})
+
+	It("should reject batches once the rate limit is exceeded", func() {
+		config.Set(analyticsRateLimitRecords, 1)
+		config.Set(analyticsRateLimitBurst, 1)
+		defer func() {
+			config.Set(analyticsRateLimitRecords, 0)
+			config.Set(analyticsRateLimitBurst, analyticsRateLimitBurstDefault)
+			rateLimitersLock.Lock()
+			rateLimiters = make(map[string]*tenantRateLimiter)
+			rateLimitCountersByKey = make(map[string]*rateLimitCounters)
+			rateLimitersLock.Unlock()
+		}()
+
+		errors := Publish(
+			Batch{BundleScopeUUID: "testid",
+				Records: []map[string]interface{}{validRecord()}},
+			Batch{Organization: "testorg", Environment: "testenv",
+				Records: []map[string]interface{}{validRecord()}})
+		Expect(errors).To(HaveLen(1))
+		Expect(errors[0].Index).To(Equal(1))
+		Expect(errors[0].ErrorCode).To(Equal("RATE_LIMITED"))
+	})
+
+	It("should not modify records of the caller", func() {
+		record := validRecord()
+		Expect(Publish(Batch{BundleScopeUUID: "testid",
+			Records: []map[string]interface{}{record}})).To(BeEmpty())
+		Expect(record).To(HaveLen(4))
+		Expect(record).ToNot(HaveKey("organization"))
+	})
+
+	It("should reject all batches if DB is not initialized", func() {
+		db := getDB()
+		setDB(nil)
+		defer setDB(db)
+		errors := Publish(Batch{BundleScopeUUID: "testid",
+			Records: []map[string]interface{}{validRecord()}})
+		Expect(errors).To(HaveLen(1))
+		Expect(errors[0].ErrorCode).To(Equal("INTERNAL_SERVER_ERROR"))
+	})
+
+	It("should publish batches of events", func() {
+		e := &PublishEvent{Batches: []Batch{
+			{BundleScopeUUID: "testid",
+				Records: []map[string]interface{}{validRecord()}},
+			{BundleScopeUUID: "wrongid",
+				Records: []map[string]interface{}{validRecord()}},
+		}}
+		var delivered interface{}
+		Eventually(events.Emit(PublishEventSelector, e), 5*time.Second).Should(Receive(&delivered))
+		Expect(delivered).To(Equal(e))
+		Expect(e.Errors).To(HaveLen(1))
+		Expect(e.Errors[0].Index).To(Equal(1))
+		Expect(e.Errors[0].ErrorCode).To(Equal("UNKNOWN_SCOPE"))
+	})
+
+	It("should convert numbers like JSON payloads", func() {
+		Expect(getJsonValue(int8(-8))).To(Equal(json.Number("-8")))
+		Expect(getJsonValue(int16(-16))).To(Equal(json.Number("-16")))
+		Expect(getJsonValue(int32(-5))).To(Equal(json.Number("-5")))
+		Expect(getJsonValue(uint(3))).To(Equal(json.Number("3")))
+		Expect(getJsonValue(uint8(200))).To(Equal(json.Number("200")))
+		Expect(getJsonValue(uint16(404))).To(Equal(json.Number("404")))
+		Expect(getJsonValue(uint64(7))).To(Equal(json.Number("7")))
+		Expect(getJsonValue(1.5)).To(Equal(json.Number("1.5")))
+		Expect(getJsonValue(time.Unix(1486406248, 277000000))).
+			To(Equal(json.Number("1486406248277")))
+		Expect(getJsonValue(math.Inf(1))).To(Equal(math.Inf(1)))
+		Expect(getJsonValue("200")).To(Equal("200"))
+	})
+})
@@ -0,0 +1,256 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Records saved by the buffering manager are also kept in memory for the
+query window so that aggregates can be computed locally eg. when UAP is
+unreachable. Only fields needed for aggregation are kept, grouped by the
+minute of client_received_start_timestamp so that old minutes can be
+dropped cheaply.
+*/
+
+var queryGroupByFields = map[string]bool{
+	"apiproxy":             true,
+	"response_status_code": true,
+	"client_id":            true,
+}
+
+type queryPoint struct {
+	timestamp int64 // ms
+	tenant    string
+	fields    map[string]string
+	// -1 if record does not have client_sent_end_timestamp
+	latency float64
+	error   bool
+}
+
+// Map from minute (unix ms) to points received for that minute
+var queryMinutes = make(map[int64][]queryPoint)
+
+// Total number of points in queryMinutes
+var queryPointCount int
+
+var queryMinutesLock = sync.RWMutex{}
+
+type queryResult struct {
+	Org     string       `json:"org"`
+	Env     string       `json:"env"`
+	Start   int64        `json:"start"`
+	End     int64        `json:"end"`
+	GroupBy string       `json:"groupBy,omitempty"`
+	Groups  []queryGroup `json:"groups"`
+}
+
+type queryGroup struct {
+	Key          string           `json:"key"`
+	RequestCount int64            `json:"requestCount"`
+	ErrorCount   int64            `json:"errorCount"`
+	Latency      map[string]int64 `json:"latency"`
+}
+
+// Add records which have been saved to the buffer
+func addToQueryStore(tenant tenant, records []interface{}) {
+	window := int64(config.GetInt(analyticsQueryWindow))
+	if window <= 0 {
+		return
+	}
+	orgEnv := getKeyForOrgEnvCache(tenant.Org, tenant.Env)
+
+	queryMinutesLock.Lock()
+	defer queryMinutesLock.Unlock()
+	for _, record := range records {
+		r, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		start, ok := getInt64Field(r, "client_received_start_timestamp")
+		if !ok {
+			continue
+		}
+		p := queryPoint{timestamp: start, tenant: orgEnv, latency: -1,
+			fields: make(map[string]string, len(queryGroupByFields))}
+		for field := range queryGroupByFields {
+			p.fields[field] = getStringField(r, field)
+		}
+		if end, ok := getInt64Field(r, "client_sent_end_timestamp"); ok && end >= start {
+			p.latency = float64(end - start)
+		}
+		if status, ok := getInt64Field(r, "response_status_code"); ok && status >= 400 {
+			p.error = true
+		}
+		minute := start / 60000 * 60000
+		queryMinutes[minute] = append(queryMinutes[minute], p)
+		queryPointCount++
+	}
+	pruneQueryStore(time.Now(), window, config.GetInt(analyticsQueryMaxRecords))
+}
+
+// Drop minutes older than the window and oldest minutes
+// till there are at most maxRecords points.
+// Should be called with queryMinutesLock held.
+func pruneQueryStore(now time.Time, window int64, maxRecords int) {
+	oldest := (now.Unix() - window) * 1000 / 60000 * 60000
+	minutes := make([]int64, 0, len(queryMinutes))
+	for minute, points := range queryMinutes {
+		if minute < oldest {
+			queryPointCount -= len(points)
+			delete(queryMinutes, minute)
+		} else {
+			minutes = append(minutes, minute)
+		}
+	}
+	if maxRecords <= 0 || queryPointCount <= maxRecords {
+		return
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+	for _, minute := range minutes {
+		if queryPointCount <= maxRecords {
+			break
+		}
+		queryPointCount -= len(queryMinutes[minute])
+		delete(queryMinutes, minute)
+	}
+}
+
+// Aggregate points of the tenant with timestamp in [start, end)
+func queryAggregates(orgEnv string, start, end int64, groupBy string) []queryGroup {
+	counts := make(map[string]*queryGroup)
+	sketches := make(map[string]*latencySketch)
+
+	queryMinutesLock.RLock()
+	for minute, points := range queryMinutes {
+		if minute+60000 <= start || minute >= end {
+			continue
+		}
+		for _, p := range points {
+			if p.tenant != orgEnv || p.timestamp < start || p.timestamp >= end {
+				continue
+			}
+			key := ""
+			if groupBy != "" {
+				key = p.fields[groupBy]
+			}
+			g, exists := counts[key]
+			if !exists {
+				g = &queryGroup{Key: key}
+				counts[key] = g
+				sketches[key] = newLatencySketch()
+			}
+			g.RequestCount++
+			if p.error {
+				g.ErrorCount++
+			}
+			if p.latency >= 0 {
+				sketches[key].add(p.latency)
+			}
+		}
+	}
+	queryMinutesLock.RUnlock()
+
+	groups := make([]queryGroup, 0, len(counts))
+	for key, g := range counts {
+		g.Latency = map[string]int64{}
+		for _, name := range []string{"p50", "p95", "p99"} {
+			if sketches[key].Count > 0 {
+				g.Latency[name] = int64(math.Round(
+					sketches[key].quantile(sketchQuantiles[name])))
+			}
+		}
+		groups = append(groups, *g)
+	}
+	// busiest groups first
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].RequestCount != groups[j].RequestCount {
+			return groups[i].RequestCount > groups[j].RequestCount
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+func queryAnalytics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	window := int64(config.GetInt(analyticsQueryWindow))
+	if window <= 0 {
+		writeError(w, http.StatusNotFound, "NOT_FOUND",
+			"Local query is not enabled")
+		return
+	}
+
+	params := r.URL.Query()
+	org, env := params.Get("org"), params.Get("env")
+	if org == "" || env == "" {
+		writeError(w, http.StatusBadRequest, "MISSING_FIELD",
+			"org and env are required")
+		return
+	}
+	orgEnv := getKeyForOrgEnvCache(org, env)
+	if !authorizedForScope(w, r, orgEnv) {
+		return
+	}
+
+	groupBy := params.Get("group_by")
+	if groupBy != "" && !queryGroupByFields[groupBy] {
+		writeError(w, http.StatusBadRequest, "BAD_DATA",
+			"group_by should be apiproxy, response_status_code or client_id")
+		return
+	}
+
+	// range is in unix seconds and defaults to the query window
+	// including records of the current second
+	end := time.Now().Unix() + 1
+	start := end - window
+	var err error
+	if s := params.Get("end"); s != "" {
+		if end, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "BAD_DATA",
+				"end should be a unix timestamp in seconds")
+			return
+		}
+		start = end - window
+	}
+	if s := params.Get("start"); s != "" {
+		if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "BAD_DATA",
+				"start should be a unix timestamp in seconds")
+			return
+		}
+	}
+	if start >= end {
+		writeError(w, http.StatusBadRequest, "BAD_DATA",
+			"start should be before end")
+		return
+	}
+
+	writeJson(w, queryResult{
+		Org:     org,
+		Env:     env,
+		Start:   start,
+		End:     end,
+		GroupBy: groupBy,
+		Groups:  queryAggregates(orgEnv, start*1000, end*1000, groupBy),
+	})
+}
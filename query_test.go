@@ -0,0 +1,144 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test local query", func() {
+	queryTenant := tenant{Org: "queryorg", Env: "testenv"}
+
+	getRecord := func(start time.Time, latency int64, proxy, status string) interface{} {
+		ts := start.UnixNano() / int64(time.Millisecond)
+		return map[string]interface{}{
+			"apiproxy":                        proxy,
+			"client_id":                       "testapikey",
+			"response_status_code":            json.Number(status),
+			"client_received_start_timestamp": json.Number(strconv.FormatInt(ts, 10)),
+			"client_sent_end_timestamp":       json.Number(strconv.FormatInt(ts+latency, 10)),
+		}
+	}
+
+	BeforeEach(func() {
+		config.Set(analyticsQueryWindow, 900)
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsQueryWindow, analyticsQueryWindowDefault)
+		queryMinutesLock.Lock()
+		queryMinutes = make(map[int64][]queryPoint)
+		queryPointCount = 0
+		queryMinutesLock.Unlock()
+	})
+
+	It("should aggregate recent records grouped by a field", func() {
+		now := time.Now()
+		addToQueryStore(queryTenant, []interface{}{
+			getRecord(now, 10, "proxy1", "200"),
+			getRecord(now, 20, "proxy1", "200"),
+			getRecord(now, 30, "proxy1", "503"),
+			getRecord(now, 100, "proxy2", "404"),
+			// outside of the query window
+			getRecord(now.Add(-time.Hour), 10, "proxy1", "200"),
+		})
+		addToQueryStore(tenant{Org: "otherorg", Env: "testenv"}, []interface{}{
+			getRecord(now, 10, "proxy1", "200"),
+		})
+
+		res, body := makeQueryRequest(url.Values{"org": {"queryorg"},
+			"env": {"testenv"}, "group_by": {"apiproxy"}})
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		var result queryResult
+		Expect(json.Unmarshal(body, &result)).To(Succeed())
+		Expect(result.GroupBy).To(Equal("apiproxy"))
+		Expect(result.Groups).To(HaveLen(2))
+
+		Expect(result.Groups[0].Key).To(Equal("proxy1"))
+		Expect(result.Groups[0].RequestCount).To(Equal(int64(3)))
+		Expect(result.Groups[0].ErrorCount).To(Equal(int64(1)))
+		Expect(result.Groups[0].Latency["p50"]).To(Equal(int64(20)))
+		Expect(result.Groups[0].Latency["p99"]).To(Equal(int64(30)))
+
+		Expect(result.Groups[1].Key).To(Equal("proxy2"))
+		Expect(result.Groups[1].ErrorCount).To(Equal(int64(1)))
+
+		By("without grouping")
+		res, body = makeQueryRequest(url.Values{"org": {"queryorg"}, "env": {"testenv"}})
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(body, &result)).To(Succeed())
+		Expect(result.Groups).To(HaveLen(1))
+		Expect(result.Groups[0].RequestCount).To(Equal(int64(4)))
+
+		By("time range")
+		end := now.Add(-30 * time.Minute).Unix()
+		res, body = makeQueryRequest(url.Values{"org": {"queryorg"}, "env": {"testenv"},
+			"start": {strconv.FormatInt(end-3600, 10)}, "end": {strconv.FormatInt(end, 10)}})
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(body, &result)).To(Succeed())
+		Expect(result.Groups).To(BeEmpty())
+	})
+
+	It("should drop oldest minutes beyond max records", func() {
+		now := time.Now()
+		addToQueryStore(queryTenant, []interface{}{
+			getRecord(now.Add(-2*time.Minute), 10, "proxy1", "200"),
+			getRecord(now, 10, "proxy1", "200"),
+		})
+		queryMinutesLock.Lock()
+		pruneQueryStore(now, 900, 1)
+		Expect(queryPointCount).To(Equal(1))
+		Expect(queryMinutes).To(HaveLen(1))
+		queryMinutesLock.Unlock()
+	})
+
+	It("should reject invalid queries", func() {
+		res, _ := makeQueryRequest(url.Values{"org": {"queryorg"}})
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+		res, _ = makeQueryRequest(url.Values{"org": {"queryorg"},
+			"env": {"testenv"}, "group_by": {"developer"}})
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+		res, _ = makeQueryRequest(url.Values{"org": {"queryorg"},
+			"env": {"testenv"}, "start": {"100"}, "end": {"50"}})
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+		config.Set(analyticsQueryWindow, 0)
+		res, _ = makeQueryRequest(url.Values{"org": {"queryorg"}, "env": {"testenv"}})
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
+
+func makeQueryRequest(params url.Values) (*http.Response, []byte) {
+	uri, err := url.Parse(testServer.URL)
+	Expect(err).ShouldNot(HaveOccurred())
+	uri.Path = analyticsBasePath + "/query"
+	uri.RawQuery = params.Encode()
+
+	res, err := client.Get(uri.String())
+	Expect(err).ShouldNot(HaveOccurred())
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res, body
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Implements token bucket rate limiting of analytics records per org~env and
+per bundle scope uuid. A batch always counts towards the limit of its
+org~env so that a tenant has the same limit whether the bundle scope uuid
+or org/env is used, and also towards the limit of its scope uuid if one was
+used. Each key has one bucket for records/sec and one for bytes/sec.
+Limiters of keys which have not sent any batch for the idle timeout are
+evicted, their counters are kept for the admin API.
+*/
+
+// Limiters idle longer than this are evicted, by then their buckets are full
+// again unless a batch much bigger than the burst put them into debt
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// Map from org~env or scope uuid to its rate limiter
+var rateLimiters = make(map[string]*tenantRateLimiter)
+
+// Map from org~env or scope uuid to its counters, which are not evicted
+var rateLimitCountersByKey = make(map[string]*rateLimitCounters)
+
+// Lock for rateLimiters and rateLimitCountersByKey maps and their values
+var rateLimitersLock = sync.Mutex{}
+
+// Time when idle limiters were last evicted
+var rateLimitersPruned time.Time
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type tenantRateLimiter struct {
+	records  tokenBucket
+	bytes    tokenBucket
+	lastUsed time.Time
+}
+
+// Counters exposed to operators via the admin API
+type rateLimitCounters struct {
+	// org~env or scope uuid
+	Tenant          string `json:"tenant"`
+	AcceptedBatches int64  `json:"acceptedBatches"`
+	AcceptedRecords int64  `json:"acceptedRecords"`
+	AcceptedBytes   int64  `json:"acceptedBytes"`
+	RejectedBatches int64  `json:"rejectedBatches"`
+	RejectedRecords int64  `json:"rejectedRecords"`
+	RejectedBytes   int64  `json:"rejectedBytes"`
+}
+
+// Wraps request body to count the number of bytes read
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Refill tokens based on time elapsed since last refill
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst,
+			b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// Returns the time to wait before n tokens are available. If bucket is full
+// then a batch bigger than the burst is allowed and the bucket goes into
+// debt, otherwise such a batch could never be accepted.
+func (b *tokenBucket) wait(n, rate, burst float64) time.Duration {
+	if b.tokens >= n || b.tokens >= burst {
+		return 0
+	}
+	need := math.Min(n, burst) - b.tokens
+	return time.Duration(need / rate * float64(time.Second))
+}
+
+/*
+Checks if a batch of records from given tenant is within the configured limits.
+Limits are disabled when configured records/sec or bytes/sec are 0.
+Returns if the batch is allowed and if not, the time to wait before retrying.
+*/
+func checkRateLimit(tenantKey string, numRecords, numBytes int64) (bool, time.Duration) {
+	allowed, wait, _ := checkRateLimits([]string{tenantKey}, numRecords, numBytes)
+	return allowed, wait
+}
+
+// Checks the batch against the limits of each key and takes tokens only if
+// all of them allow it. Returns the key whose limit was exceeded if any.
+func checkRateLimits(keys []string, numRecords, numBytes int64) (bool, time.Duration, string) {
+	recordsRate := float64(config.GetInt(analyticsRateLimitRecords))
+	bytesRate := float64(config.GetInt(analyticsRateLimitBytes))
+	burstSeconds := float64(config.GetInt(analyticsRateLimitBurst))
+	if recordsRate <= 0 && bytesRate <= 0 {
+		return true, 0, ""
+	}
+
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+
+	now := time.Now()
+	if now.Sub(rateLimitersPruned) > time.Minute {
+		pruneRateLimiters(now)
+	}
+	limiters := make([]*tenantRateLimiter, len(keys))
+	var wait time.Duration
+	var exceeded string
+	for i, key := range keys {
+		limiter, exists := rateLimiters[key]
+		if !exists {
+			limiter = &tenantRateLimiter{}
+			rateLimiters[key] = limiter
+		}
+		limiter.lastUsed = now
+		limiters[i] = limiter
+
+		var keyWait time.Duration
+		if recordsRate > 0 {
+			limiter.records.refill(now, recordsRate, recordsRate*burstSeconds)
+			keyWait = limiter.records.wait(float64(numRecords),
+				recordsRate, recordsRate*burstSeconds)
+		}
+		if bytesRate > 0 {
+			limiter.bytes.refill(now, bytesRate, bytesRate*burstSeconds)
+			bytesWait := limiter.bytes.wait(float64(numBytes),
+				bytesRate, bytesRate*burstSeconds)
+			if bytesWait > keyWait {
+				keyWait = bytesWait
+			}
+		}
+		if keyWait > wait {
+			wait, exceeded = keyWait, key
+		}
+	}
+
+	if wait > 0 {
+		for _, key := range keys {
+			counters := getCountersForKey(key)
+			counters.RejectedBatches++
+			counters.RejectedRecords += numRecords
+			counters.RejectedBytes += numBytes
+		}
+		return false, wait, exceeded
+	}
+
+	// Tokens are taken only when all limits allow the batch
+	for i, key := range keys {
+		if recordsRate > 0 {
+			limiters[i].records.tokens -= float64(numRecords)
+		}
+		if bytesRate > 0 {
+			limiters[i].bytes.tokens -= float64(numBytes)
+		}
+		counters := getCountersForKey(key)
+		counters.AcceptedBatches++
+		counters.AcceptedRecords += numRecords
+		counters.AcceptedBytes += numBytes
+	}
+	return true, 0, ""
+}
+
+// Returns counters of the key, rateLimitersLock should be held
+func getCountersForKey(key string) *rateLimitCounters {
+	counters, exists := rateLimitCountersByKey[key]
+	if !exists {
+		counters = &rateLimitCounters{Tenant: key}
+		rateLimitCountersByKey[key] = counters
+	}
+	return counters
+}
+
+// Evict limiters which are idle, rateLimitersLock should be held.
+// Counters are kept so that the admin API has their history.
+func pruneRateLimiters(now time.Time) {
+	for tenantKey, limiter := range rateLimiters {
+		if now.Sub(limiter.lastUsed) > rateLimiterIdleTimeout {
+			delete(rateLimiters, tenantKey)
+		}
+	}
+	rateLimitersPruned = now
+}
+
+// Returns number of records in the payload without validating them
+func getRecordCount(raw map[string]interface{}) int64 {
+	records, isArray := raw["records"].([]interface{})
+	if !isArray {
+		return 0
+	}
+	return int64(len(records))
+}
+
+// Checks rate limits of the org~env and scope uuid if any and writes error response
+// if the batch is rejected. Returns true if the request can be processed further.
+func allowedByRateLimit(w http.ResponseWriter, keys []string,
+	raw map[string]interface{}, body *countingReader) bool {
+	allowed, wait, exceeded := checkRateLimits(keys, getRecordCount(raw), body.count)
+	if !allowed {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusTooManyRequests, "RATE_LIMITED",
+			"Rate limit exceeded for tenant: "+exceeded)
+	}
+	return allowed
+}
+
+func getRateLimitCounters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	rateLimitersLock.Lock()
+	counters := make([]rateLimitCounters, 0, len(rateLimitCountersByKey))
+	for _, c := range rateLimitCountersByKey {
+		counters = append(counters, *c)
+	}
+	rateLimitersLock.Unlock()
+
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].Tenant < counters[j].Tenant
+	})
+
+	bytes, err := json.Marshal(counters)
+	if err != nil {
+		log.Errorf("unable to marshal rate limit counters: %v", err)
+		writeError(w, http.StatusInternalServerError,
+			"INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test checkRateLimit()", func() {
+	AfterEach(func() {
+		config.Set(analyticsRateLimitRecords, 0)
+		config.Set(analyticsRateLimitBytes, 0)
+		rateLimitersLock.Lock()
+		rateLimiters = make(map[string]*tenantRateLimiter)
+		rateLimitCountersByKey = make(map[string]*rateLimitCounters)
+		rateLimitersLock.Unlock()
+	})
+
+	Context("rate limit disabled", func() {
+		It("should allow all batches", func() {
+			for i := 0; i < 10; i++ {
+				allowed, _ := checkRateLimit("testorg~testenv", 1000, 100000)
+				Expect(allowed).To(BeTrue())
+			}
+		})
+	})
+
+	Context("records per second limit", func() {
+		It("should reject batches once burst is used", func() {
+			config.Set(analyticsRateLimitRecords, 10)
+			config.Set(analyticsRateLimitBurst, 1)
+
+			allowed, _ := checkRateLimit("testorg~testenv", 6, 100)
+			Expect(allowed).To(BeTrue())
+
+			allowed, wait := checkRateLimit("testorg~testenv", 6, 100)
+			Expect(allowed).To(BeFalse())
+			Expect(wait).To(BeNumerically(">", 0))
+
+			By("other tenants are not affected")
+			allowed, _ = checkRateLimit("testid", 6, 100)
+			Expect(allowed).To(BeTrue())
+
+			By("tokens are refilled over time")
+			time.Sleep(200 * time.Millisecond)
+			allowed, _ = checkRateLimit("testorg~testenv", 6, 100)
+			Expect(allowed).To(BeTrue())
+
+			rateLimitersLock.Lock()
+			counters := *rateLimitCountersByKey["testorg~testenv"]
+			rateLimitersLock.Unlock()
+			Expect(counters.AcceptedBatches).To(Equal(int64(2)))
+			Expect(counters.AcceptedRecords).To(Equal(int64(12)))
+			Expect(counters.RejectedBatches).To(Equal(int64(1)))
+			Expect(counters.RejectedRecords).To(Equal(int64(6)))
+		})
+
+		It("should allow a batch bigger than burst if bucket is full", func() {
+			config.Set(analyticsRateLimitRecords, 10)
+			config.Set(analyticsRateLimitBurst, 1)
+
+			allowed, _ := checkRateLimit("testorg~testenv", 50, 100)
+			Expect(allowed).To(BeTrue())
+
+			allowed, _ = checkRateLimit("testorg~testenv", 1, 100)
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("org~env and scope limits", func() {
+		It("should take tokens only if all limits allow the batch", func() {
+			config.Set(analyticsRateLimitRecords, 10)
+			config.Set(analyticsRateLimitBurst, 1)
+
+			allowed, _, _ := checkRateLimits([]string{"scope1", "testorg~testenv"}, 6, 100)
+			Expect(allowed).To(BeTrue())
+
+			By("other scope of the same org~env is limited by the org~env")
+			allowed, _, exceeded := checkRateLimits([]string{"scope2", "testorg~testenv"}, 6, 100)
+			Expect(allowed).To(BeFalse())
+			Expect(exceeded).To(Equal("testorg~testenv"))
+
+			By("scope is limited on its own")
+			allowed, _, exceeded = checkRateLimits([]string{"scope1", "testorg~otherenv"}, 6, 100)
+			Expect(allowed).To(BeFalse())
+			Expect(exceeded).To(Equal("scope1"))
+
+			rateLimitersLock.Lock()
+			scope2 := *rateLimitCountersByKey["scope2"]
+			otherEnv := rateLimiters["testorg~otherenv"].records.tokens
+			rateLimitersLock.Unlock()
+			Expect(scope2.RejectedBatches).To(Equal(int64(1)))
+			Expect(otherEnv).To(BeNumerically("==", 10))
+		})
+	})
+
+	Context("bytes per second limit", func() {
+		It("should reject batches once burst is used", func() {
+			config.Set(analyticsRateLimitBytes, 1000)
+			config.Set(analyticsRateLimitBurst, 1)
+
+			allowed, _ := checkRateLimit("testorg~testenv", 1, 800)
+			Expect(allowed).To(BeTrue())
+
+			allowed, _ = checkRateLimit("testorg~testenv", 1, 800)
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("idle limiters", func() {
+		It("should be evicted after idle timeout", func() {
+			config.Set(analyticsRateLimitRecords, 10)
+
+			checkRateLimit("testorg~testenv", 1, 100)
+			checkRateLimit("testorg~otherenv", 1, 100)
+			rateLimitersLock.Lock()
+			rateLimiters["testorg~testenv"].lastUsed =
+				time.Now().Add(-rateLimiterIdleTimeout - time.Second)
+			pruneRateLimiters(time.Now())
+			_, idleExists := rateLimiters["testorg~testenv"]
+			_, activeExists := rateLimiters["testorg~otherenv"]
+			_, countersExist := rateLimitCountersByKey["testorg~testenv"]
+			rateLimitersLock.Unlock()
+			Expect(idleExists).To(BeFalse())
+			Expect(activeExists).To(BeTrue())
+			Expect(countersExist).To(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("POST /analytics with rate limit", func() {
+	AfterEach(func() {
+		config.Set(analyticsRateLimitRecords, 0)
+		config.Set(analyticsRateLimitBurst, analyticsRateLimitBurstDefault)
+		rateLimitersLock.Lock()
+		rateLimiters = make(map[string]*tenantRateLimiter)
+		rateLimitCountersByKey = make(map[string]*rateLimitCounters)
+		rateLimitersLock.Unlock()
+	})
+
+	It("should return too many requests once limit is exceeded", func() {
+		config.Set(analyticsRateLimitRecords, 1)
+		config.Set(analyticsRateLimitBurst, 1)
+
+		now := time.Now().Unix() * 1000
+		var payload = []byte(`{
+				"organization":"testorg",
+				"environment":"testenv",
+				"records":[{
+					"response_status_code": 200,
+					"client_id":"testapikey",
+					"client_received_start_timestamp":` + fmt.Sprintf("%v", now) + `,
+					"client_received_end_timestamp":` + fmt.Sprintf("%v", now+60000) + `
+				}]
+			}`)
+		res, _ := makeRequest(getRequest(payload))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		res, e := makeRequest(getRequest(payload))
+		Expect(res.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(e.ErrorCode).To(Equal("RATE_LIMITED"))
+		Expect(res.Header.Get("Retry-After")).To(Equal("1"))
+	})
+
+	It("should share the limit of a tenant between scope and org/env", func() {
+		config.Set(analyticsRateLimitRecords, 1)
+		config.Set(analyticsRateLimitBurst, 1)
+
+		now := time.Now().Unix() * 1000
+		var payload = []byte(`{
+				"organization":"testorg",
+				"environment":"testenv",
+				"records":[{
+					"response_status_code": 200,
+					"client_id":"testapikey",
+					"client_received_start_timestamp":` + fmt.Sprintf("%v", now) + `,
+					"client_received_end_timestamp":` + fmt.Sprintf("%v", now+60000) + `
+				}]
+			}`)
+		res, _ := makeRequest(getRequestWithScope("testid", payload))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		res, e := makeRequest(getRequest(payload))
+		Expect(res.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(e.ErrorCode).To(Equal("RATE_LIMITED"))
+	})
+})
@@ -0,0 +1,313 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Records of each bucket are pre-aggregated per minute, org, env, apiproxy
+and response status code. Rollups are written to a separate file in the
+directory when the bucket is closed and uploaded under their own relative
+path so that dashboards do not need to process raw records.
+Latencies are kept in sketches with log sized bins so that percentiles
+have a bounded relative error and sketches can be merged downstream.
+*/
+
+const (
+	// Format: <4DigitRandomHex>_<TSStart>.<TSEnd>_<APIDINSTANCEUUID>_rollup.json.gz
+	rollupFileSuffix = "_rollup.json.gz"
+
+	// Relative accuracy of latency percentiles is (gamma - 1) / (gamma + 1) i.e. 1%
+	sketchGamma = 1.0202
+)
+
+var sketchQuantiles = map[string]float64{"p50": 0.5, "p90": 0.9, "p95": 0.95, "p99": 0.99}
+
+type rollupKey struct {
+	minute     int64
+	org        string
+	env        string
+	apiproxy   string
+	statusCode string
+}
+
+type rollup struct {
+	rows map[rollupKey]*rollupRow
+}
+
+type rollupRow struct {
+	Minute             string         `json:"minute"`
+	Organization       string         `json:"organization"`
+	Environment        string         `json:"environment"`
+	Apiproxy           string         `json:"apiproxy"`
+	ResponseStatusCode string         `json:"response_status_code"`
+	Count              int64          `json:"count"`
+	ErrorCount         int64          `json:"error_count"`
+	WeightedCount      float64        `json:"weighted_count"`
+	TotalLatency       *latencySketch `json:"total_latency"`
+	TargetLatency      *latencySketch `json:"target_latency"`
+}
+
+// Sketch of latencies in ms
+type latencySketch struct {
+	Count       int64            `json:"count"`
+	Sum         float64          `json:"sum"`
+	Min         float64          `json:"min"`
+	Max         float64          `json:"max"`
+	Percentiles map[string]int64 `json:"percentiles"`
+	Gamma       float64          `json:"gamma"`
+	Zero        int64            `json:"zero"`
+	// bin i has values in (gamma^(i-1), gamma^i]
+	Bins map[int]int64 `json:"bins"`
+}
+
+func isRollupFile(fileName string) bool {
+	return strings.HasSuffix(fileName, rollupFileSuffix)
+}
+
+// Returns nil if rollups are disabled
+func newRollup() *rollup {
+	if !config.GetBool(analyticsRollups) {
+		return nil
+	}
+	return &rollup{rows: make(map[rollupKey]*rollupRow)}
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{Gamma: sketchGamma, Bins: make(map[int]int64)}
+}
+
+func (s *latencySketch) add(v float64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+	if v <= 0 {
+		s.Zero++
+		return
+	}
+	s.Bins[int(math.Ceil(math.Log(v)/math.Log(s.Gamma)))]++
+}
+
+func (s *latencySketch) quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(s.Count)))
+	if rank <= s.Zero {
+		return 0
+	}
+	indexes := make([]int, 0, len(s.Bins))
+	for i := range s.Bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	seen := s.Zero
+	for _, i := range indexes {
+		seen += s.Bins[i]
+		if seen >= rank {
+			// middle of the bin which is within relative accuracy
+			v := 2 * math.Pow(s.Gamma, float64(i)) / (s.Gamma + 1)
+			return math.Min(math.Max(v, s.Min), s.Max)
+		}
+	}
+	return s.Max
+}
+
+// Aggregate a record which has been written to the bucket
+func (r *rollup) add(record map[string]interface{}) {
+	start, ok := getInt64Field(record, "client_received_start_timestamp")
+	if !ok {
+		return
+	}
+	key := rollupKey{
+		minute:     start / 60000 * 60000,
+		org:        getStringField(record, "organization"),
+		env:        getStringField(record, "environment"),
+		apiproxy:   getStringField(record, "apiproxy"),
+		statusCode: getStringField(record, "response_status_code"),
+	}
+	row, exists := r.rows[key]
+	if !exists {
+		row = &rollupRow{
+			Minute: time.Unix(key.minute/1000, 0).UTC().
+				Format(time.RFC3339),
+			Organization:       key.org,
+			Environment:        key.env,
+			Apiproxy:           key.apiproxy,
+			ResponseStatusCode: key.statusCode,
+			TotalLatency:       newLatencySketch(),
+			TargetLatency:      newLatencySketch(),
+		}
+		r.rows[key] = row
+	}
+
+	row.Count++
+	if status, ok := getInt64Field(record, "response_status_code"); ok && status >= 400 {
+		row.ErrorCount++
+	}
+	// sampled records represent 1/sample_rate records
+	weight := 1.0
+	if rate, ok := record[sampleRateField].(float64); ok && rate > 0 {
+		weight = 1 / rate
+	}
+	row.WeightedCount += weight
+
+	if end, ok := getInt64Field(record, "client_sent_end_timestamp"); ok && end >= start {
+		row.TotalLatency.add(float64(end - start))
+	}
+	targetStart, ok1 := getInt64Field(record, "target_sent_start_timestamp")
+	targetEnd, ok2 := getInt64Field(record, "target_received_end_timestamp")
+	if ok1 && ok2 && targetEnd >= targetStart {
+		row.TargetLatency.add(float64(targetEnd - targetStart))
+	}
+}
+
+// Rows sorted by minute and key so that the file is deterministic
+func (r *rollup) getRows() []interface{} {
+	keys := make([]rollupKey, 0, len(r.rows))
+	for k := range r.rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.minute != b.minute {
+			return a.minute < b.minute
+		}
+		return fmt.Sprint(a) < fmt.Sprint(b)
+	})
+
+	rows := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		row := r.rows[k]
+		for _, s := range []*latencySketch{row.TotalLatency, row.TargetLatency} {
+			s.Percentiles = make(map[string]int64)
+			for name, q := range sketchQuantiles {
+				s.Percentiles[name] = int64(math.Round(s.quantile(q)))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Write rollup file in the directory before it is moved to staging
+func writeRollupFile(dirPath string, r *rollup) error {
+	if r == nil || len(r.rows) == 0 {
+		return nil
+	}
+	start, end, err := getDirInterval(dirPath)
+	if err != nil {
+		return err
+	}
+	fileName := getIntervalFileName(start, end, rollupFileSuffix)
+	fw, err := createGzipFile(filepath.Join(dirPath, fileName))
+	if err != nil {
+		return err
+	}
+	writeGzipFile(fw, r.getRows())
+	closeGzipFile(fw)
+	return nil
+}
+
+// Compute rollup from data files eg. when a directory is recovered after
+// a crash since rollup of an open bucket is only kept in memory
+func computeRollupFromFiles(dirPath string) (*rollup, error) {
+	r := newRollup()
+	if r == nil {
+		return nil, nil
+	}
+	files, _ := ioutil.ReadDir(dirPath)
+	for _, file := range files {
+		if file.IsDir() || !isDataFile(file.Name()) || isRollupFile(file.Name()) {
+			continue
+		}
+		if err := addFileToRollup(r, filepath.Join(dirPath, file.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func addFileToRollup(r *rollup, completeFilePath string) error {
+	file, err := os.Open(completeFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := newFileReader(file)
+	if err != nil {
+		return err
+	}
+	gzReader, err := gzip.NewReader(bufio.NewReader(reader))
+	if err != nil {
+		return err
+	}
+	defer gzReader.Close()
+
+	scanner := bufio.NewScanner(gzReader)
+	scanner.Buffer(nil, 10*1024*1024)
+	for scanner.Scan() {
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+		var record map[string]interface{}
+		if decoder.Decode(&record) == nil {
+			if rate, ok := record[sampleRateField].(json.Number); ok {
+				record[sampleRateField], _ = rate.Float64()
+			}
+			r.add(record)
+		}
+	}
+	return scanner.Err()
+}
+
+func getInt64Field(record map[string]interface{}, field string) (int64, bool) {
+	switch v := record[field].(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case float64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func getStringField(record map[string]interface{}, field string) string {
+	if v, exists := record[field]; exists && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
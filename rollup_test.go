@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test rollups", func() {
+	var dirPath string
+
+	getRecord := func(start int64, latency int64, status string) map[string]interface{} {
+		return map[string]interface{}{
+			"organization":                    "testorg",
+			"environment":                     "testenv",
+			"apiproxy":                        "testproxy",
+			"response_status_code":            json.Number(status),
+			"client_received_start_timestamp": json.Number(strconv.FormatInt(start, 10)),
+			"client_sent_end_timestamp":       json.Number(strconv.FormatInt(start+latency, 10)),
+		}
+	}
+
+	BeforeEach(func() {
+		config.Set(analyticsRollups, true)
+		dirPath = filepath.Join(testTempDir, "rollup", "testorg~testenv~20170130155400")
+		Expect(os.MkdirAll(dirPath, os.ModePerm)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsRollups, false)
+		os.RemoveAll(filepath.Join(testTempDir, "rollup"))
+	})
+
+	It("should estimate percentiles within relative accuracy", func() {
+		s := newLatencySketch()
+		for i := 1; i <= 1000; i++ {
+			s.add(float64(i))
+		}
+		Expect(s.Count).To(Equal(int64(1000)))
+		Expect(s.Min).To(Equal(1.0))
+		Expect(s.Max).To(Equal(1000.0))
+		Expect(s.quantile(0.5)).To(BeNumerically("~", 500, 5))
+		Expect(s.quantile(0.99)).To(BeNumerically("~", 990, 10))
+
+		By("zero latencies")
+		s = newLatencySketch()
+		s.add(0)
+		s.add(0)
+		s.add(10)
+		Expect(s.quantile(0.5)).To(Equal(0.0))
+		Expect(s.quantile(1)).To(BeNumerically("~", 10, 0.1))
+	})
+
+	It("should aggregate records per minute, apiproxy and status code", func() {
+		r := newRollup()
+		// 2017-01-30T15:54:00Z
+		minute := int64(1485791640000)
+		r.add(getRecord(minute, 10, "200"))
+		r.add(getRecord(minute+59000, 30, "200"))
+		r.add(getRecord(minute+1000, 20, "500"))
+		r.add(getRecord(minute+60000, 40, "200"))
+
+		sampled := getRecord(minute+2000, 20, "200")
+		sampled[sampleRateField] = 0.25
+		r.add(sampled)
+
+		By("record without timestamp is ignored")
+		r.add(map[string]interface{}{"organization": "testorg"})
+
+		rows := r.getRows()
+		Expect(rows).To(HaveLen(3))
+
+		row := rows[0].(*rollupRow)
+		Expect(row.Minute).To(Equal("2017-01-30T15:54:00Z"))
+		Expect(row.ResponseStatusCode).To(Equal("200"))
+		Expect(row.Count).To(Equal(int64(3)))
+		Expect(row.ErrorCount).To(Equal(int64(0)))
+		Expect(row.WeightedCount).To(Equal(6.0))
+		Expect(row.TotalLatency.Sum).To(Equal(60.0))
+		Expect(row.TotalLatency.Percentiles["p50"]).To(Equal(int64(20)))
+		Expect(row.TargetLatency.Count).To(Equal(int64(0)))
+
+		row = rows[1].(*rollupRow)
+		Expect(row.ResponseStatusCode).To(Equal("500"))
+		Expect(row.ErrorCount).To(Equal(int64(1)))
+
+		row = rows[2].(*rollupRow)
+		Expect(row.Minute).To(Equal("2017-01-30T15:55:00Z"))
+	})
+
+	It("should write rollup file and upload it under its own prefix", func() {
+		fileName := "5be1_20170130155400.20170130155600_abcd_writer_0.txt.gz"
+		fw, err := createGzipFile(filepath.Join(dirPath, fileName))
+		Expect(err).ShouldNot(HaveOccurred())
+		records := []interface{}{getRecord(1485791640000, 10, "200")}
+		writeGzipFile(fw, records)
+		closeGzipFile(fw)
+
+		By("recomputing rollup from data files")
+		r, err := computeRollupFromFiles(dirPath)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(writeRollupFile(dirPath, r)).To(Succeed())
+
+		files, _ := ioutil.ReadDir(dirPath)
+		Expect(files).To(HaveLen(2))
+		var rollupFile string
+		for _, file := range files {
+			if isRollupFile(file.Name()) {
+				rollupFile = file.Name()
+			}
+		}
+		Expect(rollupFile).To(ContainSubstring(
+			"_20170130155400.20170130155600_abcdefgh-ijkl-mnop-qrst-uvwxyz123456_rollup.json.gz"))
+
+		r, err = computeRollupFromFiles(dirPath)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(r.rows).To(HaveLen(1))
+
+		Expect(getRelativeFilePath("date=2017-01-30/time=15-54-00", rollupFile)).
+			To(Equal("rollups/date=2017-01-30/time=15-54-00/" + rollupFile))
+		Expect(getRelativeFilePath("date=2017-01-30/time=15-54-00", fileName)).
+			To(Equal("date=2017-01-30/time=15-54-00/" + fileName))
+
+		stagingPath := filepath.Join(localAnalyticsStagingDir, "testorg~testenv~20170130160100")
+		Expect(os.Rename(dirPath, stagingPath)).To(Succeed())
+		defer os.RemoveAll(stagingPath)
+
+		dir, _ := os.Stat(stagingPath)
+		Expect(uploadDir(dir)).To(BeTrue())
+		files, _ = ioutil.ReadDir(stagingPath)
+		Expect(files).To(BeEmpty())
+	})
+
+	It("should not write rollups if disabled", func() {
+		config.Set(analyticsRollups, false)
+		Expect(newRollup()).To(BeNil())
+		Expect(writeRollupFile(dirPath, nil)).To(Succeed())
+		files, _ := ioutil.ReadDir(dirPath)
+		Expect(files).To(BeEmpty())
+	})
+})
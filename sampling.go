@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Records are sampled after validation to reduce volume for high traffic
+tenants. Sample rate of a record is looked up in this order:
+org~env~apiproxy, org~env and then the global sample rate.
+Each kept record has a sample_rate field if its rate is less than 1 so
+that counts can be re-scaled i.e. each record represents 1/sample_rate
+records. A sample_rate field sent by the client is always dropped. Sampling is random unless a key field is configured, in which
+case all records with the same value of the field are either kept or
+dropped.
+*/
+
+const sampleRateField = "sample_rate"
+
+// Sample rates for org~env and org~env~apiproxy
+var sampleRates map[string]float64
+
+var sampleRatesLock = sync.RWMutex{}
+
+// Parse sample rates of the form "org~env=0.5,org~env~proxy=0.1"
+func initSampling() error {
+	global := config.GetFloat64(analyticsSampleRate)
+	if global < 0 || global > 1 {
+		return fmt.Errorf("%s should be between 0 and 1", analyticsSampleRate)
+	}
+
+	rates := make(map[string]float64)
+	for _, entry := range strings.Split(config.GetString(analyticsSampleRates), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid sample rate '%s'", entry)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("Sample rate for '%s' should be "+
+				"between 0 and 1", kv[0])
+		}
+		rates[strings.TrimSpace(kv[0])] = rate
+	}
+
+	sampleRatesLock.Lock()
+	sampleRates = rates
+	sampleRatesLock.Unlock()
+	if global < 1 || len(rates) > 0 {
+		log.Infof("Sampling records with global rate %v and %d "+
+			"tenant/apiproxy rates", global, len(rates))
+	}
+	return nil
+}
+
+func getSampleRate(tenant tenant, record map[string]interface{}) float64 {
+	orgEnv := getKeyForOrgEnvCache(tenant.Org, tenant.Env)
+
+	sampleRatesLock.RLock()
+	defer sampleRatesLock.RUnlock()
+	if apiproxy, ok := record["apiproxy"].(string); ok {
+		if rate, exists := sampleRates[orgEnv+"~"+apiproxy]; exists {
+			return rate
+		}
+	}
+	if rate, exists := sampleRates[orgEnv]; exists {
+		return rate
+	}
+	return config.GetFloat64(analyticsSampleRate)
+}
+
+// Returns true if the record should be kept and adds its sample rate
+func sampleRecord(tenant tenant, record map[string]interface{}) bool {
+	// sample rate sent by the client would re-scale counts
+	delete(record, sampleRateField)
+	rate := getSampleRate(tenant, record)
+	if rate >= 1 {
+		return true
+	}
+	if getSamplePoint(record) >= rate {
+		return false
+	}
+	record[sampleRateField] = rate
+	return true
+}
+
+// Returns a point in [0, 1) which is deterministic
+// if the record has the configured key field
+func getSamplePoint(record map[string]interface{}) float64 {
+	keyField := config.GetString(analyticsSampleKey)
+	if keyField != "" {
+		if value, exists := record[keyField]; exists && value != nil {
+			h := fnv.New64a()
+			h.Write([]byte(fmt.Sprint(value)))
+			return float64(h.Sum64()>>11) / math.Exp2(53)
+		}
+	}
+	return rand.Float64()
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test record sampling", func() {
+	testTenant := tenant{Org: "testorg", Env: "testenv"}
+
+	AfterEach(func() {
+		config.Set(analyticsSampleRate, analyticsSampleRateDefault)
+		config.Set(analyticsSampleRates, "")
+		config.Set(analyticsSampleKey, "")
+		Expect(initSampling()).To(Succeed())
+	})
+
+	It("should reject invalid sample rates", func() {
+		config.Set(analyticsSampleRate, 1.5)
+		Expect(initSampling()).ToNot(Succeed())
+
+		config.Set(analyticsSampleRate, 1.0)
+		config.Set(analyticsSampleRates, "testorg~testenv")
+		Expect(initSampling()).ToNot(Succeed())
+
+		config.Set(analyticsSampleRates, "testorg~testenv=-1")
+		Expect(initSampling()).ToNot(Succeed())
+	})
+
+	It("should use most specific sample rate", func() {
+		config.Set(analyticsSampleRate, 0.9)
+		config.Set(analyticsSampleRates, "testorg~testenv=0.5, testorg~testenv~weather=0.1")
+		Expect(initSampling()).To(Succeed())
+
+		Expect(getSampleRate(testTenant, map[string]interface{}{
+			"apiproxy": "weather"})).To(Equal(0.1))
+		Expect(getSampleRate(testTenant, map[string]interface{}{
+			"apiproxy": "other"})).To(Equal(0.5))
+		Expect(getSampleRate(tenant{Org: "o", Env: "e"},
+			map[string]interface{}{})).To(Equal(0.9))
+	})
+
+	It("should keep all records without sample rate by default", func() {
+		record := map[string]interface{}{"client_id": "a"}
+		Expect(sampleRecord(testTenant, record)).To(BeTrue())
+		Expect(record).ToNot(HaveKey(sampleRateField))
+	})
+
+	It("should drop sample rate sent by the client", func() {
+		record := map[string]interface{}{sampleRateField: 0.01}
+		Expect(sampleRecord(testTenant, record)).To(BeTrue())
+		Expect(record).ToNot(HaveKey(sampleRateField))
+
+		config.Set(analyticsSampleRate, 0.5)
+		config.Set(analyticsSampleKey, "client_id")
+		Expect(initSampling()).To(Succeed())
+		for _, clientId := range []string{"a", "b", "c", "d", "e", "f"} {
+			record = map[string]interface{}{"client_id": clientId, sampleRateField: 0.01}
+			if sampleRecord(testTenant, record) {
+				Expect(record[sampleRateField]).To(Equal(0.5))
+			} else {
+				Expect(record).ToNot(HaveKey(sampleRateField))
+			}
+		}
+	})
+
+	It("should drop all records with sample rate 0", func() {
+		config.Set(analyticsSampleRates, "testorg~testenv=0")
+		Expect(initSampling()).To(Succeed())
+		Expect(sampleRecord(testTenant, map[string]interface{}{})).To(BeFalse())
+	})
+
+	It("should sample roughly at the configured rate", func() {
+		config.Set(analyticsSampleRate, 0.25)
+		Expect(initSampling()).To(Succeed())
+
+		kept := 0
+		for i := 0; i < 10000; i++ {
+			record := map[string]interface{}{}
+			if sampleRecord(testTenant, record) {
+				Expect(record[sampleRateField]).To(Equal(0.25))
+				kept++
+			}
+		}
+		Expect(kept).To(BeNumerically("~", 2500, 300))
+	})
+
+	It("should sample deterministically on key field", func() {
+		config.Set(analyticsSampleRate, 0.5)
+		config.Set(analyticsSampleKey, "client_id")
+		Expect(initSampling()).To(Succeed())
+
+		kept := 0
+		for i := 0; i < 1000; i++ {
+			clientId := "client" + strconv.Itoa(i)
+			first := sampleRecord(testTenant, map[string]interface{}{"client_id": clientId})
+			for j := 0; j < 3; j++ {
+				Expect(sampleRecord(testTenant, map[string]interface{}{
+					"client_id": clientId})).To(Equal(first))
+			}
+			if first {
+				kept++
+			}
+		}
+		Expect(kept).To(BeNumerically("~", 500, 100))
+	})
+})
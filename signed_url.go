@@ -0,0 +1,204 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Signed URL's are cached till shortly before they expire so that a directory
+which failed to upload can be retried without requesting them again. A URL
+is discarded once its file is uploaded or if the datastore rejected it. If the
+UAP collection endpoint supports it, signed URL's for all files in a directory
+are requested in a single call and for each file the signed URL for the next
+file is fetched while the current file is being uploaded.
+*/
+
+type signedUrlEntry struct {
+	url       string
+	expiresAt time.Time
+}
+
+type signedUrlResult struct {
+	url string
+	err error
+}
+
+// Map from tenant and relative file path to signed URL
+var signedUrlCache = make(map[string]signedUrlEntry)
+
+// Lock for signedUrlCache since URL's are prefetched asynchronously
+var signedUrlCacheLock = sync.Mutex{}
+
+// Set once the UAP collection endpoint responded to a batch request
+// with a single URL, batches are not requested after that
+var signedUrlBatchUnsupported = false
+var signedUrlBatchLock = sync.Mutex{}
+
+func getKeyForSignedUrlCache(tenant, relativeFilePath string) string {
+	return tenant + "/" + relativeFilePath
+}
+
+// Cached URL's are not used during the last tenth of their
+// lifetime, up to this margin, so that they do not expire mid upload
+const signedUrlExpiryMargin = 30 * time.Second
+
+// Returns time till which signed URL can be used based on expires_in
+// (seconds) in the response or configured TTL if not present
+func getSignedUrlExpiry(body map[string]interface{}) time.Time {
+	ttl := time.Duration(config.GetInt(analyticsSignedUrlTTL)) * time.Second
+	if expiresIn, ok := body["expires_in"].(float64); ok && expiresIn > 0 {
+		ttl = time.Duration(expiresIn) * time.Second
+	}
+	margin := ttl / 10
+	if margin > signedUrlExpiryMargin {
+		margin = signedUrlExpiryMargin
+	}
+	return time.Now().Add(ttl - margin)
+}
+
+func cacheSignedUrl(tenant, relativeFilePath, url string, expiresAt time.Time) {
+	signedUrlCacheLock.Lock()
+	defer signedUrlCacheLock.Unlock()
+
+	// purge expired entries so that the cache does not keep growing
+	// with URL's for directories that were never retried
+	now := time.Now()
+	for key, entry := range signedUrlCache {
+		if now.After(entry.expiresAt) {
+			delete(signedUrlCache, key)
+		}
+	}
+	signedUrlCache[getKeyForSignedUrlCache(tenant, relativeFilePath)] =
+		signedUrlEntry{url: url, expiresAt: expiresAt}
+}
+
+func getCachedSignedUrl(tenant, relativeFilePath string) (string, bool) {
+	signedUrlCacheLock.Lock()
+	defer signedUrlCacheLock.Unlock()
+	entry, exists := signedUrlCache[getKeyForSignedUrlCache(tenant, relativeFilePath)]
+	if !exists || time.Now().After(entry.expiresAt) {
+		return "", false
+	}
+	return entry.url, true
+}
+
+// Remove signed URL once it has been used or is known to be invalid
+func invalidateSignedUrl(tenant, relativeFilePath string) {
+	signedUrlCacheLock.Lock()
+	delete(signedUrlCache, getKeyForSignedUrlCache(tenant, relativeFilePath))
+	signedUrlCacheLock.Unlock()
+}
+
+// Signed URL is kept for a retry of the upload unless
+// the file was uploaded or the datastore rejected the URL
+func releaseSignedUrl(tenant, relativeFilePath string, err error) {
+	if _, rejected := err.(signedUrlRejectedError); err == nil || rejected {
+		invalidateSignedUrl(tenant, relativeFilePath)
+	}
+}
+
+// Returns signed URL from cache or requests a new one from UAP
+func getSignedUrlWithCache(tenant, relativeFilePath string) (string, error) {
+	if url, exists := getCachedSignedUrl(tenant, relativeFilePath); exists {
+		return url, nil
+	}
+	return getSignedUrl(tenant, relativeFilePath)
+}
+
+// Fetch signed URL asynchronously so that it is available
+// by the time the file before it has been uploaded
+func prefetchSignedUrl(tenant, relativeFilePath string) chan signedUrlResult {
+	// buffered so that the go routine does not block
+	// if the upload is aborted before the result is read
+	result := make(chan signedUrlResult, 1)
+	go func() {
+		url, err := getSignedUrlWithCache(tenant, relativeFilePath)
+		result <- signedUrlResult{url: url, err: err}
+	}()
+	return result
+}
+
+/*
+Requests signed URL's for multiple files in a single call by passing
+relative_file_path multiple times. A server that supports it responds with
+{"urls": {"<relative_file_path>": "<signed url>", ...}, "expires_in": 900}.
+The URL's are cached and any files missing from the response are requested
+individually. Errors are only logged as the files are retried individually.
+A server that responds with a single URL does not support it, which is
+remembered till apid restarts so that it is not requested for every directory.
+*/
+func getSignedUrlsInBatch(tenant string, relativeFilePaths []string) {
+	if !config.GetBool(analyticsSignedUrlBatch) || len(relativeFilePaths) < 2 ||
+		isSignedUrlBatchUnsupported() {
+		return
+	}
+
+	var missing []string
+	for _, path := range relativeFilePaths {
+		if _, exists := getCachedSignedUrl(tenant, path); !exists {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) < 2 {
+		return
+	}
+
+	err := requestSignedUrls(tenant, missing)
+	if err != nil {
+		log.Debugf("Could not get signed URL's in batch, will "+
+			"request them for each file: %v", err)
+	}
+}
+
+func requestSignedUrls(tenant string, relativeFilePaths []string) error {
+	body, err := requestUapCollection(tenant, relativeFilePaths, nil)
+	if err != nil {
+		return err
+	}
+
+	urls, ok := body["urls"].(map[string]interface{})
+	if !ok {
+		setSignedUrlBatchUnsupported()
+		return fmt.Errorf("Batch of signed URL's is not supported")
+	}
+	expiresAt := getSignedUrlExpiry(body)
+	for path, url := range urls {
+		if u, ok := url.(string); ok && strings.TrimSpace(u) != "" {
+			cacheSignedUrl(tenant, path, u, expiresAt)
+		}
+	}
+	return nil
+}
+
+func isSignedUrlBatchUnsupported() bool {
+	signedUrlBatchLock.Lock()
+	defer signedUrlBatchLock.Unlock()
+	return signedUrlBatchUnsupported
+}
+
+func setSignedUrlBatchUnsupported() {
+	signedUrlBatchLock.Lock()
+	defer signedUrlBatchLock.Unlock()
+	if !signedUrlBatchUnsupported {
+		log.Infof("UAP collection endpoint does not support batch of " +
+			"signed URL's, they will be requested for each file")
+	}
+	signedUrlBatchUnsupported = true
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test signed url cache", func() {
+	It("should return cached url till it expires", func() {
+		tenant := "testorg~testenv"
+		path := "date=2016-01-01/time=22-45-05/a.txt.gz"
+
+		cacheSignedUrl(tenant, path, "http://signed", time.Now().Add(time.Minute))
+		url, exists := getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeTrue())
+		Expect(url).To(Equal("http://signed"))
+
+		invalidateSignedUrl(tenant, path)
+		_, exists = getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeFalse())
+
+		By("expired url")
+		cacheSignedUrl(tenant, path, "http://signed", time.Now().Add(-time.Second))
+		_, exists = getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeFalse())
+	})
+
+	It("should cache url returned by getSignedUrl()", func() {
+		tenant := "testorg~testenv"
+		path := "date=2016-01-01/time=22-45-05/b.txt.gz"
+
+		url, err := getSignedUrl(tenant, path)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cached, exists := getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeTrue())
+		Expect(cached).To(Equal(url))
+		invalidateSignedUrl(tenant, path)
+	})
+
+	It("should keep url for retry unless uploaded or rejected", func() {
+		tenant := "testorg~testenv"
+		path := "date=2016-01-01/time=22-45-05/e.txt.gz"
+		cacheSignedUrl(tenant, path, "http://signed", time.Now().Add(time.Minute))
+
+		releaseSignedUrl(tenant, path, errors.New("connection reset"))
+		_, exists := getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeTrue())
+
+		releaseSignedUrl(tenant, path, signedUrlRejectedError{status: "403 Forbidden"})
+		_, exists = getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeFalse())
+
+		cacheSignedUrl(tenant, path, "http://signed", time.Now().Add(time.Minute))
+		releaseSignedUrl(tenant, path, nil)
+		_, exists = getCachedSignedUrl(tenant, path)
+		Expect(exists).To(BeFalse())
+	})
+
+	It("should not use url close to its expiry", func() {
+		expiry := getSignedUrlExpiry(map[string]interface{}{"expires_in": float64(60)})
+		Expect(expiry).To(BeTemporally("~", time.Now().Add(54*time.Second), time.Second))
+
+		expiry = getSignedUrlExpiry(map[string]interface{}{"expires_in": float64(3600)})
+		Expect(expiry).To(BeTemporally("~",
+			time.Now().Add(time.Hour-signedUrlExpiryMargin), time.Second))
+	})
+})
+
+var _ = Describe("test getSignedUrlsInBatch()", func() {
+	tenant := "testorg~testenv"
+	paths := []string{
+		"date=2016-01-01/time=22-45-05/c.txt.gz",
+		"date=2016-01-01/time=22-45-05/d.txt.gz",
+	}
+
+	AfterEach(func() {
+		config.Set(analyticsSignedUrlBatch, false)
+		signedUrlBatchLock.Lock()
+		signedUrlBatchUnsupported = false
+		signedUrlBatchLock.Unlock()
+		for _, path := range paths {
+			invalidateSignedUrl(tenant, path)
+		}
+	})
+
+	It("should not request urls if batch is disabled", func() {
+		getSignedUrlsInBatch(tenant, paths)
+		for _, path := range paths {
+			_, exists := getCachedSignedUrl(tenant, path)
+			Expect(exists).To(BeFalse())
+		}
+	})
+
+	It("should cache urls for all files if batch is enabled", func() {
+		config.Set(analyticsSignedUrlBatch, true)
+		getSignedUrlsInBatch(tenant, paths)
+		for _, path := range paths {
+			_, exists := getCachedSignedUrl(tenant, path)
+			Expect(exists).To(BeTrue())
+		}
+	})
+
+	It("should not request batches once the server does not support them", func() {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(`{"url": "http://signed"}`))
+		}))
+		defer server.Close()
+		serverBase := config.GetString(uapServerBase)
+		config.Set(uapServerBase, server.URL)
+		defer config.Set(uapServerBase, serverBase)
+
+		config.Set(analyticsSignedUrlBatch, true)
+		getSignedUrlsInBatch(tenant, paths)
+		Expect(requests).To(Equal(1))
+		Expect(isSignedUrlBatchUnsupported()).To(BeTrue())
+		getSignedUrlsInBatch(tenant, paths)
+		Expect(requests).To(Equal(1))
+		for _, path := range paths {
+			_, exists := getCachedSignedUrl(tenant, path)
+			Expect(exists).To(BeFalse())
+		}
+	})
+
+	It("should upload all files in directory", func() {
+		config.Set(analyticsSignedUrlBatch, true)
+		fakeDir := filepath.Join(localAnalyticsStagingDir, "testorg~testenv~20060102170605")
+		os.Mkdir(fakeDir, os.ModePerm)
+		for i := 0; i < 3; i++ {
+			os.Create(filepath.Join(fakeDir, "fakefile"+strconv.Itoa(i)+".txt.gz"))
+		}
+
+		dir, _ := os.Stat(fakeDir)
+		status := uploadDir(dir)
+		Expect(status).To(BeTrue())
+		for i := 0; i < 3; i++ {
+			Expect(filepath.Join(fakeDir, "fakefile"+strconv.Itoa(i)+".txt.gz")).
+				ToNot(BeAnExistingFile())
+		}
+	})
+})
@@ -0,0 +1,194 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Records accepted by validateEnrichPublish are streamed to subscribers of
+the tail API as server-sent events. Each subscriber has a bounded buffer
+and records are dropped when it is full so that a slow subscriber never
+blocks ingestion. Number of dropped records is sent as a "dropped" event.
+*/
+
+// Interval at which a comment is sent to keep idle connections open
+const tailKeepAliveInterval = 15 * time.Second
+
+type tailFilter struct {
+	orgEnv             string
+	apiproxy           string
+	responseStatusCode string
+}
+
+type tailSubscriber struct {
+	filter tailFilter
+	events chan []byte
+	// records dropped since the last dropped event was sent
+	dropped int64
+}
+
+var tailSubscribers = make(map[*tailSubscriber]bool)
+
+var tailSubscribersLock = sync.RWMutex{}
+
+func (f tailFilter) matches(orgEnv string, record map[string]interface{}) bool {
+	if f.orgEnv != orgEnv {
+		return false
+	}
+	if f.apiproxy != "" && getStringField(record, "apiproxy") != f.apiproxy {
+		return false
+	}
+	if f.responseStatusCode != "" &&
+		getStringField(record, "response_status_code") != f.responseStatusCode {
+		return false
+	}
+	return true
+}
+
+// Returns nil if max subscribers are already connected
+func addTailSubscriber(filter tailFilter) *tailSubscriber {
+	tailSubscribersLock.Lock()
+	defer tailSubscribersLock.Unlock()
+	if len(tailSubscribers) >= config.GetInt(analyticsTailMaxSubscribers) {
+		return nil
+	}
+	s := &tailSubscriber{
+		filter: filter,
+		events: make(chan []byte, config.GetInt(analyticsTailBufferSize)),
+	}
+	tailSubscribers[s] = true
+	return s
+}
+
+func removeTailSubscriber(s *tailSubscriber) {
+	tailSubscribersLock.Lock()
+	defer tailSubscribersLock.Unlock()
+	delete(tailSubscribers, s)
+}
+
+func getTailSubscriberCount() int {
+	tailSubscribersLock.RLock()
+	defer tailSubscribersLock.RUnlock()
+	return len(tailSubscribers)
+}
+
+// Send accepted records to matching subscribers without blocking
+func publishToTail(tenant tenant, records []interface{}) {
+	tailSubscribersLock.RLock()
+	defer tailSubscribersLock.RUnlock()
+	if len(tailSubscribers) == 0 {
+		return
+	}
+
+	orgEnv := getKeyForOrgEnvCache(tenant.Org, tenant.Env)
+	for _, record := range records {
+		recordMap, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// record is marshalled only if some subscriber wants it
+		var event []byte
+		for s := range tailSubscribers {
+			if !s.filter.matches(orgEnv, recordMap) {
+				continue
+			}
+			if event == nil {
+				b, err := json.Marshal(recordMap)
+				if err != nil {
+					break
+				}
+				event = b
+			}
+			select {
+			case s.events <- event:
+			default:
+				atomic.AddInt64(&s.dropped, 1)
+			}
+		}
+	}
+}
+
+func tailAnalytics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError,
+			"INTERNAL_SERVER_ERROR", "Streaming is not supported")
+		return
+	}
+
+	params := r.URL.Query()
+	org, env := params.Get("org"), params.Get("env")
+	if org == "" || env == "" {
+		writeError(w, http.StatusBadRequest, "MISSING_FIELD",
+			"org and env are required")
+		return
+	}
+	orgEnv := getKeyForOrgEnvCache(org, env)
+	if !authorizedForScope(w, r, orgEnv) {
+		return
+	}
+
+	s := addTailSubscriber(tailFilter{
+		orgEnv:             orgEnv,
+		apiproxy:           params.Get("apiproxy"),
+		responseStatusCode: params.Get("response_status_code"),
+	})
+	if s == nil {
+		writeError(w, http.StatusServiceUnavailable, "SERVICE_UNAVAILABLE",
+			"Max tail subscribers are already connected")
+		return
+	}
+	defer removeTailSubscriber(s)
+	log.Debugf("Tail subscriber connected for %s", orgEnv)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tailKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			log.Debugf("Tail subscriber disconnected for %s", orgEnv)
+			return
+		case event := <-s.events:
+			if dropped := atomic.SwapInt64(&s.dropped, 0); dropped > 0 {
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(w, "data: %s\n\n", event)
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test live tail", func() {
+	tailTenant := tenant{Org: "tailorg", Env: "testenv"}
+
+	getRecord := func(proxy, status string) interface{} {
+		return map[string]interface{}{
+			"apiproxy":             proxy,
+			"response_status_code": json.Number(status),
+		}
+	}
+
+	It("should filter records and drop them when buffer is full", func() {
+		config.Set(analyticsTailBufferSize, 2)
+		defer config.Set(analyticsTailBufferSize, analyticsTailBufferSizeDefault)
+
+		s := addTailSubscriber(tailFilter{orgEnv: "tailorg~testenv", apiproxy: "proxy1"})
+		Expect(s).ToNot(BeNil())
+		defer removeTailSubscriber(s)
+
+		publishToTail(tenant{Org: "otherorg", Env: "testenv"},
+			[]interface{}{getRecord("proxy1", "200")})
+		publishToTail(tailTenant, []interface{}{getRecord("proxy2", "200")})
+		Expect(s.events).To(BeEmpty())
+
+		publishToTail(tailTenant, []interface{}{getRecord("proxy1", "200"),
+			getRecord("proxy1", "500"), getRecord("proxy1", "404")})
+		Expect(s.events).To(HaveLen(2))
+		Expect(s.dropped).To(Equal(int64(1)))
+		Expect(string(<-s.events)).To(ContainSubstring(`"response_status_code":200`))
+	})
+
+	It("should not allow more than max subscribers", func() {
+		config.Set(analyticsTailMaxSubscribers, 1)
+		defer config.Set(analyticsTailMaxSubscribers, analyticsTailMaxSubscribersDefault)
+
+		s := addTailSubscriber(tailFilter{orgEnv: "tailorg~testenv"})
+		Expect(s).ToNot(BeNil())
+		defer removeTailSubscriber(s)
+
+		res, err := client.Get(getTailUrl(url.Values{"org": {"tailorg"}, "env": {"testenv"}}))
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should stream accepted records as server-sent events", func() {
+		res, err := client.Get(getTailUrl(url.Values{"org": {"tailorg"},
+			"env": {"testenv"}, "response_status_code": {"500"}}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+		Eventually(getTailSubscriberCount).Should(Equal(1))
+
+		publishToTail(tailTenant, []interface{}{getRecord("proxy1", "200"),
+			getRecord("proxy1", "500")})
+
+		reader := bufio.NewReader(res.Body)
+		line, err := reader.ReadString('\n')
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(strings.HasPrefix(line, "data: ")).To(BeTrue())
+		var record map[string]interface{}
+		Expect(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &record)).To(Succeed())
+		Expect(record["response_status_code"]).To(Equal(500.0))
+
+		By("subscriber is removed once disconnected")
+		res.Body.Close()
+		Eventually(getTailSubscriberCount).Should(Equal(0))
+	})
+
+	It("should require org and env", func() {
+		res, err := client.Get(getTailUrl(url.Values{"org": {"tailorg"}}))
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
+
+func getTailUrl(params url.Values) string {
+	uri, err := url.Parse(testServer.URL)
+	Expect(err).ShouldNot(HaveOccurred())
+	uri.Path = analyticsBasePath + "/tail"
+	uri.RawQuery = params.Encode()
+	return uri.String()
+}
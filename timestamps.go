@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Timestamps are expected in epoch milliseconds. If normalization is enabled
+then timestamps sent as ISO-8601 strings or as epoch seconds, microseconds
+or nanoseconds are converted to epoch milliseconds before validation.
+The unit of a number is inferred from its magnitude i.e. epoch
+milliseconds have 13 digits from 2001 till 2286.
+*/
+
+var recordTimestampFields = []string{
+	"client_received_start_timestamp", "client_received_end_timestamp",
+	"target_sent_start_timestamp", "target_sent_end_timestamp",
+	"target_received_start_timestamp", "target_received_end_timestamp",
+	"client_sent_start_timestamp", "client_sent_end_timestamp",
+}
+
+// Layouts of ISO-8601 timestamps, ones without zone are in UTC
+var isoTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func normalizeTimestamps(recordMap map[string]interface{}) {
+	for _, field := range recordTimestampFields {
+		v, exists := recordMap[field]
+		if !exists {
+			continue
+		}
+		if ms, ok := normalizeTimestamp(v); ok {
+			recordMap[field] = json.Number(strconv.FormatInt(ms, 10))
+		}
+	}
+}
+
+// Returns epoch milliseconds of the timestamp if it can be parsed
+func normalizeTimestamp(v interface{}) (int64, bool) {
+	var s string
+	switch value := v.(type) {
+	case json.Number:
+		s = value.String()
+	case string:
+		s = strings.TrimSpace(value)
+		for _, layout := range isoTimestampLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UnixNano() / int64(time.Millisecond), true
+			}
+		}
+	default:
+		return 0, false
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, false
+	}
+	// integers are converted exactly since float64 loses precision
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case i < 1e11:
+			return i * 1000, true
+		case i < 1e14:
+			return i, true
+		case i < 1e17:
+			return i / 1e3, true
+		default:
+			return i / 1e6, true
+		}
+	}
+	switch {
+	case f < 1e11:
+		return int64(math.Round(f * 1e3)), true
+	case f < 1e14:
+		return int64(math.Round(f)), true
+	case f < 1e17:
+		return int64(math.Round(f / 1e3)), true
+	default:
+		return int64(math.Round(f / 1e6)), true
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test timestamp normalization and limits", func() {
+	AfterEach(func() {
+		config.Set(analyticsNormalizeTimestamps, analyticsNormalizeTimestampsDefault)
+		config.Set(analyticsMaxClockSkew, analyticsMaxClockSkewDefault)
+		config.Set(analyticsMaxRecordAge, analyticsMaxRecordAgeDefault)
+	})
+
+	It("should convert timestamps to epoch milliseconds", func() {
+		ms := int64(1462850097576)
+		for _, v := range []interface{}{
+			json.Number("1462850097576"),
+			json.Number("1462850097.576"),
+			json.Number("1462850097576000"),
+			json.Number("1462850097576000000"),
+			"1462850097576",
+			"2016-05-10T03:14:57.576Z",
+			"2016-05-10T05:14:57.576+02:00",
+			"2016-05-10T03:14:57.576",
+			"2016-05-10 03:14:57.576",
+		} {
+			n, ok := normalizeTimestamp(v)
+			Expect(ok).To(BeTrue(), fmt.Sprint(v))
+			Expect(n).To(Equal(ms), fmt.Sprint(v))
+		}
+
+		n, ok := normalizeTimestamp(json.Number("1462850097"))
+		Expect(ok).To(BeTrue())
+		Expect(n).To(Equal(int64(1462850097000)))
+
+		_, ok = normalizeTimestamp("yesterday")
+		Expect(ok).To(BeFalse())
+		_, ok = normalizeTimestamp(true)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should normalize timestamps before validation if enabled", func() {
+		now := time.Now().UTC()
+		record := map[string]interface{}{
+			"client_received_start_timestamp": now.Add(-time.Second).Format(time.RFC3339Nano),
+			"client_received_end_timestamp":   json.Number(fmt.Sprint(now.Unix())),
+		}
+		valid, e := validate(record)
+		Expect(valid).To(BeFalse())
+		Expect(e.ErrorCode).To(Equal("BAD_DATA"))
+
+		config.Set(analyticsNormalizeTimestamps, true)
+		valid, _ = validate(record)
+		Expect(valid).To(BeTrue())
+		Expect(record["client_received_start_timestamp"]).To(Equal(json.Number(
+			fmt.Sprint(now.Add(-time.Second).UnixNano() / int64(time.Millisecond)))))
+		Expect(record["client_received_end_timestamp"]).To(Equal(json.Number(
+			fmt.Sprint(now.Unix() * 1000))))
+	})
+
+	It("should allow configured clock skew and max age", func() {
+		getRecord := func(start time.Time) map[string]interface{} {
+			ms := start.Unix() * 1000
+			return map[string]interface{}{
+				"client_received_start_timestamp": json.Number(fmt.Sprint(ms)),
+				"client_received_end_timestamp":   json.Number(fmt.Sprint(ms + 100)),
+			}
+		}
+		future := getRecord(time.Now().Add(30 * time.Second))
+		valid, e := validate(future)
+		Expect(valid).To(BeFalse())
+		Expect(e.Reason).To(ContainSubstring("cannot be after current time"))
+
+		config.Set(analyticsMaxClockSkew, 60)
+		valid, _ = validate(future)
+		Expect(valid).To(BeTrue())
+
+		old := getRecord(time.Now().AddDate(0, 0, -10))
+		valid, _ = validate(old)
+		Expect(valid).To(BeTrue())
+
+		config.Set(analyticsMaxRecordAge, 7)
+		valid, e = validate(old)
+		Expect(valid).To(BeFalse())
+		Expect(e.Reason).To(Equal("client_received_start_timestamp " +
+			"cannot be older than 7 days"))
+	})
+})
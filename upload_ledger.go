@@ -0,0 +1,257 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+/*
+Upload ledger records the outcome of each file upload in a plugin specific
+DB which is not replaced on a new ApigeeSync snapshot. It is consulted
+before each upload so that a file which was uploaded but could not be
+deleted before a crash is not uploaded again on restart.
+*/
+
+const (
+	uploadStatusUploaded = "uploaded"
+	uploadStatusFailed   = "failed"
+
+	// Max entries returned by the ledger API
+	maxLedgerEntries = 1000
+)
+
+// nil if ledger is disabled or could not be initialized
+var ledgerDB apid.DB
+
+var ledgerDBLock = sync.RWMutex{}
+
+type ledgerEntry struct {
+	Tenant           string `json:"tenant"`
+	RelativeFilePath string `json:"relativeFilePath"`
+	DirName          string `json:"dirName"`
+	Status           string `json:"status"`
+	Attempts         int    `json:"attempts"`
+	SizeBytes        int64  `json:"sizeBytes"`
+	LastError        string `json:"lastError,omitempty"`
+	UpdatedAt        int64  `json:"updatedAt"`
+	UploadedAt       int64  `json:"uploadedAt,omitempty"`
+}
+
+func getLedgerDB() apid.DB {
+	ledgerDBLock.RLock()
+	db := ledgerDB
+	ledgerDBLock.RUnlock()
+	return db
+}
+
+func setLedgerDB(db apid.DB) {
+	ledgerDBLock.Lock()
+	ledgerDB = db
+	ledgerDBLock.Unlock()
+}
+
+// Uploads continue without the ledger if it cannot be initialized
+func initUploadLedger() {
+	if !config.GetBool(analyticsUploadLedger) {
+		return
+	}
+	db, err := data.DBForID(pluginData.Name)
+	if err == nil {
+		_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS upload_ledger (
+			tenant TEXT NOT NULL,
+			relative_file_path TEXT NOT NULL,
+			dir_name TEXT,
+			status TEXT,
+			attempts INTEGER DEFAULT 0,
+			size INTEGER,
+			last_error TEXT,
+			updated_at INTEGER,
+			uploaded_at INTEGER,
+			PRIMARY KEY (tenant, relative_file_path)
+		);
+		CREATE INDEX IF NOT EXISTS upload_ledger_updated_at
+			ON upload_ledger (updated_at);
+		`)
+	}
+	if err != nil {
+		log.Errorf("Cannot initialize upload ledger, uploads will not be "+
+			"deduplicated across restarts: %v", err)
+		return
+	}
+	setLedgerDB(db)
+	pruneUploadLedger()
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			pruneUploadLedger()
+		}
+	}()
+}
+
+// Returns true if the file has already been uploaded
+func isFileUploaded(tenant, relativeFilePath string) bool {
+	db := getLedgerDB()
+	if db == nil {
+		return false
+	}
+	var status string
+	err := db.QueryRow("SELECT status FROM upload_ledger WHERE tenant = ? "+
+		"AND relative_file_path = ?", tenant, relativeFilePath).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		log.Warnf("Cannot query upload ledger: %v", err)
+	}
+	return status == uploadStatusUploaded
+}
+
+// Record outcome of an upload attempt. uploadErr is nil if upload succeeded.
+func recordUploadOutcome(tenant, relativeFilePath, dirName string,
+	size int64, uploadErr error) {
+	db := getLedgerDB()
+	if db == nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	status, lastError := uploadStatusUploaded, ""
+	var uploadedAt interface{} = now
+	if uploadErr != nil {
+		status, lastError, uploadedAt = uploadStatusFailed, uploadErr.Error(), nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Errorf("Cannot record upload of '%s': %v", relativeFilePath, err)
+		return
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO upload_ledger (tenant, "+
+		"relative_file_path, dir_name) VALUES (?, ?, ?)",
+		tenant, relativeFilePath, dirName)
+	if err == nil {
+		_, err = tx.Exec("UPDATE upload_ledger SET dir_name = ?, status = ?, "+
+			"attempts = attempts + 1, size = ?, last_error = ?, updated_at = ?, "+
+			"uploaded_at = ? WHERE tenant = ? AND relative_file_path = ?",
+			dirName, status, size, lastError, now, uploadedAt,
+			tenant, relativeFilePath)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		log.Errorf("Cannot record upload of '%s': %v", relativeFilePath, err)
+	}
+}
+
+// Delete entries older than the configured retention
+func pruneUploadLedger() {
+	db := getLedgerDB()
+	if db == nil {
+		return
+	}
+	retention := time.Hour * 24 *
+		config.GetDuration(analyticsUploadLedgerRetention)
+	cutoff := time.Now().Add(-retention).Unix()
+	res, err := db.Exec("DELETE FROM upload_ledger WHERE updated_at < ?", cutoff)
+	if err != nil {
+		log.Errorf("Cannot prune upload ledger: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Debugf("Pruned %d entries from upload ledger", n)
+	}
+}
+
+// Query ledger entries filtered by tenant, dir, status and since
+// (unix timestamp in seconds), most recently updated first
+func getUploadLedger(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	db := getLedgerDB()
+	if db == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND",
+			"Upload ledger is not enabled")
+		return
+	}
+
+	query := "SELECT tenant, relative_file_path, dir_name, status, attempts, " +
+		"size, last_error, updated_at, uploaded_at FROM upload_ledger WHERE 1 = 1"
+	var args []interface{}
+	params := r.URL.Query()
+	if tenant := params.Get("tenant"); tenant != "" {
+		query += " AND tenant = ?"
+		args = append(args, tenant)
+	}
+	if dir := params.Get("dir"); dir != "" {
+		query += " AND dir_name = ?"
+		args = append(args, dir)
+	}
+	if status := params.Get("status"); status != "" {
+		if status != uploadStatusUploaded && status != uploadStatusFailed {
+			writeError(w, http.StatusBadRequest, "BAD_DATA",
+				"status should be uploaded or failed")
+			return
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if since := params.Get("since"); since != "" {
+		ts, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BAD_DATA",
+				"since should be a unix timestamp in seconds")
+			return
+		}
+		query += " AND updated_at >= ?"
+		args = append(args, ts)
+	}
+	query += " ORDER BY updated_at DESC LIMIT " + strconv.Itoa(maxLedgerEntries)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError,
+			"INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	entries := []ledgerEntry{}
+	for rows.Next() {
+		var e ledgerEntry
+		var dirName, status, lastError sql.NullString
+		var size, updatedAt, uploadedAt sql.NullInt64
+		err := rows.Scan(&e.Tenant, &e.RelativeFilePath, &dirName, &status,
+			&e.Attempts, &size, &lastError, &updatedAt, &uploadedAt)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError,
+				"INTERNAL_SERVER_ERROR", err.Error())
+			return
+		}
+		e.DirName, e.Status, e.LastError = dirName.String, status.String, lastError.String
+		e.SizeBytes, e.UpdatedAt, e.UploadedAt = size.Int64, updatedAt.Int64, uploadedAt.Int64
+		entries = append(entries, e)
+	}
+	writeJson(w, entries)
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test upload ledger", func() {
+	It("should be initialized on plugin start", func() {
+		Expect(getLedgerDB()).ToNot(BeNil())
+	})
+
+	It("should record outcome of each attempt", func() {
+		tenant := "ledgerorg~testenv"
+		relativeFilePath := "/date=2017-01-30/time=15-54-00/a.txt.gz"
+
+		recordUploadOutcome(tenant, relativeFilePath, "ledgerorg~testenv~20170130155400",
+			10, errors.New("Final Datastore (S3/GCS)returned Error"))
+		Expect(isFileUploaded(tenant, relativeFilePath)).To(BeFalse())
+
+		recordUploadOutcome(tenant, relativeFilePath, "ledgerorg~testenv~20170130155400",
+			10, nil)
+		Expect(isFileUploaded(tenant, relativeFilePath)).To(BeTrue())
+		Expect(isFileUploaded("other~env", relativeFilePath)).To(BeFalse())
+
+		res, body := makeLedgerRequest(url.Values{"tenant": {tenant}})
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		var entries []ledgerEntry
+		Expect(json.Unmarshal(body, &entries)).To(Succeed())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Status).To(Equal(uploadStatusUploaded))
+		Expect(entries[0].Attempts).To(Equal(2))
+		Expect(entries[0].SizeBytes).To(Equal(int64(10)))
+		Expect(entries[0].UploadedAt).ToNot(BeZero())
+
+		By("filter by status")
+		res, body = makeLedgerRequest(url.Values{"tenant": {tenant},
+			"status": {uploadStatusFailed}})
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(body, &entries)).To(Succeed())
+		Expect(entries).To(BeEmpty())
+
+		By("invalid filter")
+		res, _ = makeLedgerRequest(url.Values{"since": {"yesterday"}})
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should not upload file again which is already uploaded", func() {
+		// invalid tenant so that upload fails if it is attempted
+		dirName := "o~e~20170130160500"
+		dirPath := filepath.Join(localAnalyticsStagingDir, dirName)
+		os.Mkdir(dirPath, os.ModePerm)
+		defer os.RemoveAll(dirPath)
+		fp := filepath.Join(dirPath, "fakefile.txt.gz")
+		ioutil.WriteFile(fp, []byte{}, filePermissions)
+
+		recordUploadOutcome("o~e", "date=2017-01-30/time=16-05-00/fakefile.txt.gz",
+			dirName, 0, nil)
+
+		dir, _ := os.Stat(dirPath)
+		Expect(uploadDir(dir)).To(BeTrue())
+		Expect(fp).ToNot(BeAnExistingFile())
+	})
+})
+
+func makeLedgerRequest(params url.Values) (*http.Response, []byte) {
+	uri, err := url.Parse(testServer.URL)
+	Expect(err).ShouldNot(HaveOccurred())
+	uri.Path = analyticsBasePath + "/admin/uploads"
+	uri.RawQuery = params.Encode()
+
+	req, _ := http.NewRequest("GET", uri.String(), nil)
+	return makeAdminRequest(req)
+}
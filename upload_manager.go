@@ -30,11 +30,16 @@ const (
 // moving it to failed directory
 var retriesMap map[string]int
 
+// Channel where a new upload interval is published so
+// that the upload manager can reset its ticker
+var uploadIntervalChan chan time.Duration
+
 //TODO:  make sure that this instance gets initialized only once
 // since we dont want multiple upload manager tickers running
 func initUploadManager() {
 
 	retriesMap = make(map[string]int)
+	uploadIntervalChan = make(chan time.Duration, 1)
 
 	go func() {
 		// Periodically check the staging directory to check
@@ -44,36 +49,74 @@ func initUploadManager() {
 		log.Debugf("Intialized upload manager to check for staging directory")
 		// Ticker will keep running till go routine is running
 		// i.e. till application is running
-		defer ticker.Stop()
-
-		for range ticker.C {
-			files, err := ioutil.ReadDir(localAnalyticsStagingDir)
+		defer func() {
+			ticker.Stop()
+		}()
 
-			if err != nil {
-				log.Errorf("Cannot read directory: "+
-					"%s", localAnalyticsStagingDir)
+		for {
+			select {
+			case <-ticker.C:
+				uploadStagingDirs()
+			case interval := <-uploadIntervalChan:
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+				log.Infof("Reset upload manager to check for "+
+					"staging directory every %v", interval)
 			}
+		}
+	}()
+}
 
-			uploadedDirCnt := 0
-			for _, file := range files {
-				if file.IsDir() {
-					status := uploadDir(file)
-					handleUploadDirStatus(file, status)
-					if status {
-						uploadedDirCnt++
-						log.Debugf("Successfully uploaded: %s",
-							file.Name())
-					}
-				}
+func uploadStagingDirs() {
+	if uploadsPaused() {
+		log.Debugf("Uploads are paused till bearer token is refreshed")
+		return
+	}
+
+	files, err := ioutil.ReadDir(localAnalyticsStagingDir)
+
+	if err != nil {
+		log.Errorf("Cannot read directory: "+
+			"%s", localAnalyticsStagingDir)
+	}
+
+	// other destinations share a deadline for the pass
+	endDeliveryPass := startDeliveryPass()
+	defer endDeliveryPass()
+
+	uploadedDirCnt := 0
+	for _, file := range files {
+		if file.IsDir() {
+			status := uploadDir(file)
+			if !status && uploadsPaused() {
+				// Failure due to rejected bearer token is not
+				// counted as a retry for this directory
+				break
 			}
-			if uploadedDirCnt > 0 {
-				// After a successful upload, retry the
-				// folders in failed directory as they might have
-				// failed due to intermittent S3/GCS issue
-				retryFailedUploads()
+			handleUploadDirStatus(file, status)
+			if status {
+				uploadedDirCnt++
+				log.Debugf("Successfully uploaded: %s",
+					file.Name())
 			}
 		}
-	}()
+	}
+	if uploadedDirCnt > 0 {
+		// After a successful upload, retry the
+		// folders in failed directory as they might have
+		// failed due to intermittent S3/GCS issue
+		retryFailedUploads()
+	}
+}
+
+// Publish new upload interval to the upload manager, replacing
+// any interval that has not been picked up yet
+func resetUploadInterval(interval time.Duration) {
+	select {
+	case <-uploadIntervalChan:
+	default:
+	}
+	uploadIntervalChan <- interval
 }
 
 func handleUploadDirStatus(dir os.FileInfo, status bool) {
@@ -86,12 +129,19 @@ func handleUploadDirStatus(dir os.FileInfo, status bool) {
 			"successful upload: %s", dir.Name())
 		// remove key if exists from retry map after a successful upload
 		delete(retriesMap, dir.Name())
+		popLastUploadError(dir.Name())
 	} else {
+		// attempts and last error are kept with the directory
+		// so that they are available via the admin API
+		recordUploadFailure(completePath, popLastUploadError(dir.Name()))
+
 		retriesMap[dir.Name()] = retriesMap[dir.Name()] + 1
 		if retriesMap[dir.Name()] >= maxRetries {
 			log.Errorf("Max Retires exceeded for folder: %s", completePath)
 			failedDirPath := filepath.Join(localAnalyticsFailedDir, dir.Name())
+			failedDirLock.Lock()
 			err := os.Rename(completePath, failedDirPath)
+			failedDirLock.Unlock()
 			if err != nil {
 				log.Errorf("Cannot move directory '%s'"+
 					" from staging to failed folder", dir.Name())
@@ -103,6 +153,9 @@ func handleUploadDirStatus(dir os.FileInfo, status bool) {
 }
 
 func retryFailedUploads() {
+	failedDirLock.Lock()
+	defer failedDirLock.Unlock()
+
 	failedDirs, err := ioutil.ReadDir(localAnalyticsFailedDir)
 
 	if err != nil {
@@ -113,9 +166,7 @@ func retryFailedUploads() {
 	for _, dir := range failedDirs {
 		// We rety failed folder in batches to not overload the upload thread
 		if cnt < retryFailedDirBatchSize {
-			failedPath := filepath.Join(localAnalyticsFailedDir, dir.Name())
-			newStagingPath := filepath.Join(localAnalyticsStagingDir, dir.Name())
-			err := os.Rename(failedPath, newStagingPath)
+			err := retryFailedDir(dir.Name())
 			if err != nil {
 				log.Errorf("Cannot move directory '%s'"+
 					" from failed to staging folder", dir.Name())
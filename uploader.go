@@ -17,11 +17,14 @@ package apidAnalytics
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,11 +32,75 @@ const timestampLayout = "20060102150405" // same as yyyyMMddHHmmss
 
 var token string
 
+// Bearer token that was rejected by UAP collection endpoint. Uploads are
+// paused while it is set so that auth failures do not count as retries
+var rejectedToken string
+
+// Lock for rejectedToken since it is reset by the ApigeeSync listener
+var rejectedTokenLock = sync.Mutex{}
+
+// Error returned when UAP collection endpoint rejects the bearer token
+type tokenRejectedError struct {
+	token  string
+	status string
+}
+
+func (e tokenRejectedError) Error() string {
+	return fmt.Sprintf("Bearer token rejected while getting "+
+		"signed URL '%v'", e.status)
+}
+
+// Datastore rejected the signed URL eg. because its signature
+// expired or does not match, so it should not be used again
+type signedUrlRejectedError struct {
+	status string
+}
+
+func (e signedUrlRejectedError) Error() string {
+	return fmt.Sprintf("Final Datastore (S3/GCS)returned "+
+		"Error '%v'", e.status)
+}
+
 func addHeaders(req *http.Request) {
 	token = config.GetString("apigeesync_bearer_token")
 	req.Header.Add("Authorization", "Bearer "+token)
 }
 
+func pauseUploads(rejected string) {
+	rejectedTokenLock.Lock()
+	defer rejectedTokenLock.Unlock()
+	if rejectedToken == "" {
+		log.Warnf("Pausing uploads till bearer token is refreshed")
+	}
+	rejectedToken = rejected
+}
+
+func resumeUploads() {
+	rejectedTokenLock.Lock()
+	defer rejectedTokenLock.Unlock()
+	if rejectedToken != "" {
+		log.Infof("Resuming uploads as bearer token may have been refreshed")
+		rejectedToken = ""
+	}
+}
+
+// Returns true if uploads are paused due to a rejected bearer token.
+// Uploads are resumed once the token in config is different from the
+// rejected one or an ApigeeSync event is received.
+func uploadsPaused() bool {
+	rejectedTokenLock.Lock()
+	rejected := rejectedToken
+	rejectedTokenLock.Unlock()
+	if rejected == "" {
+		return false
+	}
+	if config.GetString("apigeesync_bearer_token") != rejected {
+		resumeUploads()
+		return false
+	}
+	return true
+}
+
 func uploadDir(dir os.FileInfo) bool {
 	// Eg. org~env~20160101224500
 	tenant, timestamp := splitDirName(dir.Name())
@@ -41,41 +108,166 @@ func uploadDir(dir os.FileInfo) bool {
 	dateTimePartition := getDateFromDirTimestamp(timestamp)
 
 	completePath := filepath.Join(localAnalyticsStagingDir, dir.Name())
-	files, _ := ioutil.ReadDir(completePath)
+	// files modified after the directory was closed are not uploaded
+	if err := verifyManifest(completePath); err != nil {
+		log.Errorf("Upload failed due to: %v", err)
+		setLastUploadError(dir.Name(), err.Error())
+		return false
+	}
+	dirFiles, _ := ioutil.ReadDir(completePath)
+
+	// destinations other than UAP and files delivered to each of them
+	dests := getDestinations(tenant)
+	state := loadDeliveryState(completePath, dests)
+
+	var allFiles []os.FileInfo
+	var allRelativeFilePaths []string
+	for _, file := range dirFiles {
+		// state of interrupted uploads, failed attempts
+		// and manifest are not uploaded as data
+		if !isDataFile(file.Name()) {
+			continue
+		}
+		allFiles = append(allFiles, file)
+		allRelativeFilePaths = append(allRelativeFilePaths,
+			getRelativeFilePath(dateTimePartition, file.Name()))
+	}
+	if m, ok := getManifestToUpload(completePath); ok {
+		allFiles = append(allFiles, m)
+		allRelativeFilePaths = append(allRelativeFilePaths,
+			dateTimePartition+"/"+m.Name())
+	}
+
+	// Files are deleted after upload unless other destinations need them
+	uploaded := func(file os.FileInfo) {
+		if state == nil {
+			os.Remove(filepath.Join(completePath, file.Name()))
+			log.Debugf("Deleted file '%s' after "+
+				"successful upload", file.Name())
+			return
+		}
+		if err := state.markDelivered(uapDestinationName, file.Name()); err != nil {
+			log.Errorf("Cannot save delivery state of '%s': %v", file.Name(), err)
+		}
+	}
+
+	// Only files which still need to be uploaded get signed URL's
+	var files []os.FileInfo
+	var relativeFilePaths, batchFilePaths []string
+	for i, file := range allFiles {
+		// file was uploaded to UAP but other destinations still need it
+		if state.isDelivered(uapDestinationName, file.Name()) {
+			continue
+		}
+		// file was uploaded but not deleted before a restart
+		if isFileUploaded(tenant, allRelativeFilePaths[i]) {
+			log.Infof("Skipping file '%s' which is already "+
+				"uploaded", file.Name())
+			uploaded(file)
+			continue
+		}
+		files = append(files, file)
+		relativeFilePaths = append(relativeFilePaths, allRelativeFilePaths[i])
+		// manifest has a different content type so it is requested on its own
+		if !isManifestFile(file.Name()) &&
+			!isLargeFile(filepath.Join(completePath, file.Name())) {
+			batchFilePaths = append(batchFilePaths, allRelativeFilePaths[i])
+		}
+	}
+	getSignedUrlsInBatch(tenant, batchFilePaths)
+
+	// Large files negotiate their own upload so their
+	// signed URL is not prefetched
+	fetchSignedUrl := func(i int) chan signedUrlResult {
+		if isLargeFile(filepath.Join(completePath, files[i].Name())) {
+			return nil
+		}
+		return prefetchSignedUrl(tenant, relativeFilePaths[i])
+	}
 
 	status := true
 	var error error
-	for _, file := range files {
+	var next chan signedUrlResult
+	if len(files) > 0 {
+		next = fetchSignedUrl(0)
+	}
+	for i, file := range files {
 		completeFilePath := filepath.Join(completePath, file.Name())
-		relativeFilePath := dateTimePartition + "/" + file.Name()
-		status, error = uploadFile(tenant, relativeFilePath, completeFilePath)
+		relativeFilePath := relativeFilePaths[i]
+
+		current := next
+		// Get signed URL for next file while this file is being uploaded
+		if i+1 < len(files) {
+			next = fetchSignedUrl(i + 1)
+		}
+
+		if current == nil {
+			status, error = uploadLargeFile(tenant, relativeFilePath, completeFilePath)
+		} else if signedUrl := <-current; signedUrl.err != nil {
+			status, error = false, signedUrl.err
+		} else {
+			status, error = uploadFileToDatastore(completeFilePath, signedUrl.url)
+		}
+		releaseSignedUrl(tenant, relativeFilePath, error)
+		if _, rejected := error.(tokenRejectedError); !rejected {
+			recordUploadOutcome(tenant, relativeFilePath, dir.Name(),
+				file.Size(), error)
+		}
+
 		if error != nil {
 			log.Errorf("Upload failed due to: %v", error)
+			setLastUploadError(dir.Name(), error.Error())
+			if e, ok := error.(tokenRejectedError); ok {
+				pauseUploads(e.token)
+			}
 			break
 		} else {
-			os.Remove(completeFilePath)
-			log.Debugf("Deleted file '%s' after "+
-				"successful upload", file.Name())
+			uploaded(file)
 		}
 	}
+
+	// Other destinations are attempted even if UAP failed so that
+	// the directory is retried only for what is still missing
+	if state != nil && !deliverToDestinations(dir.Name(), tenant, dests,
+		state, allFiles, allRelativeFilePaths) {
+		status = false
+	}
 	return status
 }
 
 func uploadFile(tenant, relativeFilePath, completeFilePath string) (bool, error) {
-	signedUrl, err := getSignedUrl(tenant, relativeFilePath)
+	signedUrl, err := getSignedUrlWithCache(tenant, relativeFilePath)
 	if err != nil {
 		return false, err
 	} else {
-		return uploadFileToDatastore(completeFilePath, signedUrl)
+		status, err := uploadFileToDatastore(completeFilePath, signedUrl)
+		releaseSignedUrl(tenant, relativeFilePath, err)
+		return status, err
 	}
 }
 
 func getSignedUrl(tenant, relativeFilePath string) (string, error) {
+	body, err := requestUapCollection(tenant, []string{relativeFilePath}, nil)
+	if err != nil {
+		return "", err
+	}
+	signedURL, ok := body["url"].(string)
+	if !ok {
+		return "", fmt.Errorf("Signed URL missing in response")
+	}
+	cacheSignedUrl(tenant, relativeFilePath, signedURL, getSignedUrlExpiry(body))
+	return signedURL, nil
+}
+
+// Request signed URL's from UAP collection endpoint for given files.
+// Extra params are added to the query to negotiate the type of upload.
+func requestUapCollection(tenant string, relativeFilePaths []string,
+	params url.Values) (map[string]interface{}, error) {
 	uapCollectionUrl := config.GetString(uapServerBase) + "/analytics"
 
 	req, err := http.NewRequest("GET", uapCollectionUrl, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	q := req.URL.Query()
@@ -83,16 +275,24 @@ func getSignedUrl(tenant, relativeFilePath string) (string, error) {
 	// eg. edgexfeb1~test
 	q.Add("tenant", tenant)
 	// eg. date=2017-01-30/time=16-32/1069_20170130163200.20170130163400_218e3d99-efaf-4a7b-b3f2-5e4b00c023b7_writer_0.txt.gz
-	q.Add("relative_file_path", relativeFilePath)
-	q.Add("file_content_type", "application/x-gzip")
+	for _, relativeFilePath := range relativeFilePaths {
+		q.Add("relative_file_path", relativeFilePath)
+	}
+	// files requested together are of the same type
+	q.Add("file_content_type", getFileContentType(relativeFilePaths[0]))
 	q.Add("encrypt", "true")
+	for key, values := range params {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
 	req.URL.RawQuery = q.Encode()
 
 	// Add Bearer Token to each request
 	addHeaders(req)
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -100,37 +300,52 @@ func getSignedUrl(tenant, relativeFilePath string) (string, error) {
 	if resp.StatusCode == 200 {
 		var body map[string]interface{}
 		json.Unmarshal(respBody, &body)
-		signedURL := body["url"]
-		return signedURL.(string), nil
+		return body, nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		// 403 is specific to the tenant (eg. org is deprovisioned)
+		// so it is retried like any other error for the directory
+		return nil, tokenRejectedError{
+			token:  strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "),
+			status: resp.Status}
 	} else {
-		return "", fmt.Errorf("Error while getting "+
+		return nil, fmt.Errorf("Error while getting "+
 			"signed URL '%v'", resp.Status)
 	}
 }
 
 func uploadFileToDatastore(completeFilePath, signedUrl string) (bool, error) {
-	// open gzip file that needs to be uploaded
-	file, err := os.Open(completeFilePath)
+	// open gzip file that needs to be uploaded, decrypting it if required
+	file, err := openStagedFile(completeFilePath)
 	if err != nil {
 		return false, err
 	}
 	defer file.Close()
 
-	req, err := http.NewRequest("PUT", signedUrl, file)
+	var c checksum
+	verify := config.GetBool(analyticsUploadChecksum)
+	if verify {
+		c, err = computeChecksum(io.NewSectionReader(file, 0, file.Size()))
+		if err != nil {
+			return false, fmt.Errorf("Could not compute checksum for "+
+				"file '%v'", err)
+		}
+	}
+
+	req, err := http.NewRequest("PUT", signedUrl,
+		io.NewSectionReader(file, 0, file.Size()))
 	if err != nil {
 		return false, fmt.Errorf("Parsing URL failed '%v'", err)
 	}
 
 	req.Header.Set("Expect", "100-continue")
-	req.Header.Set("Content-Type", "application/x-gzip")
+	// should match the content type the URL was signed for
+	req.Header.Set("Content-Type", getFileContentType(completeFilePath))
 	req.Header.Set("x-amz-server-side-encryption", "AES256")
-
-	fileStats, err := file.Stat()
-	if err != nil {
-		return false, fmt.Errorf("Could not get content length for "+
-			"file '%v'", err)
+	if verify {
+		addChecksumHeaders(req, c)
 	}
-	req.ContentLength = fileStats.Size()
+
+	req.ContentLength = file.Size()
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -139,13 +354,41 @@ func uploadFileToDatastore(completeFilePath, signedUrl string) (bool, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 200 {
+		if verify {
+			// mismatch is returned as an error so that upload is retried
+			if err := verifyChecksum(resp.Header, c); err != nil {
+				return false, err
+			}
+			log.Infof("Uploaded file '%s' with checksum %s",
+				filepath.Base(completeFilePath), c)
+		}
 		return true, nil
+	} else if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return false, signedUrlRejectedError{status: resp.Status}
 	} else {
 		return false, fmt.Errorf("Final Datastore (S3/GCS)returned "+
 			"Error '%v'", resp.Status)
 	}
 }
 
+func getFileContentType(fileName string) string {
+	if isManifestFile(fileName) {
+		return "application/json"
+	}
+	return "application/x-gzip"
+}
+
+// Rollups are uploaded under their own prefix so that they
+// can be processed separately from raw records
+// eg. rollups/date=2016-01-02/time=15-45/filename_rollup.json.gz
+func getRelativeFilePath(dateTimePartition, fileName string) string {
+	if isRollupFile(fileName) {
+		return config.GetString(analyticsRollupPathPrefix) + "/" +
+			dateTimePartition + "/" + fileName
+	}
+	return dateTimePartition + "/" + fileName
+}
+
 // Extract tenant and timestamp from directory Name
 func splitDirName(dirName string) (string, string) {
 	s := strings.Split(dirName, "~")
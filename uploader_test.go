@@ -100,6 +100,73 @@ var _ = Describe("test getSignedUrl()", func() {
 	})
 })
 
+var _ = Describe("test expired bearer token", func() {
+	AfterEach(func() {
+		config.Set("apigeesync_bearer_token", "")
+		resumeUploads()
+	})
+
+	It("getSignedUrl() should return token rejected error", func() {
+		config.Set("apigeesync_bearer_token", "expiredtoken")
+		tenant := "testorg~testenv"
+		relativeFilePath := "/date=2016-01-01/time=22-45-05/a.txt.gz"
+
+		_, err := getSignedUrl(tenant, relativeFilePath)
+		Expect(err).Should(HaveOccurred())
+		e, ok := err.(tokenRejectedError)
+		Expect(ok).To(BeTrue())
+		Expect(e.token).To(Equal("expiredtoken"))
+	})
+
+	It("should pause uploads without counting retries till token is refreshed", func() {
+		config.Set("apigeesync_bearer_token", "expiredtoken")
+		dirName := "testorg~testenv~20060102160605"
+		fakeDir := filepath.Join(localAnalyticsStagingDir, dirName)
+		fp := filepath.Join(fakeDir, "fakefile.txt.gz")
+		os.Mkdir(fakeDir, os.ModePerm)
+		os.Create(fp)
+
+		for i := 0; i < maxRetries+1; i++ {
+			uploadStagingDirs()
+		}
+		Expect(uploadsPaused()).To(BeTrue())
+		Expect(fp).To(BeAnExistingFile())
+		_, exists := retriesMap[dirName]
+		Expect(exists).To(BeFalse())
+
+		By("token is refreshed")
+		config.Set("apigeesync_bearer_token", "newtoken")
+		Expect(uploadsPaused()).To(BeFalse())
+
+		uploadStagingDirs()
+		Expect(fakeDir).ToNot(BeADirectory())
+	})
+
+	It("should count 403 for a tenant as a retry without pausing uploads", func() {
+		dirName := "forbiddenorg~testenv~20060102160605"
+		fakeDir := filepath.Join(localAnalyticsStagingDir, dirName)
+		os.Mkdir(fakeDir, os.ModePerm)
+		os.Create(filepath.Join(fakeDir, "fakefile.txt.gz"))
+		defer os.RemoveAll(filepath.Join(localAnalyticsFailedDir, dirName))
+
+		for i := 0; i < maxRetries; i++ {
+			uploadStagingDirs()
+			Expect(uploadsPaused()).To(BeFalse())
+		}
+		Expect(fakeDir).ToNot(BeADirectory())
+		Expect(filepath.Join(localAnalyticsFailedDir, dirName)).To(BeADirectory())
+	})
+
+	It("should resume uploads on ApigeeSync event", func() {
+		pauseUploads("expiredtoken")
+		config.Set("apigeesync_bearer_token", "expiredtoken")
+		Expect(uploadsPaused()).To(BeTrue())
+
+		resumeUploads()
+		Expect(uploadsPaused()).To(BeFalse())
+	})
+})
+
 var _ = Describe("test uploadFileToDatastore()", func() {
 	It("should return status based on response from mocked datastore", func() {
 		fakeDir := filepath.Join(localAnalyticsStagingDir, "d1~e1~20060102150405")
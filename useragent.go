@@ -0,0 +1,268 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+The useragent field of each record is parsed into browser, OS, device
+category and bot flag using regex rules. First matching rule of each kind
+wins so more specific rules (eg. Edge) should be listed before generic
+ones (eg. Chrome). Version is the first group of the regex, if any.
+Parsed results are cached by the raw user agent.
+*/
+
+// Fields added to the record
+const (
+	uaAgentFamilyField    = "ax_ua_agent_family"
+	uaAgentVersionField   = "ax_ua_agent_version"
+	uaOSFamilyField       = "ax_ua_os_family"
+	uaOSVersionField      = "ax_ua_os_version"
+	uaDeviceCategoryField = "ax_ua_device_category"
+	uaIsBotField          = "ax_ua_is_bot"
+)
+
+// Rules used unless a rules file is configured
+const defaultUserAgentRules = `{
+  "bots": [
+    "(?i)bot\\b", "(?i)crawl", "(?i)spider", "(?i)slurp", "(?i)^curl/", "(?i)^wget/",
+    "(?i)python-requests", "(?i)go-http-client", "(?i)headlesschrome",
+    "(?i)facebookexternalhit", "(?i)pingdom"
+  ],
+  "agents": [
+    {"regex": "Edg(?:e|A|iOS)?/(\\d+(?:\\.\\d+)?)", "family": "Edge"},
+    {"regex": "(?:OPR|Opera)/(\\d+(?:\\.\\d+)?)", "family": "Opera"},
+    {"regex": "SamsungBrowser/(\\d+(?:\\.\\d+)?)", "family": "Samsung Internet"},
+    {"regex": "CriOS/(\\d+(?:\\.\\d+)?)", "family": "Chrome Mobile iOS"},
+    {"regex": "FxiOS/(\\d+(?:\\.\\d+)?)", "family": "Firefox iOS"},
+    {"regex": "Googlebot/(\\d+(?:\\.\\d+)?)", "family": "Googlebot"},
+    {"regex": "bingbot/(\\d+(?:\\.\\d+)?)", "family": "Bingbot"},
+    {"regex": "(?:Chrome|Chromium)/(\\d+(?:\\.\\d+)?)", "family": "Chrome"},
+    {"regex": "Firefox/(\\d+(?:\\.\\d+)?)", "family": "Firefox"},
+    {"regex": "MSIE (\\d+(?:\\.\\d+)?)", "family": "IE"},
+    {"regex": "Trident/.*rv:(\\d+(?:\\.\\d+)?)", "family": "IE"},
+    {"regex": "Version/(\\d+(?:\\.\\d+)?).*Safari/", "family": "Safari"},
+    {"regex": "^curl/(\\d+(?:\\.\\d+)?)", "family": "curl"},
+    {"regex": "^okhttp/(\\d+(?:\\.\\d+)?)", "family": "okhttp"},
+    {"regex": "^Apache-HttpClient/(\\d+(?:\\.\\d+)?)", "family": "Apache-HttpClient"}
+  ],
+  "os": [
+    {"regex": "Windows Phone (\\d+(?:\\.\\d+)?)", "family": "Windows Phone"},
+    {"regex": "Windows NT (\\d+(?:\\.\\d+)?)", "family": "Windows"},
+    {"regex": "(?:iPhone|iPad|iPod).*OS (\\d+(?:_\\d+)?)", "family": "iOS"},
+    {"regex": "Android (\\d+(?:\\.\\d+)?)", "family": "Android"},
+    {"regex": "Mac OS X (\\d+(?:[_.]\\d+)?)", "family": "Mac OS X"},
+    {"regex": "CrOS \\S+ (\\d+(?:\\.\\d+)?)", "family": "Chrome OS"},
+    {"regex": "Linux", "family": "Linux"}
+  ],
+  "devices": [
+    {"regex": "(?i)ipad|tablet|kindle|silk", "category": "tablet"},
+    {"regex": "(?i)mobi|iphone|ipod|phone", "category": "smartphone"},
+    {"regex": "(?i)android", "category": "tablet"},
+    {"regex": "(?i)windows nt|macintosh|x11|cros", "category": "desktop"}
+  ]
+}`
+
+type userAgentRulesFile struct {
+	Bots   []string `json:"bots"`
+	Agents []struct {
+		Regex  string `json:"regex"`
+		Family string `json:"family"`
+	} `json:"agents"`
+	OS []struct {
+		Regex  string `json:"regex"`
+		Family string `json:"family"`
+	} `json:"os"`
+	Devices []struct {
+		Regex    string `json:"regex"`
+		Category string `json:"category"`
+	} `json:"devices"`
+}
+
+type userAgentRule struct {
+	regex *regexp.Regexp
+	// family or device category
+	name string
+}
+
+type userAgentParser struct {
+	bots    []*regexp.Regexp
+	agents  []userAgentRule
+	os      []userAgentRule
+	devices []userAgentRule
+}
+
+type userAgentInfo struct {
+	agentFamily    string
+	agentVersion   string
+	osFamily       string
+	osVersion      string
+	deviceCategory string
+	isBot          bool
+}
+
+// nil if user agent parsing is disabled
+var uaParser *userAgentParser
+
+// Cache from raw user agent to parsed userAgentInfo
+var uaCache *lruCache
+
+var uaParserLock = sync.RWMutex{}
+
+func initUserAgent() error {
+	var parser *userAgentParser
+	if config.GetBool(analyticsUserAgentParsing) {
+		rules := []byte(defaultUserAgentRules)
+		if path := config.GetString(analyticsUserAgentRulesFile); path != "" {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("Cannot read user agent rules "+
+					"file '%s': %v", path, err)
+			}
+			rules = b
+		}
+		var err error
+		if parser, err = newUserAgentParser(rules); err != nil {
+			return err
+		}
+		log.Infof("Enriching records with parsed user agent")
+	}
+
+	uaParserLock.Lock()
+	uaParser = parser
+	uaCache = newLRUCache(config.GetInt(analyticsUserAgentCacheSize))
+	uaParserLock.Unlock()
+	return nil
+}
+
+func newUserAgentParser(rules []byte) (*userAgentParser, error) {
+	var f userAgentRulesFile
+	if err := json.Unmarshal(rules, &f); err != nil {
+		return nil, fmt.Errorf("Invalid user agent rules: %v", err)
+	}
+	compile := func(expr string) (*regexp.Regexp, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid user agent rule '%s': %v", expr, err)
+		}
+		return re, nil
+	}
+
+	p := &userAgentParser{}
+	for _, expr := range f.Bots {
+		re, err := compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		p.bots = append(p.bots, re)
+	}
+	for _, r := range f.Agents {
+		re, err := compile(r.Regex)
+		if err != nil {
+			return nil, err
+		}
+		p.agents = append(p.agents, userAgentRule{re, r.Family})
+	}
+	for _, r := range f.OS {
+		re, err := compile(r.Regex)
+		if err != nil {
+			return nil, err
+		}
+		p.os = append(p.os, userAgentRule{re, r.Family})
+	}
+	for _, r := range f.Devices {
+		re, err := compile(r.Regex)
+		if err != nil {
+			return nil, err
+		}
+		p.devices = append(p.devices, userAgentRule{re, r.Category})
+	}
+	return p, nil
+}
+
+// Returns name and version of the first matching rule
+func matchUserAgentRules(rules []userAgentRule, ua string) (string, string) {
+	for _, r := range rules {
+		if m := r.regex.FindStringSubmatch(ua); m != nil {
+			version := ""
+			if len(m) > 1 {
+				// eg. iOS 10_3 is reported as 10.3
+				version = strings.Replace(m[1], "_", ".", -1)
+			}
+			return r.name, version
+		}
+	}
+	return "", ""
+}
+
+func (p *userAgentParser) parse(ua string) userAgentInfo {
+	var info userAgentInfo
+	info.agentFamily, info.agentVersion = matchUserAgentRules(p.agents, ua)
+	info.osFamily, info.osVersion = matchUserAgentRules(p.os, ua)
+	info.deviceCategory, _ = matchUserAgentRules(p.devices, ua)
+	for _, re := range p.bots {
+		if re.MatchString(ua) {
+			info.isBot = true
+			info.deviceCategory = "bot"
+			break
+		}
+	}
+	if info.deviceCategory == "" {
+		info.deviceCategory = "other"
+	}
+	return info
+}
+
+// Add parsed user agent fields to the record
+func enrichUserAgent(recordMap map[string]interface{}) {
+	uaParserLock.RLock()
+	parser, cache := uaParser, uaCache
+	uaParserLock.RUnlock()
+	if parser == nil {
+		return
+	}
+	ua, ok := recordMap["useragent"].(string)
+	if !ok || ua == "" {
+		return
+	}
+
+	var info userAgentInfo
+	if v, cached := cache.get(ua); cached {
+		info = v.(userAgentInfo)
+	} else {
+		info = parser.parse(ua)
+		cache.add(ua, info)
+	}
+
+	for field, value := range map[string]string{
+		uaAgentFamilyField:    info.agentFamily,
+		uaAgentVersionField:   info.agentVersion,
+		uaOSFamilyField:       info.osFamily,
+		uaOSVersionField:      info.osVersion,
+		uaDeviceCategoryField: info.deviceCategory,
+	} {
+		if value != "" {
+			recordMap[field] = value
+		}
+	}
+	recordMap[uaIsBotField] = info.isBot
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidAnalytics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("test user agent parsing", func() {
+	BeforeEach(func() {
+		config.Set(analyticsUserAgentParsing, true)
+		Expect(initUserAgent()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		config.Set(analyticsUserAgentParsing, false)
+		config.Set(analyticsUserAgentRulesFile, "")
+		Expect(initUserAgent()).To(Succeed())
+	})
+
+	It("should parse user agents with embedded rules", func() {
+		p, err := newUserAgentParser([]byte(defaultUserAgentRules))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		info := p.parse("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/58.0.3029.110 Safari/537.36 Edge/16.16299")
+		Expect(info).To(Equal(userAgentInfo{agentFamily: "Edge", agentVersion: "16.16299",
+			osFamily: "Windows", osVersion: "10.0", deviceCategory: "desktop"}))
+
+		info = p.parse("Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X) " +
+			"AppleWebKit/603.1.30 (KHTML, like Gecko) Version/10.0 Mobile/14E277 Safari/602.1")
+		Expect(info).To(Equal(userAgentInfo{agentFamily: "Safari", agentVersion: "10.0",
+			osFamily: "iOS", osVersion: "10.3", deviceCategory: "smartphone"}))
+
+		info = p.parse("Mozilla/5.0 (Linux; Android 7.0; SM-G930V Build/NRD90M) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/59.0.3071.125 Mobile Safari/537.36")
+		Expect(info).To(Equal(userAgentInfo{agentFamily: "Chrome", agentVersion: "59.0",
+			osFamily: "Android", osVersion: "7.0", deviceCategory: "smartphone"}))
+
+		info = p.parse("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+		Expect(info.agentFamily).To(Equal("Googlebot"))
+		Expect(info.isBot).To(BeTrue())
+		Expect(info.deviceCategory).To(Equal("bot"))
+
+		Expect(p.parse("unknown").deviceCategory).To(Equal("other"))
+	})
+
+	It("should add parsed fields to the record and cache them", func() {
+		record := map[string]interface{}{"useragent": "curl/7.54.0"}
+		enrichUserAgent(record)
+		Expect(record[uaAgentFamilyField]).To(Equal("curl"))
+		Expect(record[uaAgentVersionField]).To(Equal("7.54"))
+		Expect(record[uaIsBotField]).To(BeTrue())
+		Expect(record).ToNot(HaveKey(uaOSFamilyField))
+		Expect(uaCache.len()).To(Equal(1))
+
+		By("record without user agent")
+		record = map[string]interface{}{"client_id": "testapikey"}
+		enrichUserAgent(record)
+		Expect(record).To(HaveLen(1))
+
+		By("parsing disabled")
+		config.Set(analyticsUserAgentParsing, false)
+		Expect(initUserAgent()).To(Succeed())
+		record = map[string]interface{}{"useragent": "curl/7.54.0"}
+		enrichUserAgent(record)
+		Expect(record).To(HaveLen(1))
+	})
+
+	It("should use rules from file if configured", func() {
+		rulesFile := filepath.Join(testTempDir, "ua_rules.json")
+		defer os.Remove(rulesFile)
+		Expect(ioutil.WriteFile(rulesFile, []byte(`{
+			"agents": [{"regex": "^TestGateway/(\\d+)", "family": "Test Gateway"}],
+			"devices": [{"regex": "TestGateway", "category": "server"}]
+		}`), filePermissions)).To(Succeed())
+		config.Set(analyticsUserAgentRulesFile, rulesFile)
+		Expect(initUserAgent()).To(Succeed())
+
+		record := map[string]interface{}{"useragent": "TestGateway/2"}
+		enrichUserAgent(record)
+		Expect(record[uaAgentFamilyField]).To(Equal("Test Gateway"))
+		Expect(record[uaAgentVersionField]).To(Equal("2"))
+		Expect(record[uaDeviceCategoryField]).To(Equal("server"))
+		Expect(record[uaIsBotField]).To(BeFalse())
+
+		By("invalid rule")
+		Expect(ioutil.WriteFile(rulesFile, []byte(`{"bots": ["(bot"]}`),
+			filePermissions)).To(Succeed())
+		Expect(initUserAgent()).ToNot(Succeed())
+	})
+})